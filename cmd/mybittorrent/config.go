@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"karlan/torrent/internal/tracker"
+	"os"
+	"path/filepath"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// configFile is the layout of the JSON config file. Flags given on the
+// command line take precedence over it.
+type configFile struct {
+	Tracker struct {
+		Timeout   string `json:"timeout"` // A duration such as "30s"
+		Proxy     string `json:"proxy"`
+		CAFile    string `json:"ca_file"`
+		UserAgent string `json:"user_agent"`
+		NumWant   int    `json:"numwant"`
+		IP        string `json:"ip"`
+		NoPeerID  bool   `json:"no_peer_id"`
+	} `json:"tracker"`
+}
+
+// defaultConfigPath is where the config file is looked for when -config is
+// not given. It is fine for it not to exist.
+func defaultConfigPath() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "mybittorrent", "config.json")
+}
+
+// readConfig reads the tracker settings of the config file at path.
+func readConfig(path string) (tracker.Config, error) {
+	var cfg tracker.Config
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return cfg, err
+	}
+	var file configFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return cfg, fmt.Errorf("error parsing %s: %v", path, err)
+	}
+
+	if file.Tracker.Timeout != "" {
+		cfg.Timeout, err = time.ParseDuration(file.Tracker.Timeout)
+		if err != nil {
+			return cfg, fmt.Errorf("error parsing %s: invalid timeout: %v", path, err)
+		}
+	}
+	cfg.Proxy = file.Tracker.Proxy
+	cfg.CAFile = file.Tracker.CAFile
+	cfg.UserAgent = file.Tracker.UserAgent
+	cfg.NumWant = file.Tracker.NumWant
+	cfg.IP = file.Tracker.IP
+	cfg.NoPeerID = file.Tracker.NoPeerID
+	return cfg, nil
+}
+
+// trackerFlags defines the flags that set how trackers are reached on fs. The
+// returned function, to be called once fs is parsed, returns the tracker
+// configuration from the config file and those flags.
+func trackerFlags(fs *flag.FlagSet) func() tracker.Config {
+	var flags tracker.Config
+	configPath := fs.String("config", "", "config file; defaults to "+defaultConfigPath()+" if it exists")
+	fs.DurationVar(&flags.Timeout, "timeout", tracker.DefaultTimeout, "timeout of tracker requests")
+	fs.StringVar(&flags.Proxy, "proxy", "", "URL of an HTTP or SOCKS5 proxy for HTTP trackers")
+	fs.StringVar(&flags.CAFile, "ca-file", "", "PEM bundle of extra certificate authorities for HTTPS trackers")
+	fs.StringVar(&flags.UserAgent, "user-agent", "", "User-Agent of HTTP tracker requests")
+	fs.IntVar(&flags.NumWant, "numwant", 0, "number of peers to ask trackers for")
+	fs.StringVar(&flags.IP, "ip", "", "IP address to announce")
+	fs.BoolVar(&flags.NoPeerID, "no-peer-id", false, "ask trackers to leave out peer IDs")
+
+	return func() tracker.Config {
+		path := *configPath
+		if path == "" {
+			path = defaultConfigPath()
+		}
+
+		var cfg tracker.Config
+		if path != "" {
+			var err error
+			cfg, err = readConfig(path)
+			if errors.Is(err, os.ErrNotExist) && *configPath == "" {
+				err = nil
+			}
+			if err != nil {
+				log.Fatalf("Error reading config: %v", err)
+			}
+		}
+
+		fs.Visit(func(f *flag.Flag) {
+			switch f.Name {
+			case "timeout":
+				cfg.Timeout = flags.Timeout
+			case "proxy":
+				cfg.Proxy = flags.Proxy
+			case "ca-file":
+				cfg.CAFile = flags.CAFile
+			case "user-agent":
+				cfg.UserAgent = flags.UserAgent
+			case "numwant":
+				cfg.NumWant = flags.NumWant
+			case "ip":
+				cfg.IP = flags.IP
+			case "no-peer-id":
+				cfg.NoPeerID = flags.NoPeerID
+			}
+		})
+
+		cfg, err := cfg.Resolve()
+		if err != nil {
+			log.Fatalf("Error configuring trackers: %v", err)
+		}
+		return cfg
+	}
+}
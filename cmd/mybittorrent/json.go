@@ -0,0 +1,311 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"karlan/torrent/internal/bencode"
+	"math/big"
+	"strconv"
+	"unicode/utf8"
+)
+
+// Binary strings cannot be represented in JSON, so they are written as an
+// object with a single tag key, e.g. {"$hex": "d69f91e6"}. A dictionary that
+// would read as such an object, having a tag as its only key, is wrapped in
+// one more, e.g. {"$dict": {"$hex": "ab"}}. A dictionary with binary keys,
+// such as the files of a scrape response, is written as a list of key and
+// value pairs instead, e.g. {"$dict": [[{"$hex": "d69f"}, 1]]}.
+const (
+	hexTag    = "$hex"
+	base64Tag = "$base64"
+	dictTag   = "$dict"
+)
+
+func isTag(key string) bool {
+	return key == hexTag || key == base64Tag || key == dictTag
+}
+
+// readJSON parses a single JSON value and converts it into a value that
+// bencode.Marshal can encode.
+func readJSON(r io.Reader) (interface{}, error) {
+	d := json.NewDecoder(r)
+	d.UseNumber()
+
+	var v interface{}
+	if err := d.Decode(&v); err != nil {
+		return nil, err
+	}
+	if _, err := d.Token(); err != io.EOF {
+		return nil, fmt.Errorf("unexpected data after JSON value")
+	}
+	return fromJSON(v, "")
+}
+
+// fromJSON converts a decoded JSON value into its bencode equivalent. path
+// names the value for error messages.
+func fromJSON(v interface{}, path string) (interface{}, error) {
+	switch x := v.(type) {
+	case string:
+		return x, nil
+	case json.Number:
+		n, ok := new(big.Int).SetString(x.String(), 10)
+		if !ok {
+			return nil, fmt.Errorf("%s: bencode only supports integers, got %s", pathOrRoot(path), x)
+		}
+		return n, nil
+	case []interface{}:
+		list := make([]interface{}, len(x))
+		for i, elem := range x {
+			converted, err := fromJSON(elem, fmt.Sprintf("%s[%d]", path, i))
+			if err != nil {
+				return nil, err
+			}
+			list[i] = converted
+		}
+		return list, nil
+	case map[string]interface{}:
+		if value, ok := x[dictTag]; ok && len(x) == 1 {
+			switch inner := value.(type) {
+			case map[string]interface{}:
+				return fromJSONDict(inner, path)
+			case []interface{}:
+				return fromJSONPairs(inner, path)
+			default:
+				return nil, fmt.Errorf("%s: %s value must be an object or a list of pairs", pathOrRoot(path), dictTag)
+			}
+		}
+		if binary, ok, err := fromTaggedString(x, path); ok || err != nil {
+			return binary, err
+		}
+		return fromJSONDict(x, path)
+	default:
+		return nil, fmt.Errorf("%s: bencode has no equivalent of JSON %v", pathOrRoot(path), v)
+	}
+}
+
+// fromJSONDict converts the entries of a JSON object into a dictionary.
+func fromJSONDict(obj map[string]interface{}, path string) (interface{}, error) {
+	dict := make(map[string]interface{}, len(obj))
+	for key, elem := range obj {
+		converted, err := fromJSON(elem, joinPath(path, key))
+		if err != nil {
+			return nil, err
+		}
+		dict[key] = converted
+	}
+	return dict, nil
+}
+
+// fromJSONPairs converts a list of key and value pairs into a dictionary.
+// Keys are strings, which may be tagged as binary.
+func fromJSONPairs(pairs []interface{}, path string) (interface{}, error) {
+	dict := make(map[string]interface{}, len(pairs))
+	for i, elem := range pairs {
+		pairPath := fmt.Sprintf("%s[%d]", joinPath(path, dictTag), i)
+		pair, ok := elem.([]interface{})
+		if !ok || len(pair) != 2 {
+			return nil, fmt.Errorf("%s: must be a pair of key and value", pairPath)
+		}
+
+		var key string
+		switch k := pair[0].(type) {
+		case string:
+			key = k
+		case map[string]interface{}:
+			var err error
+			if key, ok, err = fromTaggedString(k, pairPath); err != nil {
+				return nil, err
+			}
+		default:
+			ok = false
+		}
+		if !ok {
+			return nil, fmt.Errorf("%s: key must be a string", pairPath)
+		}
+		if _, ok := dict[key]; ok {
+			return nil, fmt.Errorf("%s: duplicate key %q", pairPath, key)
+		}
+
+		converted, err := fromJSON(pair[1], pairPath)
+		if err != nil {
+			return nil, err
+		}
+		dict[key] = converted
+	}
+	return dict, nil
+}
+
+// fromTaggedString decodes a {"$hex": ...} or {"$base64": ...} object. It
+// reports false if the object is a regular dictionary.
+func fromTaggedString(obj map[string]interface{}, path string) (string, bool, error) {
+	if len(obj) != 1 {
+		return "", false, nil
+	}
+
+	for tag, value := range obj {
+		var decode func(string) ([]byte, error)
+		switch tag {
+		case hexTag:
+			decode = hex.DecodeString
+		case base64Tag:
+			decode = base64.StdEncoding.DecodeString
+		default:
+			return "", false, nil
+		}
+
+		s, ok := value.(string)
+		if !ok {
+			return "", true, fmt.Errorf("%s: %s value must be a string", pathOrRoot(path), tag)
+		}
+		b, err := decode(s)
+		if err != nil {
+			return "", true, fmt.Errorf("%s: invalid %s value: %v", pathOrRoot(path), tag, err)
+		}
+		return string(b), true, nil
+	}
+	return "", false, nil
+}
+
+func joinPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+func pathOrRoot(path string) string {
+	if path == "" {
+		return "value"
+	}
+	return path
+}
+
+// writeJSON writes v, as produced by a bencode.Decoder with UseDict, as JSON
+// without losing information. Dictionaries keep their key order, integers of
+// any size are written in full, and strings that are not valid UTF-8 are
+// tagged with binary, either hexTag or base64Tag. Dictionaries that look like
+// tagged objects or have binary keys are tagged with dictTag.
+func writeJSON(w io.Writer, v interface{}, binary string) error {
+	buf, err := appendJSON(nil, v, binary)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(buf, '\n'))
+	return err
+}
+
+func appendJSON(buf []byte, v interface{}, binary string) ([]byte, error) {
+	switch x := v.(type) {
+	case string:
+		return appendJSONString(buf, x, binary), nil
+	case int:
+		return strconv.AppendInt(buf, int64(x), 10), nil
+	case int64:
+		return strconv.AppendInt(buf, x, 10), nil
+	case uint64:
+		return strconv.AppendUint(buf, x, 10), nil
+	case *big.Int:
+		return x.Append(buf, 10), nil
+	case []interface{}:
+		buf = append(buf, '[')
+		for i, elem := range x {
+			if i > 0 {
+				buf = append(buf, ',')
+			}
+			var err error
+			if buf, err = appendJSON(buf, elem, binary); err != nil {
+				return nil, err
+			}
+		}
+		return append(buf, ']'), nil
+	case bencode.Dict:
+		if !validKeys(x) {
+			var err error
+			if buf, err = appendJSONPairs(fmt.Appendf(buf, `{"%s":`, dictTag), x, binary); err != nil {
+				return nil, err
+			}
+			return append(buf, '}'), nil
+		}
+		if len(x) == 1 && isTag(x[0].Key) {
+			var err error
+			if buf, err = appendJSONDict(fmt.Appendf(buf, `{"%s":`, dictTag), x, binary); err != nil {
+				return nil, err
+			}
+			return append(buf, '}'), nil
+		}
+		return appendJSONDict(buf, x, binary)
+	default:
+		return nil, fmt.Errorf("cannot write %T as JSON", v)
+	}
+}
+
+func appendJSONDict(buf []byte, x bencode.Dict, binary string) ([]byte, error) {
+	buf = append(buf, '{')
+	for i, entry := range x {
+		if i > 0 {
+			buf = append(buf, ',')
+		}
+		buf = append(buf, quoteJSON(entry.Key)...)
+		buf = append(buf, ':')
+		var err error
+		if buf, err = appendJSON(buf, entry.Value, binary); err != nil {
+			return nil, err
+		}
+	}
+	return append(buf, '}'), nil
+}
+
+// appendJSONPairs appends a dictionary as a list of key and value pairs, whose
+// keys may be binary.
+func appendJSONPairs(buf []byte, x bencode.Dict, binary string) ([]byte, error) {
+	buf = append(buf, '[')
+	for i, entry := range x {
+		if i > 0 {
+			buf = append(buf, ',')
+		}
+		buf = append(appendJSONString(append(buf, '['), entry.Key, binary), ',')
+		var err error
+		if buf, err = appendJSON(buf, entry.Value, binary); err != nil {
+			return nil, err
+		}
+		buf = append(buf, ']')
+	}
+	return append(buf, ']'), nil
+}
+
+func validKeys(x bencode.Dict) bool {
+	for _, entry := range x {
+		if !utf8.ValidString(entry.Key) {
+			return false
+		}
+	}
+	return true
+}
+
+// appendJSONString appends s as a JSON string, or as a tagged object if it is
+// binary.
+func appendJSONString(buf []byte, s string, binary string) []byte {
+	if utf8.ValidString(s) {
+		return append(buf, quoteJSON(s)...)
+	}
+
+	if binary == base64Tag {
+		return fmt.Appendf(buf, `{"%s":"%s"}`, base64Tag, base64.StdEncoding.EncodeToString([]byte(s)))
+	}
+	return fmt.Appendf(buf, `{"%s":"%s"}`, hexTag, hex.EncodeToString([]byte(s)))
+}
+
+// quoteJSON returns s as a JSON string. Unlike json.Marshal it leaves <, >
+// and & alone, since the output is meant to be read rather than embedded in
+// HTML.
+func quoteJSON(s string) []byte {
+	var b bytes.Buffer
+	enc := json.NewEncoder(&b)
+	enc.SetEscapeHTML(false)
+	enc.Encode(s)
+	return bytes.TrimSuffix(b.Bytes(), []byte("\n"))
+}
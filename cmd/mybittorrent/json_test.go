@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bytes"
+	"karlan/torrent/internal/bencode"
+	"strings"
+	"testing"
+)
+
+// decodeToJSON decodes bencoded the way the decode command does and returns
+// the JSON it writes.
+func decodeToJSON(t *testing.T, bencoded, binary string) string {
+	t.Helper()
+	d := bencode.NewDecoder(strings.NewReader(bencoded))
+	d.UseDict()
+	var v interface{}
+	if err := d.Decode(&v); err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	if err := writeJSON(&out, v, binary); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return strings.TrimSuffix(out.String(), "\n")
+}
+
+// encodeFromJSON encodes JSON the way the encode command does.
+func encodeFromJSON(t *testing.T, input string) string {
+	t.Helper()
+	v, err := readJSON(strings.NewReader(input))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var out bytes.Buffer
+	if err := bencode.NewEncoder(&out).Encode(v); err != nil {
+		t.Fatal(err)
+	}
+	return out.String()
+}
+
+func TestJSONRoundTrip(t *testing.T) {
+	tests := []struct {
+		name     string
+		bencoded string
+		binary   string
+		want     string
+	}{
+		{"binary keys", "d1:ai2e2:\xab\xcdi1ee", hexTag, `{"$dict":[["a",2],[{"$hex":"abcd"},1]]}`},
+		{"binary keys in base64", "d2:\xab\xcdi1ee", base64Tag, `{"$dict":[[{"$base64":"q80="},1]]}`},
+		{"scrape response", "d5:filesd2:\xff\x01d8:completei3eeee", hexTag, `{"files":{"$dict":[[{"$hex":"ff01"},{"complete":3}]]}}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			have := decodeToJSON(t, tt.bencoded, tt.binary)
+			if have != tt.want {
+				t.Errorf("have %s, want %s", have, tt.want)
+			}
+			if back := encodeFromJSON(t, have); back != tt.bencoded {
+				t.Errorf("have %q after a round trip, want %q", back, tt.bencoded)
+			}
+		})
+	}
+}
+
+func TestReadJSON(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{"integer", `52`, "i52e"},
+		{"negative integer", `-7`, "i-7e"},
+		{"big integer", `123456789012345678901234567890`, "i123456789012345678901234567890e"},
+		{"string", `"hé <&>"`, "7:h\xc3\xa9 <&>"},
+		{"list", `[1, "a", []]`, "li1e1:alee"},
+		{"dictionary in sorted order", `{"b": 1, "a": {"c": "d"}}`, "d1:ad1:c1:de1:bi1ee"},
+		{"hex string", `{"$hex": "d69f91e6"}`, "4:\xd6\x9f\x91\xe6"},
+		{"base64 string", `{"$base64": "q80="}`, "2:\xab\xcd"},
+		{"tag with another key", `{"$hex": "ab", "a": 1}`, "d4:$hex2:ab1:ai1ee"},
+		{"escaped dictionary", `{"$dict": {"$hex": "ab"}}`, "d4:$hex2:abe"},
+		{"escaped escape", `{"$dict": {"$dict": {}}}`, "d5:$dictdee"},
+		{"pairs", `{"$dict": [[{"$hex": "ff"}, 1], ["a", {"$base64": "AA=="}]]}`, "d1:a1:\x001:\xffi1ee"},
+		{"empty pairs", `{"$dict": []}`, "de"},
+		{"surrounding whitespace", " \n[]\n", "le"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if have := encodeFromJSON(t, tt.input); have != tt.want {
+				t.Errorf("have %q, want %q", have, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadJSONErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{"fraction", `1.5`, "value: bencode only supports integers, got 1.5"},
+		{"exponent", `{"a": [1e3]}`, "a[0]: bencode only supports integers, got 1e3"},
+		{"boolean", `[true]`, "[0]: bencode has no equivalent of JSON true"},
+		{"null", `{"a": {"b": null}}`, "a.b: bencode has no equivalent of JSON <nil>"},
+		{"invalid hex", `{"$hex": "xy"}`, "value: invalid $hex value"},
+		{"invalid base64", `{"a": {"$base64": "!"}}`, "a: invalid $base64 value"},
+		{"tag of a number", `{"$hex": 1}`, "value: $hex value must be a string"},
+		{"dictionary tag of a string", `{"$dict": "a"}`, "value: $dict value must be an object or a list of pairs"},
+		{"pair of one", `{"$dict": [["a"]]}`, "$dict[0]: must be a pair of key and value"},
+		{"pair with a number key", `{"a": {"$dict": [[1, 2]]}}`, "a.$dict[0]: key must be a string"},
+		{"pair with an object key", `{"$dict": [[{"a": "b"}, 2]]}`, "$dict[0]: key must be a string"},
+		{"duplicate pair keys", `{"$dict": [["a", 1], [{"$hex": "61"}, 2]]}`, `$dict[1]: duplicate key "a"`},
+		{"bad pair value", `{"$dict": [["a", 1.5]]}`, "$dict[0]: bencode only supports integers"},
+		{"trailing data", `1 2`, "unexpected data after JSON value"},
+		{"invalid JSON", `{`, "unexpected EOF"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := readJSON(strings.NewReader(tt.input))
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("have error %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestJSONBencodeRoundTrip(t *testing.T) {
+	// Each input is written the way decode writes it, so it must come back
+	// unchanged
+	tests := []string{
+		`123456789012345678901234567890`,
+		`-123456789012345678901234567890`,
+		`"<a & b>"`,
+		`{"$hex":"00ff"}`,
+		`["a",{"$hex":"ff"},[1,[]],{}]`,
+		`{"$dict":{"$hex":"ab"}}`,
+		`{"$dict":{"$base64":{"$hex":"ab"}}}`,
+		`{"$dict":{"$dict":{}}}`,
+		`{"$hex":"ab","a":1}`,
+		`{"$dict":[["a",1],[{"$hex":"ff"},{"$dict":[[{"$hex":"fe"},2]]}]]}`,
+		`{"info":{"length":5,"name":"a.txt","pieces":{"$hex":"d69f91e6"}}}`,
+	}
+
+	for _, input := range tests {
+		t.Run(input, func(t *testing.T) {
+			if have := decodeToJSON(t, encodeFromJSON(t, input), hexTag); have != input {
+				t.Errorf("have %s, want %s", have, input)
+			}
+		})
+	}
+}
+
+func TestWriteJSON(t *testing.T) {
+	tests := []struct {
+		name     string
+		bencoded string
+		binary   string
+		want     string
+	}{
+		{"big integer", "i-123456789012345678901234567890e", hexTag, `-123456789012345678901234567890`},
+		{"text", "7:<a & b>", hexTag, `"<a & b>"`},
+		{"binary string", "2:\xab\xcd", hexTag, `{"$hex":"abcd"}`},
+		{"binary string in base64", "2:\xab\xcd", base64Tag, `{"$base64":"q80="}`},
+		{"key order kept", "d1:bi1e1:ai2ee", hexTag, `{"b":1,"a":2}`},
+		{"dictionary like a hex string", "d4:$hex2:abe", hexTag, `{"$dict":{"$hex":"ab"}}`},
+		{"dictionary like a base64 string", "d7:$base644:q80=e", hexTag, `{"$dict":{"$base64":"q80="}}`},
+		{"dictionary like an escaped one", "d5:$dictdee", hexTag, `{"$dict":{"$dict":{}}}`},
+		{"tag among other keys", "d4:$hex2:ab1:ai1ee", hexTag, `{"$hex":"ab","a":1}`},
+		{"nested", "ld1:xl1:\xffeee", hexTag, `[{"x":[{"$hex":"ff"}]}]`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if have := decodeToJSON(t, tt.bencoded, tt.binary); have != tt.want {
+				t.Errorf("have %s, want %s", have, tt.want)
+			}
+		})
+	}
+}
@@ -1,8 +1,9 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
 	"encoding/hex"
-	"encoding/json"
 	"fmt"
 	"karlan/torrent/internal/bencode"
 	"karlan/torrent/internal/client"
@@ -12,19 +13,114 @@ import (
 	"karlan/torrent/internal/torrent"
 	"karlan/torrent/internal/tracker"
 
+	"io"
+	"net/http"
 	"os"
-	"sync"
+	"os/signal"
+	"syscall"
+	"time"
+	"unicode"
 
 	log "github.com/sirupsen/logrus"
 )
 
-func decodeBencodedString(encoding string) {
-	decoded, err := bencode.Decode(encoding)
+func decodeBencode(input io.Reader, format, binary string) {
+	d := bencode.NewDecoder(input)
+
+	if format == "tree" {
+		if err := writeTree(os.Stdout, d); err != nil {
+			log.Fatalf("Error decoding bencode: %v", err)
+		}
+		if err := checkTrailingData(d, input); err != nil {
+			log.Fatalf("Error decoding bencode: %v", err)
+		}
+		return
+	}
+
+	d.UseDict()
+	var decoded interface{}
+	if err := d.Decode(&decoded); err != nil {
+		log.Fatalf("Error decoding bencode: %v", err)
+	}
+	if err := checkTrailingData(d, input); err != nil {
+		log.Fatalf("Error decoding bencode: %v", err)
+	}
+	if err := writeJSON(os.Stdout, decoded, binary); err != nil {
+		log.Fatalf("Error writing JSON: %v", err)
+	}
+}
+
+// checkTrailingData fails if anything but whitespace, such as the newline echo
+// adds, follows the value decoded from input.
+func checkTrailingData(d *bencode.Decoder, input io.Reader) error {
+	offset := d.InputOffset()
+	rest := bufio.NewReader(io.MultiReader(d.Buffered(), input))
+	for {
+		c, err := rest.ReadByte()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if !unicode.IsSpace(rune(c)) {
+			return fmt.Errorf("unexpected data after bencoded value at offset %d", offset)
+		}
+		offset++
+	}
+}
+
+func queryBencode(input io.Reader, expression, format, binary string) {
+	segments, err := parseQuery(expression)
 	if err != nil {
+		log.Fatalf("Invalid query %q: %v", expression, err)
+	}
+
+	d := bencode.NewDecoder(input)
+	d.UseDict()
+	var decoded interface{}
+	if err := d.Decode(&decoded); err != nil {
 		log.Fatalf("Error decoding bencode: %v", err)
 	}
-	jsonOutput, _ := json.Marshal(decoded)
-	fmt.Printf("Decoded JSON: %s\n", string(jsonOutput))
+
+	matches := evalQuery(decoded, segments)
+	if len(matches) == 0 {
+		log.Fatalf("No values match %q", expression)
+	}
+	for _, match := range matches {
+		if err := writeQueryResult(os.Stdout, match, format, binary); err != nil {
+			log.Fatalf("Error writing result: %v", err)
+		}
+	}
+}
+
+func encodeJSON(input io.Reader) {
+	value, err := readJSON(input)
+	if err != nil {
+		log.Fatalf("Error reading JSON: %v", err)
+	}
+	err = bencode.NewEncoder(os.Stdout).Encode(value)
+	if err != nil {
+		log.Fatalf("Error encoding bencode: %v", err)
+	}
+}
+
+func createTorrent(path, outputPath string, opts torrent.CreateOptions) {
+	log.Infof("Creating torrent for %s", path)
+
+	// The torrent may be written into the directory it is made of, so it
+	// must not list itself, and is only written once complete
+	opts.Exclude = append(opts.Exclude, outputPath)
+	var out bytes.Buffer
+	infoHash, err := torrent.Create(&out, path, opts)
+	if err != nil {
+		log.Fatalf("Error creating torrent: %v", err)
+	}
+	if err := os.WriteFile(outputPath, out.Bytes(), 0644); err != nil {
+		log.Fatalf("Error writing torrent file: %v", err)
+	}
+	log.Infof("Wrote torrent to %s", outputPath)
+	fmt.Printf("Created %s with info hash %s\n", outputPath, hex.EncodeToString(infoHash[:]))
 }
 
 func printTorrentInfo(filePath string) {
@@ -35,11 +131,14 @@ func printTorrentInfo(filePath string) {
 	log.Infof("Torrent info for %s has been printed.\n", filePath)
 }
 
-func printPeers(filePath string) {
+func printPeers(filePath string, cfg tracker.Config) {
 	log.Infof("Opening torrent file: %s", filePath)
 	torrent := torrent.Open(filePath)
 	log.Infof("Fetching peers from tracker")
-	interval, clients := tracker.GET(torrent)
+	interval, clients, err := tracker.GET(torrent, cfg)
+	if err != nil {
+		log.Fatalf("Error fetching peers: %v", err)
+	}
 	log.Debugf("Tracker interval: %v", interval)
 	fmt.Printf("Found %d peers.\n", len(clients))
 	for _, client := range clients {
@@ -47,6 +146,123 @@ func printPeers(filePath string) {
 	}
 }
 
+// scrapeTorrents prints the tracker statistics of each torrent. Torrents
+// sharing a tracker are scraped together, and a torrent whose tracker fails
+// or does not know it is tried at its next tracker.
+func scrapeTorrents(filePaths []string, cfg tracker.Config) {
+	type scrape struct {
+		name     string
+		infoHash [20]byte
+		trackers []string // Left to try, in order
+		result   *tracker.ScrapeResult
+		tracker  string
+		err      error
+	}
+
+	scrapes := make([]*scrape, len(filePaths))
+	for i, filePath := range filePaths {
+		log.Infof("Opening torrent file: %s", filePath)
+		t := torrent.Open(filePath)
+		s := &scrape{name: t.GetName(), infoHash: t.InfoHash, err: tracker.ErrNoTrackers}
+		for _, tier := range t.Trackers() {
+			s.trackers = append(s.trackers, tier...)
+		}
+		scrapes[i] = s
+	}
+
+	for {
+		// Group the torrents still waiting by the tracker to try next
+		var announces []string
+		groups := make(map[string][]*scrape)
+		for _, s := range scrapes {
+			if s.result != nil || len(s.trackers) == 0 {
+				continue
+			}
+			announce := s.trackers[0]
+			s.trackers = s.trackers[1:]
+			if groups[announce] == nil {
+				announces = append(announces, announce)
+			}
+			groups[announce] = append(groups[announce], s)
+		}
+		if len(announces) == 0 {
+			break
+		}
+
+		for _, announce := range announces {
+			group := groups[announce]
+			infoHashes := make([][20]byte, len(group))
+			for i, s := range group {
+				infoHashes[i] = s.infoHash
+			}
+
+			log.Infof("Scraping %d torrents from tracker %s", len(group), announce)
+			results, err := tracker.Scrape(announce, infoHashes, cfg)
+			if err != nil {
+				log.Warnf("Error scraping tracker %s: %v", announce, err)
+			}
+			for _, s := range group {
+				s.err = err
+				if err == nil {
+					s.err = fmt.Errorf("torrent not known to tracker %s", announce)
+				}
+				for i := range results {
+					if results[i].InfoHash == s.infoHash {
+						s.result, s.tracker, s.err = &results[i], announce, nil
+					}
+				}
+			}
+		}
+	}
+
+	failed := false
+	for _, s := range scrapes {
+		if s.err != nil {
+			fmt.Printf("%s: %v\n", s.name, s.err)
+			failed = true
+			continue
+		}
+		fmt.Printf("%s: %d seeders, %d leechers, %d completed (%s)\n", s.name, s.result.Seeders, s.result.Leechers, s.result.Completed, s.tracker)
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// listenForPeers listens on the first free port from the torrent's port on,
+// within the range BitTorrent clients traditionally use, and makes it the port
+// announced to trackers. It returns nil if no port is free, in which case
+// only outgoing connections are made.
+func listenForPeers(t *torrent.Torrent) *client.Listener {
+	const lastPort = 6889
+	for port := t.Port; port <= max(t.Port, lastPort); port++ {
+		listener, err := client.Listen(fmt.Sprintf(":%d", port))
+		if err != nil {
+			log.Warnf("Cannot listen on port %d: %v", port, err)
+			continue
+		}
+		t.Port = listener.Port()
+		return listener
+	}
+	log.Warn("No port free to listen for peers on")
+	return nil
+}
+
+func serveTracker(addr, allowDir string, interval time.Duration) {
+	opts := tracker.ServerOptions{Interval: interval}
+	if allowDir != "" {
+		allowList, err := tracker.LoadAllowList(allowDir)
+		if err != nil {
+			log.Fatalf("Error loading allowed torrents: %v", err)
+		}
+		log.Infof("Tracking %d torrents from %s", len(allowList), allowDir)
+		opts.AllowList = allowList
+	}
+
+	fmt.Printf("Tracker listening on %s\n", addr)
+	log.Fatalf("Error serving tracker: %v", http.ListenAndServe(addr, tracker.NewServer(opts)))
+}
+
 func performHandshakeWithPeer(address, filePath string) {
 	log.Infof("Opening torrent file: %s", filePath)
 	torrent := torrent.Open(filePath)
@@ -63,13 +279,16 @@ func performHandshakeWithPeer(address, filePath string) {
 	fmt.Printf("Handshake successful with peer at address %s. Peer ID: %s\n", address, hex.EncodeToString(client.PeerID[:]))
 }
 
-func downloadPiece(torrentPath, outputPath string, pieceIndex int) {
+func downloadPiece(torrentPath, outputPath string, pieceIndex int, cfg tracker.Config) {
 	log.Infof("Opening torrent file: %s", torrentPath)
 	torrent := torrent.Open(torrentPath)
 	log.Debugf("Printing torrent info")
 	torrent.Log()
 	log.Infof("Fetching peers from tracker")
-	interval, clients := tracker.GET(torrent)
+	interval, clients, err := tracker.GET(torrent, cfg)
+	if err != nil {
+		log.Fatalf("Error fetching peers: %v", err)
+	}
 	log.Debugf("Tracker interval: %v", interval)
 
 	for i, c := range clients {
@@ -96,41 +315,102 @@ func downloadPiece(torrentPath, outputPath string, pieceIndex int) {
 	}
 }
 
-func downloadFile(torrentPath, outputPath string) {
+func downloadFile(torrentPath, outputPath string, uploadSlots int, cfg tracker.Config) {
 	log.Infof("Opening torrent file: %s", torrentPath)
 	t := torrent.Open(torrentPath)
 	log.Debugf("Printing torrent info")
 	t.Log()
-	log.Infof("Fetching peers from tracker")
-	interval, clients := tracker.GET(t)
-	log.Debugf("Tracker interval: %v", interval)
 
+	// The announcer keeps feeding peers from the trackers into the swarm, and
+	// peers that find us through the trackers connect to the listener
 	q := queue.NewQueue(t.GetNumberOfPieces())
-	var wg sync.WaitGroup
-	for i, c := range clients {
-		log.Debugf("Index of clients: %d", i)
-		log.Infof("Initiating connection with client %s", c.Address())
-		err := (&c).Init(t.InfoHash, t.PeerID)
-		if err != nil {
-			log.Warnf("Error initializing client: %s, Error: %v", c.Address(), err)
-			continue
-		}
-
-		log.Infof("Downloading file %v from client %s", t.GetName(), c.Address())
-		wg.Add(1)
-		go download.DownloadFile(&c, t, q, &wg)
+	choker := download.NewChoker(t, uploadSlots)
+	choker.Start()
+	defer choker.Stop()
+	swarm := download.NewSwarm(t, q, choker)
+	if listener := listenForPeers(t); listener != nil {
+		defer listener.Close()
+		listener.Register(t.InfoHash, t.PeerID, t.Bitfield, swarm.AcceptPeer)
+	}
+	announcer := tracker.NewAnnouncer(t, cfg, swarm.AddPeers)
+	log.Infof("Fetching peers from tracker")
+	if err := announcer.Start(); err != nil {
+		log.Fatalf("Error fetching peers: %v", err)
 	}
 
-	wg.Wait()
+	// The download runs until every piece is in, waiting for more peers when
+	// it runs out, or until it is interrupted
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-stop
+		log.Infof("Interrupted, stopping download")
+		swarm.Stop()
+	}()
+	swarm.Wait()
+	signal.Stop(stop)
 	t.Log()
 
 	// Verify the integrity of each piece and check that everything is downloaded
 	if !t.FinishedDownloading() {
-		log.Errorf("Torrent finished downloading with missing pieces")
+		announcer.Stop()
+		log.Errorf("Download stopped with missing pieces")
+		fmt.Println("Download stopped with missing pieces")
 		os.Exit(1)
 	}
+	announcer.Completed()
+	announcer.Stop()
 
-	fileio.WriteToAbsolutePath(outputPath, t.GetData())
-	log.Infof("Writing torrent to file %s", outputPath)
+	// A single file is written to the output path, while the files of a
+	// multi-file torrent are laid out in a directory under it
+	if t.IsMultiFile() {
+		log.Infof("Writing torrent files under %s", outputPath)
+		if err := t.WriteFiles(outputPath); err != nil {
+			log.Fatalf("Error writing files: %v", err)
+		}
+	} else {
+		log.Infof("Writing torrent to file %s", outputPath)
+		fileio.WriteToAbsolutePath(outputPath, t.GetData())
+	}
 	fmt.Printf("Downloaded and wrote torrent to %s\n", outputPath)
 }
+
+func seedTorrent(torrentPath, contentPath string, uploadSlots int, cfg tracker.Config) {
+	log.Infof("Opening torrent file: %s", torrentPath)
+	t := torrent.Open(torrentPath)
+	t.Log()
+
+	log.Infof("Verifying content at %s", contentPath)
+	verified, err := t.VerifyContent(contentPath)
+	if err != nil {
+		log.Fatalf("Error verifying content: %v", err)
+	}
+	if verified != t.GetNumberOfPieces() {
+		log.Fatalf("Content at %s has %d of %d pieces intact", contentPath, verified, t.GetNumberOfPieces())
+	}
+
+	listener := listenForPeers(t)
+	if listener == nil {
+		log.Fatalf("Cannot seed without a port to listen on")
+	}
+	defer listener.Close()
+	choker := download.NewChoker(t, uploadSlots)
+	choker.Start()
+	defer choker.Stop()
+	listener.Register(t.InfoHash, t.PeerID, t.Bitfield, func(c client.Client) { go download.Seed(&c, choker) })
+
+	announcer := tracker.NewAnnouncer(t, cfg, nil)
+	log.Infof("Announcing to tracker")
+	if err := announcer.Start(); err != nil {
+		log.Fatalf("Error announcing: %v", err)
+	}
+	fmt.Printf("Seeding %s on port %d\n", t.GetName(), t.Port)
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	<-stop
+
+	announcer.Stop()
+	uploaded, _, _ := t.Stats()
+	fmt.Printf("Stopped seeding after uploading %d bytes\n", uploaded)
+}
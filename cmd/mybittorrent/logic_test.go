@@ -0,0 +1,32 @@
+package main
+
+import (
+	"karlan/torrent/internal/bencode"
+	"strings"
+	"testing"
+)
+
+func TestCheckTrailingData(t *testing.T) {
+	tests := []struct {
+		input   string
+		wantErr bool
+	}{
+		{"i5e", false},
+		{"i5e\n", false},
+		{"i5e \t\r\n", false},
+		{"i5ei6e", true},
+		{"i5e\nx", true},
+	}
+
+	for _, tt := range tests {
+		input := strings.NewReader(tt.input)
+		d := bencode.NewDecoder(input)
+		var v interface{}
+		if err := d.Decode(&v); err != nil {
+			t.Fatalf("%q: %v", tt.input, err)
+		}
+		if err := checkTrailingData(d, input); (err != nil) != tt.wantErr {
+			t.Errorf("%q: have error %v, want error %v", tt.input, err, tt.wantErr)
+		}
+	}
+}
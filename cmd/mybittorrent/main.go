@@ -3,9 +3,13 @@ package main
 import (
 	"flag"
 	"fmt"
+	"karlan/torrent/internal/download"
+	"karlan/torrent/internal/torrent"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 )
@@ -44,8 +48,10 @@ func init() {
 		log.Fatalf("Failed to open log file: %v", err)
 	}
 
-	// Output to the log file instead of the default stderr
+	// Output to the log file instead of the default stderr, except for the
+	// errors that end a command
 	log.SetOutput(logFile)
+	log.AddHook(stderrHook{})
 
 	// Set the log level based on the flag
 	level, err := log.ParseLevel(logLevel)
@@ -55,6 +61,19 @@ func init() {
 	log.SetLevel(level)
 }
 
+// stderrHook prints fatal errors on stderr as well, so that a failing command
+// says why.
+type stderrHook struct{}
+
+func (stderrHook) Levels() []log.Level {
+	return []log.Level{log.PanicLevel, log.FatalLevel}
+}
+
+func (stderrHook) Fire(entry *log.Entry) error {
+	_, err := fmt.Fprintln(os.Stderr, entry.Message)
+	return err
+}
+
 func main() {
 	defer logFile.Close()
 
@@ -66,11 +85,17 @@ func main() {
 
 	commands := map[string]func(){
 		"decode":         decodeCommand,
+		"encode":         encodeCommand,
+		"query":          queryCommand,
+		"create":         createCommand,
 		"info":           infoCommand,
 		"peers":          peersCommand,
+		"scrape":         scrapeCommand,
+		"tracker":        trackerCommand,
 		"handshake":      handshakeCommand,
 		"download_piece": downloadPieceCommand,
 		"download":       downloadFileCommand,
+		"seed":           seedCommand,
 	}
 
 	if cmdFunc, exists := commands[command]; exists {
@@ -82,11 +107,143 @@ func main() {
 }
 
 func decodeCommand() {
-	if len(os.Args) < 3 {
-		fmt.Println("Usage: ./bittorrent.sh decode <bencoded_string>")
+	usage := "Usage: ./bittorrent.sh decode [-file <path>] [-format json|tree] [-binary hex|base64] [<bencoded_data>]"
+
+	fs := flag.NewFlagSet("decode", flag.ExitOnError)
+	fs.Usage = func() { fmt.Println(usage) }
+	file := fs.String("file", "", "read the bencoded data from a file")
+	format := fs.String("format", "json", "output format: json or tree")
+	binary := fs.String("binary", "hex", "encoding of binary strings in JSON: hex or base64")
+	fs.String("loglevel", "trace", "set the log level")
+	fs.Parse(os.Args[2:])
+
+	if (*format != "json" && *format != "tree") || (*binary != "hex" && *binary != "base64") {
+		fmt.Println(usage)
+		os.Exit(1)
+	}
+	binaryTag := hexTag
+	if *binary == "base64" {
+		binaryTag = base64Tag
+	}
+
+	// Read the data from the file, the argument, or stdin if neither is given
+	switch {
+	case *file != "":
+		f, err := os.Open(*file)
+		if err != nil {
+			log.Fatalf("Error opening file: %v", err)
+		}
+		defer f.Close()
+		decodeBencode(f, *format, binaryTag)
+	case fs.NArg() == 0 || fs.Arg(0) == "-":
+		decodeBencode(os.Stdin, *format, binaryTag)
+	default:
+		decodeBencode(strings.NewReader(fs.Arg(0)), *format, binaryTag)
+	}
+}
+
+func encodeCommand() {
+	// Read the JSON from the argument, or from stdin if it is missing or "-"
+	if len(os.Args) < 3 || os.Args[2] == "-" {
+		encodeJSON(os.Stdin)
+		return
+	}
+	encodeJSON(strings.NewReader(os.Args[2]))
+}
+
+func queryCommand() {
+	usage := "Usage: ./bittorrent.sh query [-format raw|hex|json] [-binary hex|base64] <path> [<file_path>]"
+
+	fs := flag.NewFlagSet("query", flag.ExitOnError)
+	fs.Usage = func() { fmt.Println(usage) }
+	format := fs.String("format", "raw", "output format: raw, hex or json")
+	binary := fs.String("binary", "hex", "encoding of binary strings in JSON: hex or base64")
+	fs.String("loglevel", "trace", "set the log level")
+	fs.Parse(os.Args[2:])
+
+	if fs.NArg() < 1 || (*format != "raw" && *format != "hex" && *format != "json") || (*binary != "hex" && *binary != "base64") {
+		fmt.Println(usage)
+		os.Exit(1)
+	}
+	binaryTag := hexTag
+	if *binary == "base64" {
+		binaryTag = base64Tag
+	}
+
+	// Read the data from the file, or from stdin if it is missing or "-"
+	if fs.NArg() < 2 || fs.Arg(1) == "-" {
+		queryBencode(os.Stdin, fs.Arg(0), *format, binaryTag)
+		return
+	}
+	f, err := os.Open(fs.Arg(1))
+	if err != nil {
+		log.Fatalf("Error opening file: %v", err)
+	}
+	defer f.Close()
+	queryBencode(f, fs.Arg(0), *format, binaryTag)
+}
+
+// stringList collects the values of a flag that can be repeated.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, " ")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+func createCommand() {
+	usage := "Usage: ./bittorrent.sh create [-o <output_path>] -announce <url[,url...]> [-announce ...] [-comment <text>] [-created-by <name>] [-private] [-webseed <url>] [-piece-length <bytes>] [-no-date] <path>"
+
+	var announce, webSeeds stringList
+	fs := flag.NewFlagSet("create", flag.ExitOnError)
+	fs.Usage = func() { fmt.Println(usage) }
+	output := fs.String("o", "", "where to write the torrent; defaults to <name>.torrent")
+	fs.Var(&announce, "announce", "comma-separated tracker URLs of one tier; repeat for more tiers")
+	comment := fs.String("comment", "", "comment stored in the torrent")
+	createdBy := fs.String("created-by", "mybittorrent", "software named as the creator")
+	private := fs.Bool("private", false, "only use peers from the trackers")
+	fs.Var(&webSeeds, "webseed", "URL of a web seed; repeat for more")
+	pieceLength := fs.Int("piece-length", 0, "piece length in bytes; chosen from the content size if 0")
+	noDate := fs.Bool("no-date", false, "leave out the creation date")
+	fs.String("loglevel", "trace", "set the log level")
+	fs.Parse(os.Args[2:])
+
+	if fs.NArg() != 1 || len(announce) == 0 {
+		fmt.Println(usage)
 		os.Exit(1)
 	}
-	decodeBencodedString(os.Args[2])
+
+	opts := torrent.CreateOptions{
+		Comment:     *comment,
+		CreatedBy:   *createdBy,
+		Private:     *private,
+		WebSeeds:    webSeeds,
+		PieceLength: *pieceLength,
+	}
+	for _, tier := range announce {
+		opts.AnnounceList = append(opts.AnnounceList, strings.Split(tier, ","))
+	}
+	if len(opts.AnnounceList) == 1 && len(opts.AnnounceList[0]) == 1 {
+		// A single tracker needs no announce-list
+		opts.Announce = opts.AnnounceList[0][0]
+		opts.AnnounceList = nil
+	}
+	if !*noDate {
+		opts.CreationDate = time.Now()
+	}
+
+	if *output == "" {
+		abs, err := filepath.Abs(fs.Arg(0))
+		if err != nil {
+			log.Fatalf("Error resolving %s: %v", fs.Arg(0), err)
+		}
+		*output = filepath.Base(abs) + ".torrent"
+	}
+	createTorrent(fs.Arg(0), *output, opts)
 }
 
 func infoCommand() {
@@ -97,12 +254,62 @@ func infoCommand() {
 	printTorrentInfo(os.Args[2])
 }
 
+// trackerUsage lists the flags defined by trackerFlags.
+const trackerUsage = "[-config <file>] [-timeout <duration>] [-proxy <url>] [-ca-file <file>] [-user-agent <name>] [-numwant <n>] [-ip <address>] [-no-peer-id]"
+
 func peersCommand() {
-	if len(os.Args) < 3 {
-		fmt.Println("Usage: ./bittorrent.sh peers <file_path>")
+	usage := "Usage: ./bittorrent.sh peers " + trackerUsage + " <file_path>"
+
+	fs := flag.NewFlagSet("peers", flag.ExitOnError)
+	fs.Usage = func() { fmt.Println(usage) }
+	trackerConfig := trackerFlags(fs)
+	fs.String("loglevel", "trace", "set the log level")
+	fs.Parse(os.Args[2:])
+
+	if fs.NArg() != 1 {
+		fmt.Println(usage)
+		os.Exit(1)
+	}
+	printPeers(fs.Arg(0), trackerConfig())
+}
+
+func scrapeCommand() {
+	usage := "Usage: ./bittorrent.sh scrape " + trackerUsage + " <file_path> [<file_path>...]"
+
+	fs := flag.NewFlagSet("scrape", flag.ExitOnError)
+	fs.Usage = func() { fmt.Println(usage) }
+	trackerConfig := trackerFlags(fs)
+	fs.String("loglevel", "trace", "set the log level")
+	fs.Parse(os.Args[2:])
+
+	if fs.NArg() < 1 {
+		fmt.Println(usage)
 		os.Exit(1)
 	}
-	printPeers(os.Args[2])
+	scrapeTorrents(fs.Args(), trackerConfig())
+}
+
+func trackerCommand() {
+	usage := "Usage: ./bittorrent.sh tracker serve [-addr <host:port>] [-allow <torrent_dir>] [-interval <duration>]"
+
+	if len(os.Args) < 3 || os.Args[2] != "serve" {
+		fmt.Println(usage)
+		os.Exit(1)
+	}
+
+	fs := flag.NewFlagSet("tracker serve", flag.ExitOnError)
+	fs.Usage = func() { fmt.Println(usage) }
+	addr := fs.String("addr", ":6969", "address to listen on")
+	allow := fs.String("allow", "", "only track the torrents in this directory of .torrent files")
+	interval := fs.Duration("interval", 30*time.Minute, "how often clients should announce")
+	fs.String("loglevel", "trace", "set the log level")
+	fs.Parse(os.Args[3:])
+
+	if fs.NArg() != 0 {
+		fmt.Println(usage)
+		os.Exit(1)
+	}
+	serveTracker(*addr, *allow, *interval)
 }
 
 func handshakeCommand() {
@@ -114,23 +321,59 @@ func handshakeCommand() {
 }
 
 func downloadPieceCommand() {
-	if len(os.Args) < 6 || os.Args[2] != "-o" {
-		fmt.Println("Usage: ./bittorrent.sh download_piece -o <output_path> <torrent_path> <piece_index>")
+	usage := "Usage: ./bittorrent.sh download_piece -o <output_path> " + trackerUsage + " <torrent_path> <piece_index>"
+
+	fs := flag.NewFlagSet("download_piece", flag.ExitOnError)
+	fs.Usage = func() { fmt.Println(usage) }
+	output := fs.String("o", "", "where to write the piece")
+	trackerConfig := trackerFlags(fs)
+	fs.String("loglevel", "trace", "set the log level")
+	fs.Parse(os.Args[2:])
+
+	if *output == "" || fs.NArg() != 2 {
+		fmt.Println(usage)
 		os.Exit(1)
 	}
-	pieceIndex, err := strconv.Atoi(os.Args[5])
+	pieceIndex, err := strconv.Atoi(fs.Arg(1))
 	if err != nil {
 		fmt.Println("Invalid piece index")
-		fmt.Println("Usage: ./bittorrent.sh download_piece -o <output_path> <torrent_path> <piece_index>")
+		fmt.Println(usage)
 		os.Exit(1)
 	}
-	downloadPiece(os.Args[4], os.Args[3], pieceIndex)
+	downloadPiece(fs.Arg(0), *output, pieceIndex, trackerConfig())
 }
 
 func downloadFileCommand() {
-	if len(os.Args) < 5 || os.Args[2] != "-o" {
-		fmt.Println("Usage: ./bittorrent.sh download -o <output_path> <torrent_path>")
+	usage := "Usage: ./bittorrent.sh download -o <output_path|output_dir> [-upload-slots <n>] " + trackerUsage + " <torrent_path>"
+
+	fs := flag.NewFlagSet("download", flag.ExitOnError)
+	fs.Usage = func() { fmt.Println(usage) }
+	output := fs.String("o", "", "where to write the file, or the directory of a multi-file torrent")
+	uploadSlots := fs.Int("upload-slots", download.DefaultUploadSlots, "number of peers to upload to for their rates, besides one optimistic unchoke")
+	trackerConfig := trackerFlags(fs)
+	fs.String("loglevel", "trace", "set the log level")
+	fs.Parse(os.Args[2:])
+
+	if *output == "" || fs.NArg() != 1 {
+		fmt.Println(usage)
+		os.Exit(1)
+	}
+	downloadFile(fs.Arg(0), *output, *uploadSlots, trackerConfig())
+}
+
+func seedCommand() {
+	usage := "Usage: ./bittorrent.sh seed [-upload-slots <n>] " + trackerUsage + " <torrent_path> <content_path>"
+
+	fs := flag.NewFlagSet("seed", flag.ExitOnError)
+	fs.Usage = func() { fmt.Println(usage) }
+	uploadSlots := fs.Int("upload-slots", download.DefaultUploadSlots, "number of peers to upload to for their rates, besides one optimistic unchoke")
+	trackerConfig := trackerFlags(fs)
+	fs.String("loglevel", "trace", "set the log level")
+	fs.Parse(os.Args[2:])
+
+	if fs.NArg() != 2 {
+		fmt.Println(usage)
 		os.Exit(1)
 	}
-	downloadFile(os.Args[4], os.Args[3])
+	seedTorrent(fs.Arg(0), fs.Arg(1), *uploadSlots, trackerConfig())
 }
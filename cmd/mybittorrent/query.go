@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+	"karlan/torrent/internal/bencode"
+	"strconv"
+	"strings"
+)
+
+// A querySegment is one step of a query path: a dictionary key, a list index,
+// or a wildcard that matches every element of a list or dictionary.
+type querySegment struct {
+	key      string
+	index    int
+	isIndex  bool
+	wildcard bool
+}
+
+// parseQuery parses a path expression such as info.files[*].path or
+// announce-list[0]. Keys are separated by dots and may contain anything else,
+// including spaces, as in "info.piece length". Keys that contain dots or
+// brackets can be written quoted in brackets, e.g. ["x.y"]. Negative indices
+// count from the end of a list. An empty expression or "." selects the whole
+// value.
+func parseQuery(expr string) ([]querySegment, error) {
+	var segments []querySegment
+	if expr == "" || expr == "." {
+		return segments, nil
+	}
+
+	i := 0
+	expectKey := true
+	for i < len(expr) {
+		switch {
+		case expr[i] == '[':
+			end := strings.IndexByte(expr[i:], ']')
+			if end < 0 {
+				return nil, fmt.Errorf("missing ] after offset %d", i)
+			}
+			inner := expr[i+1 : i+end]
+
+			if strings.HasPrefix(inner, `"`) {
+				// A quoted key may itself contain ], so find the closing quote
+				quoted, err := strconv.QuotedPrefix(expr[i+1:])
+				if err != nil {
+					return nil, fmt.Errorf("invalid quoted key at offset %d", i+1)
+				}
+				end = 1 + len(quoted)
+				if i+end >= len(expr) || expr[i+end] != ']' {
+					return nil, fmt.Errorf("missing ] after offset %d", i+end)
+				}
+				key, _ := strconv.Unquote(quoted)
+				segments = append(segments, querySegment{key: key})
+			} else if inner == "*" {
+				segments = append(segments, querySegment{wildcard: true})
+			} else {
+				index, err := strconv.Atoi(inner)
+				if err != nil {
+					return nil, fmt.Errorf("invalid index %q at offset %d", inner, i+1)
+				}
+				segments = append(segments, querySegment{index: index, isIndex: true})
+			}
+			i += end + 1
+			expectKey = false
+		case expr[i] == '.':
+			if expectKey {
+				return nil, fmt.Errorf("empty key at offset %d", i)
+			}
+			i++
+			expectKey = true
+			if i == len(expr) {
+				return nil, fmt.Errorf("empty key at offset %d", i)
+			}
+		default:
+			if !expectKey {
+				return nil, fmt.Errorf("expected . or [ at offset %d", i)
+			}
+			end := strings.IndexAny(expr[i:], ".[")
+			if end < 0 {
+				end = len(expr) - i
+			}
+			key := expr[i : i+end]
+			if key == "*" {
+				segments = append(segments, querySegment{wildcard: true})
+			} else {
+				segments = append(segments, querySegment{key: key})
+			}
+			i += end
+			expectKey = false
+		}
+	}
+	return segments, nil
+}
+
+// evalQuery returns the values below root, as decoded with UseDict, that the
+// path selects, in the order they appear. Steps that do not apply to a value,
+// such as a key on a list, match nothing rather than failing, so that
+// wildcards can run over elements of different shapes.
+func evalQuery(root interface{}, segments []querySegment) []interface{} {
+	matches := []interface{}{root}
+	for _, seg := range segments {
+		var next []interface{}
+		for _, m := range matches {
+			switch x := m.(type) {
+			case bencode.Dict:
+				if seg.wildcard {
+					for _, entry := range x {
+						next = append(next, entry.Value)
+					}
+				} else if !seg.isIndex {
+					if value, ok := x.Get(seg.key); ok {
+						next = append(next, value)
+					}
+				}
+			case []interface{}:
+				if seg.wildcard {
+					next = append(next, x...)
+				} else if seg.isIndex {
+					index := seg.index
+					if index < 0 {
+						index += len(x)
+					}
+					if index >= 0 && index < len(x) {
+						next = append(next, x[index])
+					}
+				}
+			}
+		}
+		matches = next
+	}
+	return matches
+}
+
+// writeQueryResult writes a matched value on a line of its own. In raw form
+// strings are written as they are and integers in decimal, while lists and
+// dictionaries are written bencoded. The hex form hex-encodes what raw would
+// write, except for integers, and json writes the value as decode does.
+func writeQueryResult(w io.Writer, v interface{}, format, binary string) error {
+	if format == "json" {
+		return writeJSON(w, v, binary)
+	}
+
+	var out []byte
+	switch x := v.(type) {
+	case string:
+		out = []byte(x)
+	case []interface{}, bencode.Dict:
+		encoded, err := bencode.Marshal(x)
+		if err != nil {
+			return err
+		}
+		out = encoded
+	default:
+		// Integers read the same in both forms
+		_, err := fmt.Fprintln(w, x)
+		return err
+	}
+
+	if format == "hex" {
+		out = []byte(hex.EncodeToString(out))
+	}
+	_, err := w.Write(append(out, '\n'))
+	return err
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"karlan/torrent/internal/bencode"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseQuery(t *testing.T) {
+	tests := []struct {
+		expr string
+		want []querySegment
+	}{
+		{"", nil},
+		{".", nil},
+		{"announce", []querySegment{{key: "announce"}}},
+		{"info.piece length", []querySegment{{key: "info"}, {key: "piece length"}}},
+		{"announce-list[0][-1]", []querySegment{{key: "announce-list"}, {index: 0, isIndex: true}, {index: -1, isIndex: true}}},
+		{"info.files[*].path", []querySegment{{key: "info"}, {key: "files"}, {wildcard: true}, {key: "path"}}},
+		{"*.length", []querySegment{{wildcard: true}, {key: "length"}}},
+		{`["x.y"]`, []querySegment{{key: "x.y"}}},
+		{`info["a]b"].c`, []querySegment{{key: "info"}, {key: "a]b"}, {key: "c"}}},
+		{`["\x00"]`, []querySegment{{key: "\x00"}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			have, err := parseQuery(tt.expr)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(have, tt.want) {
+				t.Errorf("have %+v, want %+v", have, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseQueryErrors(t *testing.T) {
+	tests := []struct {
+		expr string
+		want string
+	}{
+		{".info", "empty key at offset 0"},
+		{"info..name", "empty key at offset 5"},
+		{"info.", "empty key at offset 5"},
+		{"info[0", "missing ] after offset 4"},
+		{"info[x]", `invalid index "x" at offset 5`},
+		{`info["x]`, "invalid quoted key at offset 5"},
+		{`info["x"x]`, "missing ] after offset 8"},
+		{"info[0]name", "expected . or [ at offset 7"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			_, err := parseQuery(tt.expr)
+			if err == nil || err.Error() != tt.want {
+				t.Errorf("have error %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestEvalQuery(t *testing.T) {
+	d := bencode.NewDecoder(strings.NewReader("d8:announce3:url13:announce-listll1:a1:bel1:cee4:infod5:filesld6:lengthi1e4:pathl1:xeed6:lengthi2e4:pathl1:y1:zeee4:name1:neee"))
+	d.UseDict()
+	var root interface{}
+	if err := d.Decode(&root); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		expr string
+		want string // The matches, bencoded and concatenated
+	}{
+		{"announce", "3:url"},
+		{"announce-list[0][1]", "1:b"},
+		{"announce-list[-1][-1]", "1:c"},
+		{"announce-list[*][0]", "1:a1:c"},
+		{"info.files[*].length", "i1ei2e"},
+		{"info.files[*].path[-1]", "1:x1:z"},
+		{"info.*", "ld6:lengthi1e4:pathl1:xeed6:lengthi2e4:pathl1:y1:zeee1:n"},
+		{`["announce"]`, "3:url"},
+
+		// No match
+		{"missing", ""},
+		{"announce-list[2]", ""},
+		{"announce-list[-3]", ""},
+		{"announce.x", ""},
+		{"info[0]", ""},
+		{"info.files.length", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			segments, err := parseQuery(tt.expr)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			var have bytes.Buffer
+			for _, match := range evalQuery(root, segments) {
+				encoded, err := bencode.Marshal(match)
+				if err != nil {
+					t.Fatal(err)
+				}
+				have.Write(encoded)
+			}
+			if have.String() != tt.want {
+				t.Errorf("have %q, want %q", have.String(), tt.want)
+			}
+		})
+	}
+}
+
+func TestWriteQueryResult(t *testing.T) {
+	tests := []struct {
+		value  interface{}
+		format string
+		want   string
+	}{
+		{"hello", "raw", "hello\n"},
+		{"hello", "hex", "68656c6c6f\n"},
+		{"\xab", "json", `{"$hex":"ab"}` + "\n"},
+		{52, "raw", "52\n"},
+		{52, "hex", "52\n"},
+		{[]interface{}{"a", 1}, "raw", "l1:ai1ee\n"},
+		{bencode.Dict{{Key: "a", Value: 1}}, "hex", "64313a6169316565\n"},
+	}
+
+	for _, tt := range tests {
+		var have bytes.Buffer
+		if err := writeQueryResult(&have, tt.value, tt.format, hexTag); err != nil {
+			t.Errorf("%v as %s: unexpected error: %v", tt.value, tt.format, err)
+			continue
+		}
+		if have.String() != tt.want {
+			t.Errorf("%v as %s: have %q, want %q", tt.value, tt.format, have.String(), tt.want)
+		}
+	}
+}
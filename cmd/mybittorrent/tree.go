@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"karlan/torrent/internal/bencode"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Longer strings are cut short in the tree, which is meant for finding your
+// way around a payload rather than extracting values from it.
+const (
+	maxTreeString = 64
+	maxTreeBinary = 20
+)
+
+// treeLevel is a list or dictionary that the tree printer is inside of.
+type treeLevel struct {
+	dict  bool
+	index int    // Number of elements seen so far
+	key   string // Key of the next dictionary value
+}
+
+// writeTree prints a bencoded value from d as an indented tree, one line per
+// value, each starting with the byte offset of the value in the input.
+func writeTree(w io.Writer, d *bencode.Decoder) error {
+	out := bufio.NewWriter(w)
+	defer out.Flush()
+	var stack []*treeLevel
+
+	for {
+		offset := d.InputOffset()
+		tok, err := d.Token()
+		if err != nil {
+			return err
+		}
+
+		var label string
+		if len(stack) > 0 {
+			level := stack[len(stack)-1]
+			if tok == bencode.Delim('e') {
+				if level.dict && level.index%2 == 1 {
+					return fmt.Errorf("missing value for key %s at offset %d", summarizeString(level.key), offset)
+				}
+				stack = stack[:len(stack)-1]
+				if len(stack) == 0 {
+					break
+				}
+				continue
+			}
+			if level.dict && level.index%2 == 0 {
+				// Keys are printed along with their value
+				key, ok := tok.(string)
+				if !ok {
+					return fmt.Errorf("dictionary key at offset %d is not a string", offset)
+				}
+				level.key = key
+				level.index++
+				continue
+			}
+			if level.dict {
+				label = summarizeString(level.key) + ": "
+			} else {
+				label = "[" + strconv.Itoa(level.index) + "] "
+			}
+			level.index++
+		}
+
+		indent := strings.Repeat("  ", len(stack))
+		switch x := tok.(type) {
+		case bencode.Delim:
+			if x == 'd' {
+				fmt.Fprintf(out, "%8d  %s%sdictionary\n", offset, indent, label)
+			} else {
+				fmt.Fprintf(out, "%8d  %s%slist\n", offset, indent, label)
+			}
+			stack = append(stack, &treeLevel{dict: x == 'd'})
+		case string:
+			fmt.Fprintf(out, "%8d  %s%s%s\n", offset, indent, label, summarizeString(x))
+		default:
+			fmt.Fprintf(out, "%8d  %s%s%v\n", offset, indent, label, x)
+		}
+
+		if len(stack) == 0 {
+			break
+		}
+	}
+	return nil
+}
+
+// summarizeString quotes text and shows binary strings as hex, both cut short
+// with their full length when they do not fit on a line.
+func summarizeString(s string) string {
+	if utf8.ValidString(s) {
+		if len(s) <= maxTreeString {
+			return strconv.Quote(s)
+		}
+		// Cut on a rune boundary so the quoted text stays readable
+		n := maxTreeString
+		for !utf8.RuneStart(s[n]) {
+			n--
+		}
+		return fmt.Sprintf("%s... (%d bytes)", strconv.Quote(s[:n]), len(s))
+	}
+
+	if len(s) <= maxTreeBinary {
+		return fmt.Sprintf("<%d bytes> %s", len(s), hex.EncodeToString([]byte(s)))
+	}
+	return fmt.Sprintf("<%d bytes> %s...", len(s), hex.EncodeToString([]byte(s[:maxTreeBinary])))
+}
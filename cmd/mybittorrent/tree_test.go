@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"karlan/torrent/internal/bencode"
+	"strings"
+	"testing"
+)
+
+func TestWriteTree(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{"integer", "i-52e", "       0  -52\n"},
+		{"binary string", "2:\xab\xcd", "       0  <2 bytes> abcd\n"},
+		{
+			"nested",
+			"d4:infod6:lengthi5e4:name5:a.txte4:listli1el1:xeee",
+			"       0  dictionary\n" +
+				"       7    \"info\": dictionary\n" +
+				"      16      \"length\": 5\n" +
+				"      25      \"name\": \"a.txt\"\n" +
+				"      39    \"list\": list\n" +
+				"      40      [0] 1\n" +
+				"      43      [1] list\n" +
+				"      44        [0] \"x\"\n",
+		},
+		{"empty list", "le", "       0  list\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var have bytes.Buffer
+			if err := writeTree(&have, bencode.NewDecoder(strings.NewReader(tt.input))); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if have.String() != tt.want {
+				t.Errorf("have\n%s\nwant\n%s", have.String(), tt.want)
+			}
+		})
+	}
+}
+
+func TestWriteTreeErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{"integer key", "di1ei2ee", "dictionary key at offset 1 is not a string"},
+		{"list key", "dlei2ee", "dictionary key at offset 1 is not a string"},
+		{"missing value", "d1:ae", `missing value for key "a" at offset 4`},
+		{"truncated", "l1:a", "unexpected end of input at offset 4"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			err := writeTree(&out, bencode.NewDecoder(strings.NewReader(tt.input)))
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("have error %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestSummarizeString(t *testing.T) {
+	tests := []struct {
+		s    string
+		want string
+	}{
+		{"abc", `"abc"`},
+		{strings.Repeat("a", 70), `"` + strings.Repeat("a", 64) + `"... (70 bytes)`},
+		// Cut before the é that straddles the limit
+		{strings.Repeat("a", 63) + "éé", `"` + strings.Repeat("a", 63) + `"... (67 bytes)`},
+		{"\xff", "<1 bytes> ff"},
+		{strings.Repeat("\xff", 25), "<25 bytes> " + strings.Repeat("ff", 20) + "..."},
+	}
+
+	for _, tt := range tests {
+		if have := summarizeString(tt.s); have != tt.want {
+			t.Errorf("have %s, want %s", have, tt.want)
+		}
+	}
+}
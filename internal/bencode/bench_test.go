@@ -0,0 +1,98 @@
+package bencode
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"testing"
+)
+
+func readBenchmarkTorrent(b *testing.B) []byte {
+	data, err := os.ReadFile("../../torrents/debian.torrent")
+	if err != nil {
+		b.Skipf("cannot read benchmark torrent: %v", err)
+	}
+	return data
+}
+
+type benchmarkTorrent struct {
+	Announce string     `bencode:"announce"`
+	Comment  string     `bencode:"comment,omitempty"`
+	Info     RawMessage `bencode:"info"`
+}
+
+type benchmarkInfo struct {
+	Name        string `bencode:"name"`
+	Length      int64  `bencode:"length"`
+	PieceLength int    `bencode:"piece length"`
+	Pieces      []byte `bencode:"pieces"`
+}
+
+func BenchmarkDecode(b *testing.B) {
+	data := string(readBenchmarkTorrent(b))
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := Decode(data); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkUnmarshal(b *testing.B) {
+	data := readBenchmarkTorrent(b)
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		var t benchmarkTorrent
+		var info benchmarkInfo
+		if err := Unmarshal(data, &t); err != nil {
+			b.Fatal(err)
+		}
+		if err := Unmarshal(t.Info, &info); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkDecoderStream(b *testing.B) {
+	data := readBenchmarkTorrent(b)
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		var t benchmarkTorrent
+		if err := NewDecoder(bytes.NewReader(data)).Decode(&t); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkEncode(b *testing.B) {
+	data := readBenchmarkTorrent(b)
+	decoded, err := Decode(string(data))
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		Encode(decoded)
+	}
+}
+
+func BenchmarkEncoder(b *testing.B) {
+	data := readBenchmarkTorrent(b)
+	decoded, err := Decode(string(data))
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := NewEncoder(io.Discard).Encode(decoded); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
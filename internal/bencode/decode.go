@@ -1,155 +1,720 @@
 package bencode
 
 import (
+	"bytes"
 	"fmt"
+	"io"
+	"math"
+	"reflect"
 	"strconv"
 )
 
-func decodeString(bencode string, start int) (result string, index int, err error) {
-	var firstColonIndex int
-	for i := start; i < len(bencode); i++ {
-		if bencode[i] == ':' {
-			firstColonIndex = i
-			break
+// A Decoder reads and decodes bencoded values from an input stream.
+//
+// A Decoder created by NewDecoder buffers its input and copies every string
+// it returns. Unmarshal instead decodes straight from the given slice and
+// hands out sub-slices of it, so decoding never copies the input.
+type Decoder struct {
+	r       io.Reader     // Source of more input, nil if buf holds all of it
+	err     error         // Sticky error returned by r
+	buf     []byte        // Input read so far, buf[pos:] is still unread
+	pos     int           // Read position in buf
+	base    int64         // Input offset of buf[0]
+	keep    int           // Start of a RawMessage being captured in buf, or -1
+	strict  bool          // Reject non-canonical input
+	useDict bool          // Decode dictionaries into Dict rather than maps
+	limits  Limits        // Resource limits for a single value
+	start   int64         // Offset of the value being decoded
+	depth   int           // Current nesting of lists and dictionaries
+	path    []interface{} // Keys and indexes leading to the current value
+}
+
+// minRead is the smallest chunk the decoder asks its reader for.
+const minRead = 4096
+
+// NewDecoder returns a new decoder that reads from r, using DefaultLimits.
+//
+// The decoder introduces its own buffering and may read data from r beyond
+// the bencoded values requested.
+func NewDecoder(r io.Reader) *Decoder {
+	return &Decoder{r: r, keep: -1, limits: DefaultLimits}
+}
+
+// newBytesDecoder returns a decoder over data that never copies it.
+func newBytesDecoder(data []byte) *Decoder {
+	d := &Decoder{buf: data, keep: -1, limits: DefaultLimits}
+	// The input is already in memory, so it bounds the size of the value
+	d.limits.MaxSize = 0
+	return d
+}
+
+// InputOffset returns the input stream byte offset of the current decoder
+// position.
+func (d *Decoder) InputOffset() int64 {
+	return d.offset()
+}
+
+// Buffered returns a reader of the data remaining in the decoder's buffer. The
+// reader is valid until the next call to Decode or Token.
+func (d *Decoder) Buffered() io.Reader {
+	return bytes.NewReader(d.buf[d.pos:])
+}
+
+func (d *Decoder) offset() int64 {
+	return d.base + int64(d.pos)
+}
+
+// Decode reads the next bencoded value from its input and stores it in the
+// value pointed to by v. It returns io.EOF if the input holds no more values.
+// Malformed input is reported as a *SyntaxError and values that do not fit
+// their target as an *UnmarshalTypeError.
+//
+// Dictionaries decode into structs, matching keys against the field tags
+// described in Marshal, or into maps with string keys. Unknown keys are
+// skipped. A RawMessage receives the undecoded bytes of the value. Strings
+// decode into string, []byte or byte arrays of the same length, integers into
+// big.Int or any integer type that can hold them, and lists into slices or
+// arrays. Decoding into an empty interface stores one of string, int,
+// []interface{} or map[string]interface{}, except that integers outside the
+// range of int become int64, uint64 or *big.Int, whichever fits first. See
+// UseDict for keeping the order of dictionary keys.
+func (d *Decoder) Decode(v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Pointer || rv.IsNil() {
+		return fmt.Errorf("cannot decode into non-pointer %T", v)
+	}
+
+	if err := d.fill(1); err != nil {
+		return err
+	}
+
+	// Restore the nesting state on errors, which leave it behind mid-value.
+	// It is not zero if Decode is called between calls to Token.
+	depth, pathLen := d.depth, len(d.path)
+	defer func() {
+		d.depth = depth
+		d.path = d.path[:pathLen]
+		d.keep = -1
+	}()
+	d.start = d.offset()
+
+	return d.value(rv.Elem())
+}
+
+// fill reads from r until at least n unread bytes are buffered. Consumed
+// bytes are dropped to make room, except those of a RawMessage being
+// captured. The buffer grows with the data actually read, so a bogus string
+// length cannot make us allocate more memory than the input holds.
+func (d *Decoder) fill(n int) error {
+	for len(d.buf)-d.pos < n {
+		if d.r == nil {
+			return io.EOF
+		}
+		if d.err != nil {
+			return d.err
+		}
+
+		discard := d.pos
+		if d.keep >= 0 {
+			discard = d.keep
+			d.keep = 0
+		}
+		if discard > 0 {
+			d.buf = d.buf[:copy(d.buf, d.buf[discard:])]
+			d.pos -= discard
+			d.base += int64(discard)
+		}
+
+		if cap(d.buf)-len(d.buf) < minRead {
+			grown := make([]byte, len(d.buf), 2*cap(d.buf)+minRead)
+			copy(grown, d.buf)
+			d.buf = grown
+		}
+
+		read, err := d.r.Read(d.buf[len(d.buf):cap(d.buf)])
+		d.buf = d.buf[:len(d.buf)+read]
+		if err != nil {
+			d.err = err
 		}
 	}
+	return nil
+}
 
-	lengthStr := bencode[start:firstColonIndex]
-	length, err := strconv.Atoi(lengthStr)
+// owned returns b, which points into the input, in a form the caller may keep.
+// Slices of a caller-provided input are returned as they are, while slices of
+// the decoder's own buffer are copied because the buffer is reused.
+func (d *Decoder) owned(b []byte) []byte {
+	if d.r == nil {
+		return b
+	}
+	return bytes.Clone(b)
+}
 
+func (d *Decoder) readByte() (byte, error) {
+	if err := d.checkSize(1); err != nil {
+		return 0, err
+	}
+
+	c, err := d.peekByte()
 	if err != nil {
-		return "", 0, err
+		return 0, err
 	}
+	d.pos++
+	return c, nil
+}
 
-	index = firstColonIndex + 1 + length
+func (d *Decoder) peekByte() (byte, error) {
+	if d.pos >= len(d.buf) {
+		if err := d.fill(1); err != nil {
+			return 0, d.unexpected(err)
+		}
+	}
+	return d.buf[d.pos], nil
+}
 
-	if index > len(bencode) {
-		return "", 0, fmt.Errorf("invalid bencoded string: length exceeds available data")
+// unexpected turns an end of input in the middle of a value into a
+// SyntaxError wrapping io.ErrUnexpectedEOF. Other read errors are returned
+// as they are.
+func (d *Decoder) unexpected(err error) error {
+	if err != io.EOF && err != io.ErrUnexpectedEOF {
+		return err
 	}
+	return &SyntaxError{Offset: d.offset(), Path: d.pathString(), msg: "unexpected end of input", err: io.ErrUnexpectedEOF}
+}
 
-	if index < len(bencode) {
-		nextChar := bencode[index]
+// readDigits consumes an optionally signed run of digits terminated by delim
+// and returns the run without the delimiter.
+func (d *Decoder) readDigits(delim byte, what string) (string, error) {
+	start := d.offset()
+	var digits []byte
+	for {
+		c, err := d.readByte()
+		if err != nil {
+			return "", err
+		}
+		if c == delim {
+			break
+		}
 
-		if nextChar != 'i' && nextChar != 'l' && nextChar != 'd' && nextChar != 'e' && (nextChar < '0' || nextChar > '9') {
-			return "", 0, fmt.Errorf("invalid bencoded string: length mismatch")
+		isSign := len(digits) == 0 && (c == '-' || c == '+')
+		if !isSign && (c < '0' || c > '9') {
+			return "", d.syntaxError(d.offset()-1, "invalid character %q in %s", c, what)
 		}
+		digits = append(digits, c)
+	}
 
-		if nextChar >= '0' && nextChar <= '9' {
-			colonFound := false
-			for i := index + 1; i < len(bencode); i++ {
-				if bencode[i] == ':' {
-					colonFound = true
-					break
-				}
-				if bencode[i] < '0' || bencode[i] > '9' {
-					return "", 0, fmt.Errorf("invalid bencoded string: length mismatch")
-				}
-			}
-			if !colonFound {
-				return "", 0, fmt.Errorf("invalid bencoded string: length mismatch")
-			}
+	if len(digits) == 0 || (len(digits) == 1 && (digits[0] == '-' || digits[0] == '+')) {
+		return "", d.syntaxError(start, "%s has no digits", what)
+	}
+	return string(digits), nil
+}
+
+// readString consumes a <length>:<contents> token and returns its contents.
+// The result points into the decoder's buffer and is only valid until the
+// next read, see owned.
+func (d *Decoder) readString() ([]byte, error) {
+	start := d.offset()
+	lengthStr, err := d.readDigits(':', "string length")
+	if err != nil {
+		return nil, err
+	}
+
+	length, err := strconv.ParseInt(lengthStr, 10, 64)
+	if err != nil || length < 0 || length > math.MaxInt {
+		return nil, d.syntaxError(start, "invalid string length %q", lengthStr)
+	}
+	if d.strict {
+		if msg := checkCanonicalLength(lengthStr); msg != "" {
+			return nil, d.syntaxError(start, "%s", msg)
+		}
+	}
+	if d.limits.MaxStringLength > 0 && length > d.limits.MaxStringLength {
+		return nil, d.syntaxError(start, "string length %d exceeds maximum of %d", length, d.limits.MaxStringLength)
+	}
+	if err := d.checkSize(length); err != nil {
+		return nil, err
+	}
+
+	n := int(length)
+	if err := d.fill(n); err != nil {
+		if err == io.EOF {
+			return nil, &SyntaxError{Offset: start, Path: d.pathString(), msg: "string length exceeds available data", err: io.ErrUnexpectedEOF}
 		}
+		return nil, err
 	}
 
-	return bencode[firstColonIndex+1 : index], index, nil
+	buf := d.buf[d.pos : d.pos+n : d.pos+n]
+	d.pos += n
+	return buf, nil
 }
 
-func decodeInt(bencode string, start int) (number int, index int, err error) {
-	length := len(bencode)
-	for index = start; index < length; index++ {
-		if rune(bencode[index]) == 'e' {
-			break
+// readInt consumes an i<number>e token and returns the number's digits.
+func (d *Decoder) readInt() (string, error) {
+	start := d.offset()
+	if _, err := d.readByte(); err != nil { // Skip the 'i'
+		return "", err
+	}
+
+	digits, err := d.readDigits('e', "integer")
+	if err != nil {
+		return "", err
+	}
+	if d.strict {
+		if msg := checkCanonicalInt(digits); msg != "" {
+			return "", d.syntaxError(start, "%s", msg)
 		}
 	}
-	numberStr := bencode[start+1 : index]
-	number, err = strconv.Atoi(numberStr)
+	return digits, nil
+}
+
+func (d *Decoder) decodeString() (string, error) {
+	buf, err := d.readString()
+	return string(buf), err
+}
+
+func (d *Decoder) decodeInt() (interface{}, error) {
+	start := d.offset()
+	numberStr, err := d.readInt()
 	if err != nil {
-		return 0, 0, err
+		return nil, err
 	}
-	return number, index + 1, nil
+
+	number, ok := parseInteger(numberStr)
+	if !ok {
+		return nil, d.syntaxError(start, "invalid integer %q", numberStr)
+	}
+	return number, nil
 }
 
-func decodeList(bencode string, start int) (list []interface{}, index int, err error) {
-	if start >= len(bencode) {
-		return nil, start, fmt.Errorf("bad list")
+func (d *Decoder) decodeList() ([]interface{}, error) {
+	if err := d.enter(d.offset()); err != nil {
+		return nil, err
 	}
+	defer d.leave()
 
-	list = make([]interface{}, 0)
-	index = start + 1
+	if _, err := d.readByte(); err != nil { // Skip the 'l'
+		return nil, err
+	}
 
-	for {
-		if index >= len(bencode) {
-			return nil, index, fmt.Errorf("unexpected end of list")
+	list := make([]interface{}, 0)
+	for i := 0; ; i++ {
+		c, err := d.peekByte()
+		if err != nil {
+			return nil, err
 		}
-		if rune(bencode[index]) == 'e' {
-			break
+		if c == 'e' {
+			_, err := d.readByte()
+			return list, err
 		}
 
-		var result interface{}
-		result, index, err = decode(bencode, index)
+		d.pushPath(i)
+		result, err := d.decode()
 		if err != nil {
-			return nil, index, err
+			return nil, err
 		}
+		d.popPath()
 		list = append(list, result)
 	}
-
-	return list, index + 1, nil
 }
 
-func decodeDict(bencode string, start int) (dict map[string]interface{}, index int, err error) {
-	if start >= len(bencode) {
-		return nil, start, fmt.Errorf("bad dict")
+func (d *Decoder) decodeDict() (interface{}, error) {
+	if err := d.enter(d.offset()); err != nil {
+		return nil, err
+	}
+	defer d.leave()
+
+	if _, err := d.readByte(); err != nil { // Skip the 'd'
+		return nil, err
+	}
+
+	var dict map[string]interface{}
+	var ordered Dict
+	if d.useDict {
+		ordered = make(Dict, 0)
+	} else {
+		dict = make(map[string]interface{})
 	}
 
-	dict = make(map[string]interface{})
-	index = start + 1
+	var prev *string
 	for {
-		if index >= len(bencode) {
-			return nil, index, fmt.Errorf("unexpected end of dictionary")
+		c, err := d.peekByte()
+		if err != nil {
+			return nil, err
 		}
-		if rune(bencode[index]) == 'e' {
-			break
+		if c == 'e' {
+			if _, err := d.readByte(); err != nil {
+				return nil, err
+			}
+			if d.useDict {
+				return ordered, nil
+			}
+			return dict, nil
 		}
 
-		// Get key
-		var key, value interface{}
-		key, index, err = decode(bencode, index)
+		key, err := d.decodeKey(&prev)
 		if err != nil {
-			return nil, index, err
+			return nil, err
 		}
 
-		// Cast to string
-		key_str, ok := key.(string)
-		if !ok {
-			return nil, index, fmt.Errorf("dict key is not a string")
+		d.pushPath(key)
+		value, err := d.decode()
+		if err != nil {
+			return nil, err
+		}
+		d.popPath()
+
+		if d.useDict {
+			ordered = append(ordered, DictEntry{Key: key, Value: value})
+		} else {
+			dict[key] = value
+		}
+	}
+}
+
+// decodeKey reads a dictionary key. prev tracks the previous key of the same
+// dictionary so strict mode can enforce ordering.
+func (d *Decoder) decodeKey(prev **string) (string, error) {
+	start := d.offset()
+	c, err := d.peekByte()
+	if err != nil {
+		return "", err
+	}
+
+	// Keys must be strings
+	if c < '0' || c > '9' {
+		return "", d.syntaxError(start, "dict key is not a string")
+	}
+	key, err := d.decodeString()
+	if err != nil {
+		return "", err
+	}
+
+	if d.strict {
+		if msg := checkKeyOrder(*prev, key); msg != "" {
+			return "", d.syntaxError(start, "%s", msg)
 		}
+		*prev = &key
+	}
+	return key, nil
+}
+
+func (d *Decoder) decode() (interface{}, error) {
+	c, err := d.peekByte()
+	if err != nil {
+		return nil, err
+	}
 
-		// Get value
-		value, index, err = decode(bencode, index)
+	switch {
+	case c == 'i':
+		return d.decodeInt()
+	case c == 'l':
+		return d.decodeList()
+	case c == 'd':
+		return d.decodeDict()
+	case c >= '0' && c <= '9':
+		return d.decodeString()
+	default:
+		return nil, d.syntaxError(d.offset(), "invalid character %q", c)
+	}
+}
+
+// skip consumes the next value without building it.
+func (d *Decoder) skip() error {
+	c, err := d.peekByte()
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case c == 'i':
+		_, err := d.readInt()
+		return err
+	case c >= '0' && c <= '9':
+		_, err := d.readString()
+		return err
+	case c != 'l' && c != 'd':
+		return d.syntaxError(d.offset(), "invalid character %q", c)
+	}
+
+	if err := d.enter(d.offset()); err != nil {
+		return err
+	}
+	defer d.leave()
+
+	if _, err := d.readByte(); err != nil { // Skip the 'l' or 'd'
+		return err
+	}
+
+	var prev *string
+	for i := 0; ; i++ {
+		next, err := d.peekByte()
+		if err != nil {
+			return err
+		}
+		if next == 'e' {
+			_, err := d.readByte()
+			return err
+		}
+
+		if c == 'd' {
+			key, err := d.decodeKey(&prev)
+			if err != nil {
+				return err
+			}
+			d.pushPath(key)
+		} else {
+			d.pushPath(i)
+		}
+
+		if err := d.skip(); err != nil {
+			return err
+		}
+		d.popPath()
+	}
+}
+
+// value decodes the next value into v, which must be settable.
+func (d *Decoder) value(v reflect.Value) error {
+	// Allocate and follow pointers until we reach the actual target
+	for v.Kind() == reflect.Pointer {
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		v = v.Elem()
+	}
+
+	if v.Type() == rawMessageType {
+		raw, err := d.rawValue()
+		if err != nil {
+			return err
+		}
+		v.SetBytes(raw)
+		return nil
+	}
+
+	if v.Type() == dictType {
+		return d.orderedDictValue(v)
+	}
+
+	if v.Kind() == reflect.Interface && v.NumMethod() == 0 {
+		result, err := d.decode()
+		if err != nil {
+			return err
+		}
+		v.Set(reflect.ValueOf(result))
+		return nil
+	}
+
+	c, err := d.peekByte()
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case c == 'i':
+		return d.intValue(v)
+	case c == 'l':
+		return d.listValue(v)
+	case c == 'd':
+		return d.dictValue(v)
+	case c >= '0' && c <= '9':
+		return d.stringValue(v)
+	default:
+		return d.syntaxError(d.offset(), "invalid character %q", c)
+	}
+}
+
+func (d *Decoder) stringValue(v reflect.Value) error {
+	start := d.offset()
+	buf, err := d.readString()
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case v.Kind() == reflect.String:
+		v.SetString(string(buf))
+	case v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.Uint8:
+		v.SetBytes(d.owned(buf))
+	case v.Kind() == reflect.Array && v.Type().Elem().Kind() == reflect.Uint8:
+		if len(buf) != v.Len() {
+			return d.typeError("string", v.Type(), start, fmt.Sprintf("length %d, want %d", len(buf), v.Len()))
+		}
+		reflect.Copy(v, reflect.ValueOf(buf))
+	default:
+		return d.typeError("string", v.Type(), start)
+	}
+	return nil
+}
+
+func (d *Decoder) intValue(v reflect.Value) error {
+	start := d.offset()
+	numberStr, err := d.readInt()
+	if err != nil {
+		return err
+	}
+
+	switch v.Kind() {
+	case reflect.Struct:
+		if v.Type() != bigIntType {
+			return d.typeError("integer", v.Type(), start)
+		}
+		return d.bigIntValue(v, numberStr, start)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		number, err := strconv.ParseInt(numberStr, 10, v.Type().Bits())
+		if err != nil {
+			return d.typeError("integer", v.Type(), start, fmt.Sprintf("%s is out of range", numberStr))
+		}
+		v.SetInt(number)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		number, err := strconv.ParseUint(numberStr, 10, v.Type().Bits())
 		if err != nil {
-			return nil, index, err
+			return d.typeError("integer", v.Type(), start, fmt.Sprintf("%s is out of range", numberStr))
 		}
+		v.SetUint(number)
+	default:
+		return d.typeError("integer", v.Type(), start)
+	}
+	return nil
+}
+
+func (d *Decoder) listValue(v reflect.Value) error {
+	start := d.offset()
+	if v.Kind() != reflect.Slice && v.Kind() != reflect.Array {
+		return d.typeError("list", v.Type(), start)
+	}
+
+	if err := d.enter(start); err != nil {
+		return err
+	}
+	defer d.leave()
+
+	if _, err := d.readByte(); err != nil { // Skip the 'l'
+		return err
+	}
 
-		dict[key_str] = value
+	if v.Kind() == reflect.Slice {
+		v.Set(reflect.MakeSlice(v.Type(), 0, 0))
 	}
 
-	return dict, index + 1, nil
+	for i := 0; ; i++ {
+		c, err := d.peekByte()
+		if err != nil {
+			return err
+		}
+		if c == 'e' {
+			_, err := d.readByte()
+			return err
+		}
+
+		if v.Kind() == reflect.Slice {
+			v.Set(reflect.Append(v, reflect.Zero(v.Type().Elem())))
+		} else if i >= v.Len() {
+			return d.typeError("list", v.Type(), start, fmt.Sprintf("more than %d elements", v.Len()))
+		}
+
+		d.pushPath(i)
+		if err := d.value(v.Index(i)); err != nil {
+			return err
+		}
+		d.popPath()
+	}
 }
 
-func decode(bencode string, start int) (result interface{}, index int, err error) {
-	switch bencode[start] {
-	case 'i':
-		return decodeInt(bencode, start)
-	case 'l':
-		return decodeList(bencode, start)
-	case 'd':
-		return decodeDict(bencode, start)
+func (d *Decoder) dictValue(v reflect.Value) error {
+	start := d.offset()
+	var fields *structFields
+
+	switch {
+	case v.Kind() == reflect.Struct:
+		fields = cachedFields(v.Type())
+	case v.Kind() == reflect.Map && v.Type().Key().Kind() == reflect.String:
+		if v.IsNil() {
+			v.Set(reflect.MakeMap(v.Type()))
+		}
 	default:
-		return decodeString(bencode, start)
+		return d.typeError("dictionary", v.Type(), start)
+	}
+
+	if err := d.enter(start); err != nil {
+		return err
+	}
+	defer d.leave()
+
+	if _, err := d.readByte(); err != nil { // Skip the 'd'
+		return err
+	}
+
+	var prev *string
+	for {
+		c, err := d.peekByte()
+		if err != nil {
+			return err
+		}
+		if c == 'e' {
+			_, err := d.readByte()
+			return err
+		}
+
+		key, err := d.decodeKey(&prev)
+		if err != nil {
+			return err
+		}
+
+		d.pushPath(key)
+		if fields == nil {
+			elem := reflect.New(v.Type().Elem()).Elem()
+			if err := d.value(elem); err != nil {
+				return err
+			}
+			v.SetMapIndex(reflect.ValueOf(key).Convert(v.Type().Key()), elem)
+		} else if f, ok := fields.byName[key]; ok {
+			if err := d.value(v.Field(f.index)); err != nil {
+				return err
+			}
+		} else {
+			// Skip keys the struct does not know about
+			if err := d.skip(); err != nil {
+				return err
+			}
+		}
+		d.popPath()
 	}
 }
 
+// Unmarshal decodes the bencoded data and stores the result in the value
+// pointed to by v. The whole input must be consumed by that value. See
+// Decoder.Decode for how bencode values map onto Go values.
+//
+// Unmarshal does not copy data: []byte values and RawMessages stored in v
+// point into it, so data must not be modified while they are in use.
+func Unmarshal(data []byte, v interface{}) error {
+	return newBytesDecoder(data).decodeAll(v)
+}
+
+// Decode decodes a single bencoded value. The whole input must be consumed by
+// that value.
 func Decode(bencode string) (result interface{}, err error) {
-	result, _, err = decode(bencode, 0)
-	return result, err
+	if err = newBytesDecoder([]byte(bencode)).decodeAll(&result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// decodeAll decodes a single value into v and fails if any input follows it.
+func (d *Decoder) decodeAll(v interface{}) error {
+	if err := d.Decode(v); err != nil {
+		if err == io.EOF {
+			err = d.unexpected(err)
+		}
+		return err
+	}
+
+	if err := d.fill(1); err != io.EOF {
+		if err != nil {
+			return err
+		}
+		return d.syntaxError(d.offset(), "unexpected data after top-level value")
+	}
+	return nil
 }
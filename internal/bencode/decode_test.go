@@ -1,9 +1,17 @@
 package bencode
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
+	"io"
+	"math"
+	"math/big"
+	"os"
 	"reflect"
+	"strings"
 	"testing"
+	"testing/iotest"
 )
 
 func TestDecode(t *testing.T) {
@@ -129,3 +137,572 @@ func compareInterfaceSlices(slice1, slice2 []interface{}) bool {
 
 	return true
 }
+
+func TestDecoder(t *testing.T) {
+	t.Run("reads consecutive values", func(t *testing.T) {
+		d := NewDecoder(strings.NewReader("i1e5:helloli2eed1:ai3ee"))
+		want := []interface{}{1, "hello", []interface{}{2}, map[string]interface{}{"a": 3}}
+
+		for _, w := range want {
+			var have interface{}
+			if err := d.Decode(&have); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(have, w) {
+				t.Errorf("have: %v, want: %v", have, w)
+			}
+		}
+
+		var v interface{}
+		if err := d.Decode(&v); err != io.EOF {
+			t.Errorf("have: %v, want: %v", err, io.EOF)
+		}
+	})
+
+	t.Run("tracks the input offset", func(t *testing.T) {
+		d := NewDecoder(strings.NewReader("5:helloi52e"))
+		var v interface{}
+		d.Decode(&v)
+		if have := d.InputOffset(); have != 7 {
+			t.Errorf("have: %d, want: 7", have)
+		}
+	})
+
+	t.Run("reports the offset of errors", func(t *testing.T) {
+		d := NewDecoder(strings.NewReader("l5:helloi5xee"))
+		var v interface{}
+		err := d.Decode(&v)
+		if err == nil || !strings.Contains(err.Error(), "offset 10") {
+			t.Errorf("have: %v, want an error at offset 10", err)
+		}
+	})
+
+	t.Run("truncated input", func(t *testing.T) {
+		d := NewDecoder(strings.NewReader("d3:foo"))
+		var v interface{}
+		if err := d.Decode(&v); !errors.Is(err, io.ErrUnexpectedEOF) {
+			t.Errorf("have: %v, want: %v", err, io.ErrUnexpectedEOF)
+		}
+	})
+}
+
+func TestUnmarshal(t *testing.T) {
+	type file struct {
+		Length int64    `bencode:"length"`
+		Path   []string `bencode:"path"`
+	}
+	type info struct {
+		Name        string `bencode:"name"`
+		PieceLength int    `bencode:"piece length"`
+		Pieces      []byte `bencode:"pieces"`
+		Files       []file `bencode:"files,omitempty"`
+		Private     *uint8 `bencode:"private,omitempty"`
+		Ignored     string `bencode:"-"`
+	}
+
+	input := "d5:filesld6:lengthi5e4:pathl1:a1:beee4:name3:foo12:piece lengthi16e6:pieces3:abc7:privatei1e7:unknownli1eee"
+	var have info
+	if err := Unmarshal([]byte(input), &have); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	private := uint8(1)
+	want := info{
+		Name:        "foo",
+		PieceLength: 16,
+		Pieces:      []byte("abc"),
+		Files:       []file{{Length: 5, Path: []string{"a", "b"}}},
+		Private:     &private,
+	}
+	if !reflect.DeepEqual(have, want) {
+		t.Errorf("have: %+v, want: %+v", have, want)
+	}
+
+	var failingTests = []struct {
+		bencode string
+		target  interface{}
+	}{
+		{"i300e", new(uint8)},
+		{"i-1e", new(uint)},
+		{"5:hello", new(int)},
+		{"i1e", new(string)},
+		{"3:abc", new([4]byte)},
+		{"li1ei2ee", new([1]int)},
+		{"d4:namei1ee", new(info)},
+		{"i1e", info{}},
+	}
+
+	for _, tt := range failingTests {
+		t.Run(fmt.Sprintf("%s into %T throws error", tt.bencode, tt.target), func(t *testing.T) {
+			if err := Unmarshal([]byte(tt.bencode), tt.target); err == nil {
+				t.Error("Should have thrown an error but didn't")
+			}
+		})
+	}
+}
+
+func TestRawMessage(t *testing.T) {
+	// Unsorted keys and a list nested in the raw value must survive untouched
+	input := "d4:infod4:name3:foo6:lengthi5e5:filesli1eee8:announce3:urle"
+
+	var have struct {
+		Announce string     `bencode:"announce"`
+		Info     RawMessage `bencode:"info"`
+	}
+	if err := Unmarshal([]byte(input), &have); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	want := "d4:name3:foo6:lengthi5e5:filesli1eee"
+	if string(have.Info) != want {
+		t.Errorf("have: %s, want: %s", have.Info, want)
+	}
+	if have.Announce != "url" {
+		t.Errorf("have: %s, want: url", have.Announce)
+	}
+
+	encoded, err := Marshal(have)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if wantEncoded := "d8:announce3:url4:info" + want + "e"; string(encoded) != wantEncoded {
+		t.Errorf("have: %s, want: %s", encoded, wantEncoded)
+	}
+}
+
+func TestDecodeStrict(t *testing.T) {
+	var tests = []string{
+		"i0e",
+		"i-52e",
+		"0:",
+		"10:helloworld",
+		"d1:ai1e1:bi2ee",
+		"d1:ad1:xi1e1:yi2eee",
+	}
+
+	var failingTests = []struct {
+		bencode string
+		offset  string
+	}{
+		{"i-0e", "offset 0"},
+		{"i03e", "offset 0"},
+		{"i-03e", "offset 0"},
+		{"i+3e", "offset 0"},
+		{"ie", "offset 1"},
+		{"05:hello", "offset 0"},
+		{"li1ei01ee", "offset 4"},
+		{"d1:bi1e1:ai2ee", "offset 7"},
+		{"d1:ai1e1:ai2ee", "offset 7"},
+		{"d1:ad1:yi1e1:xi2eee", "offset 11"},
+	}
+
+	for _, bencode := range tests {
+		t.Run(bencode, func(t *testing.T) {
+			have, err := DecodeStrict(bencode)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			want, _ := Decode(bencode)
+			if !reflect.DeepEqual(have, want) {
+				t.Errorf("have: %v, want: %v", have, want)
+			}
+		})
+	}
+
+	for _, tt := range failingTests {
+		t.Run(fmt.Sprintf("%s throws error", tt.bencode), func(t *testing.T) {
+			if _, err := Decode(tt.bencode); err != nil && tt.bencode != "ie" {
+				t.Errorf("lenient decoding should have accepted it: %v", err)
+			}
+
+			_, err := DecodeStrict(tt.bencode)
+			if err == nil {
+				t.Fatal("Should have thrown an error but didn't")
+			}
+			if !strings.Contains(err.Error(), tt.offset) {
+				t.Errorf("have: %v, want an error at %s", err, tt.offset)
+			}
+		})
+	}
+
+	t.Run("struct targets", func(t *testing.T) {
+		var v struct {
+			A int `bencode:"a"`
+			B int `bencode:"b"`
+		}
+		d := NewDecoder(strings.NewReader("d1:bi1e1:ai2ee"))
+		d.Strict()
+		if err := d.Decode(&v); err == nil {
+			t.Error("Should have thrown an error but didn't")
+		}
+	})
+}
+
+func TestSyntaxError(t *testing.T) {
+	var tests = []struct {
+		bencode string
+		offset  int64
+		path    string
+	}{
+		{"", 0, ""},
+		{"5:hell", 0, ""},
+		{"x", 0, ""},
+		{"5hello", 1, ""},
+		{"d4:infod5:filesld6:lengthi1xeeeee", 27, "info.files[0].length"},
+		{"d4:infod5:filesld6:lengthi1eed6:lengthi-eeeee", 39, "info.files[1].length"},
+		{"li1e", 4, ""},
+		{"l9999999999999999999999:ae", 1, "[0]"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.bencode, func(t *testing.T) {
+			var v interface{}
+			err := Unmarshal([]byte(tt.bencode), &v)
+
+			var syntaxErr *SyntaxError
+			if !errors.As(err, &syntaxErr) {
+				t.Fatalf("have: %v (%T), want a *SyntaxError", err, err)
+			}
+			if syntaxErr.Offset != tt.offset {
+				t.Errorf("have offset: %d, want: %d (%v)", syntaxErr.Offset, tt.offset, err)
+			}
+			if syntaxErr.Path != tt.path {
+				t.Errorf("have path: %q, want: %q", syntaxErr.Path, tt.path)
+			}
+		})
+	}
+
+	t.Run("type errors carry the path", func(t *testing.T) {
+		var v struct {
+			Info struct {
+				PieceLength int `bencode:"piece length"`
+			} `bencode:"info"`
+		}
+		err := Unmarshal([]byte("d4:infod12:piece length3:abcee"), &v)
+
+		var typeErr *UnmarshalTypeError
+		if !errors.As(err, &typeErr) {
+			t.Fatalf("have: %v (%T), want a *UnmarshalTypeError", err, err)
+		}
+		if typeErr.Path != "info.piece length" || typeErr.Offset != 23 {
+			t.Errorf("have: %q at %d, want: %q at 23", typeErr.Path, typeErr.Offset, "info.piece length")
+		}
+	})
+}
+
+func TestDecoderLimits(t *testing.T) {
+	var tests = []struct {
+		name    string
+		bencode string
+		limits  Limits
+	}{
+		{"depth", "lllleeee", Limits{MaxDepth: 3}},
+		{"typed depth", "d1:ad1:ad1:ai1eeee", Limits{MaxDepth: 2}},
+		{"string length", "l3:abc4:abcde", Limits{MaxStringLength: 3}},
+		{"size", "l3:abc3:defe", Limits{MaxSize: 8}},
+		{"size of a bogus string", "1000000:abc", Limits{MaxSize: 100}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := NewDecoder(strings.NewReader(tt.bencode))
+			d.SetLimits(tt.limits)
+
+			var v map[string]map[string]interface{}
+			var target interface{} = &v
+			if tt.name != "typed depth" {
+				target = new(interface{})
+			}
+
+			var syntaxErr *SyntaxError
+			if err := d.Decode(target); !errors.As(err, &syntaxErr) {
+				t.Errorf("have: %v, want a *SyntaxError", err)
+			}
+		})
+	}
+
+	t.Run("default limits stop deep nesting", func(t *testing.T) {
+		deep := strings.Repeat("l", 100000) + strings.Repeat("e", 100000)
+		if _, err := Decode(deep); err == nil {
+			t.Error("Should have thrown an error but didn't")
+		}
+	})
+
+	t.Run("limits apply per value", func(t *testing.T) {
+		d := NewDecoder(strings.NewReader("3:abc3:def"))
+		d.SetLimits(Limits{MaxSize: 5})
+		for i := 0; i < 2; i++ {
+			var v interface{}
+			if err := d.Decode(&v); err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+		}
+	})
+}
+
+// Every prefix and single-byte corruption of a real torrent must produce an
+// error or a value, never a panic.
+func TestDecodeDoesNotPanic(t *testing.T) {
+	data, err := os.ReadFile("../../torrents/sample.torrent")
+	if err != nil {
+		t.Skipf("cannot read sample torrent: %v", err)
+	}
+
+	for i := 0; i < len(data); i++ {
+		var v interface{}
+		Unmarshal(data[:i], &v)
+
+		corrupted := bytes.Clone(data)
+		for _, c := range []byte{'e', 'i', 'l', 'd', ':', '-', '9', 0} {
+			corrupted[i] = c
+			Unmarshal(corrupted, &v)
+
+			var typed struct {
+				Announce string     `bencode:"announce"`
+				Info     RawMessage `bencode:"info"`
+			}
+			Unmarshal(corrupted, &typed)
+		}
+	}
+}
+
+func TestDecodeIntegers(t *testing.T) {
+	huge, _ := new(big.Int).SetString("-123456789012345678901234567890", 10)
+
+	var tests = []struct {
+		bencode string
+		want    interface{}
+	}{
+		{"i0e", 0},
+		{"i-9223372036854775808e", int(math.MinInt64)},
+		{"i18446744073709551615e", uint64(math.MaxUint64)},
+		{"i18446744073709551616e", new(big.Int).Lsh(big.NewInt(1), 64)},
+		{"i-123456789012345678901234567890e", huge},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.bencode, func(t *testing.T) {
+			have, err := Decode(tt.bencode)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(have, tt.want) {
+				t.Errorf("have: %v (%T), want: %v (%T)", have, have, tt.want, tt.want)
+			}
+
+			// Whatever type was chosen must encode back to the same bytes
+			if encoded := Encode(have); encoded != tt.bencode {
+				t.Errorf("have: %s, want: %s", encoded, tt.bencode)
+			}
+		})
+	}
+
+	t.Run("typed targets", func(t *testing.T) {
+		var v struct {
+			Length   int64    `bencode:"length"`
+			Unsigned uint64   `bencode:"unsigned"`
+			Big      *big.Int `bencode:"big"`
+			Small    int32    `bencode:"small"`
+		}
+		input := "d3:bigi99999999999999999999999e6:lengthi5000000000000e5:smalli-5e8:unsignedi18446744073709551615ee"
+		if err := Unmarshal([]byte(input), &v); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if v.Length != 5000000000000 || v.Unsigned != math.MaxUint64 || v.Small != -5 || v.Big.String() != "99999999999999999999999" {
+			t.Errorf("have: %+v", v)
+		}
+
+		encoded, err := Marshal(v)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if string(encoded) != input {
+			t.Errorf("have: %s, want: %s", encoded, input)
+		}
+
+		if err := Unmarshal([]byte("i99999999999999999999e"), &v.Length); err == nil {
+			t.Error("Should have thrown an error but didn't")
+		}
+	})
+}
+
+func TestDecoderSmallReads(t *testing.T) {
+	data, err := os.ReadFile("../../torrents/debian.torrent")
+	if err != nil {
+		t.Skipf("cannot read torrent: %v", err)
+	}
+
+	type metainfo struct {
+		Announce string     `bencode:"announce"`
+		Info     RawMessage `bencode:"info"`
+	}
+
+	var want metainfo
+	if err := Unmarshal(data, &want); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	readers := map[string]io.Reader{
+		"one byte": iotest.OneByteReader(bytes.NewReader(data)),
+		"half":     iotest.HalfReader(bytes.NewReader(data)),
+		"data err": iotest.DataErrReader(bytes.NewReader(data)),
+	}
+	for name, r := range readers {
+		t.Run(name, func(t *testing.T) {
+			var have metainfo
+			if err := NewDecoder(r).Decode(&have); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if have.Announce != want.Announce || !bytes.Equal(have.Info, want.Info) {
+				t.Error("streamed result differs from in-memory result")
+			}
+		})
+	}
+
+	t.Run("unmarshal does not copy", func(t *testing.T) {
+		var have struct {
+			Pieces []byte `bencode:"pieces"`
+		}
+		if err := Unmarshal(want.Info, &have); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if len(have.Pieces) == 0 || &have.Pieces[0] != &want.Info[bytes.Index(want.Info, have.Pieces)] {
+			t.Error("pieces do not point into the input")
+		}
+	})
+}
+
+func TestDict(t *testing.T) {
+	// Unsorted and duplicate keys, with an unsorted dictionary nested in a list
+	input := "d8:announce3:url4:infod6:lengthi5e4:name3:fooe1:ali1ed1:zi1e1:yi2eee8:announce4:url2e"
+
+	d := NewDecoder(strings.NewReader(input))
+	d.UseDict()
+	var v interface{}
+	if err := d.Decode(&v); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	dict, ok := v.(Dict)
+	if !ok {
+		t.Fatalf("have: %T, want: Dict", v)
+	}
+	wantKeys := []string{"announce", "info", "a", "announce"}
+	for i, entry := range dict {
+		if entry.Key != wantKeys[i] {
+			t.Errorf("have key %d: %s, want: %s", i, entry.Key, wantKeys[i])
+		}
+	}
+	if announce, _ := dict.Get("announce"); announce != "url" {
+		t.Errorf("have: %v, want: url", announce)
+	}
+
+	encoded, err := Marshal(v)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if string(encoded) != input {
+		t.Errorf("have: %s, want: %s", encoded, input)
+	}
+
+	t.Run("typed targets", func(t *testing.T) {
+		var v struct {
+			Info Dict `bencode:"info"`
+		}
+		if err := Unmarshal([]byte("d4:infod1:bi1e1:ad1:yi1e1:xi2eeee"), &v); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if _, ok := v.Info[1].Value.(Dict); !ok {
+			t.Errorf("have nested %T, want Dict", v.Info[1].Value)
+		}
+
+		v.Info.Set("b", 5)
+		v.Info.Set("c", "new")
+		encoded, _ := Marshal(v)
+		if want := "d4:infod1:bi5e1:ad1:yi1e1:xi2ee1:c3:newee"; string(encoded) != want {
+			t.Errorf("have: %s, want: %s", encoded, want)
+		}
+
+		if err := Unmarshal([]byte("d4:infoli1eee"), &v); err == nil {
+			t.Error("Should have thrown an error but didn't")
+		}
+	})
+}
+
+func TestToken(t *testing.T) {
+	d := NewDecoder(strings.NewReader("d3:foold1:ai1eee3:bari10000000000000000000ee2:hi"))
+
+	type token struct {
+		offset int64
+		token  Token
+	}
+	want := []token{
+		{0, Delim('d')},
+		{1, "foo"},
+		{6, Delim('l')},
+		{7, Delim('d')},
+		{8, "a"},
+		{11, 1},
+		{14, Delim('e')},
+		{15, Delim('e')},
+		{16, "bar"},
+		{21, uint64(10000000000000000000)},
+		{43, Delim('e')},
+		{44, "hi"},
+	}
+
+	for _, w := range want {
+		offset := d.InputOffset()
+		have, err := d.Token()
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if offset != w.offset || !reflect.DeepEqual(have, w.token) {
+			t.Errorf("have: %v at %d, want: %v at %d", have, offset, w.token, w.offset)
+		}
+	}
+
+	if _, err := d.Token(); err != io.EOF {
+		t.Errorf("have: %v, want: %v", err, io.EOF)
+	}
+
+	t.Run("mixed with Decode", func(t *testing.T) {
+		d := NewDecoder(strings.NewReader("l3:abcd1:xi1eee"))
+		d.Token()
+		var s string
+		var m map[string]int
+		if err := d.Decode(&s); err != nil || s != "abc" {
+			t.Fatalf("have: %q, %v", s, err)
+		}
+		if !d.More() {
+			t.Fatal("expected more elements")
+		}
+		if err := d.Decode(&m); err != nil || m["x"] != 1 {
+			t.Fatalf("have: %v, %v", m, err)
+		}
+		if d.More() {
+			t.Error("expected no more elements")
+		}
+		if tok, err := d.Token(); err != nil || tok != Delim('e') {
+			t.Errorf("have: %v, %v", tok, err)
+		}
+	})
+
+	t.Run("stray end delimiter", func(t *testing.T) {
+		if _, err := NewDecoder(strings.NewReader("e")).Token(); err == nil {
+			t.Error("Should have thrown an error but didn't")
+		}
+	})
+}
+
+func TestBuffered(t *testing.T) {
+	d := NewDecoder(strings.NewReader("i5e \nrest"))
+	var n int
+	if err := d.Decode(&n); err != nil || n != 5 {
+		t.Fatalf("have: %d, %v", n, err)
+	}
+	rest, err := io.ReadAll(d.Buffered())
+	if err != nil || string(rest) != " \nrest" {
+		t.Errorf("have: %q, %v, want: %q", rest, err, " \nrest")
+	}
+}
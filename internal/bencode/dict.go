@@ -0,0 +1,83 @@
+package bencode
+
+import "reflect"
+
+// A Dict is a bencode dictionary that keeps its entries in the order they
+// appeared in the input, duplicates included. Marshal writes the entries in
+// that same order, so decoding into Dicts and encoding the result reproduces
+// an input whose only irregularity is key order. Use RawMessage to keep
+// other non-canonical forms, such as integers with leading zeros.
+type Dict []DictEntry
+
+// A DictEntry is a single key and value of a Dict.
+type DictEntry struct {
+	Key   string
+	Value interface{}
+}
+
+var dictType = reflect.TypeOf(Dict(nil))
+
+// Get returns the value of the first entry with the given key.
+func (d Dict) Get(key string) (interface{}, bool) {
+	for _, entry := range d {
+		if entry.Key == key {
+			return entry.Value, true
+		}
+	}
+	return nil, false
+}
+
+// Set replaces the value of the first entry with the given key, or appends a
+// new entry if there is none.
+func (d *Dict) Set(key string, value interface{}) {
+	for i := range *d {
+		if (*d)[i].Key == key {
+			(*d)[i].Value = value
+			return
+		}
+	}
+	*d = append(*d, DictEntry{Key: key, Value: value})
+}
+
+// UseDict makes the decoder store dictionaries as Dict instead of
+// map[string]interface{} when decoding into an empty interface. Decoding into
+// a Dict does this regardless.
+func (d *Decoder) UseDict() {
+	d.useDict = true
+}
+
+// orderedDictValue decodes the next value, a dictionary, into v, a Dict.
+func (d *Decoder) orderedDictValue(v reflect.Value) error {
+	useDict := d.useDict
+	d.useDict = true
+	defer func() { d.useDict = useDict }()
+
+	start := d.offset()
+	c, err := d.peekByte()
+	if err != nil {
+		return err
+	}
+	if c != 'd' {
+		return d.typeError(kindOf(c), v.Type(), start)
+	}
+
+	result, err := d.decode()
+	if err != nil {
+		return err
+	}
+	v.Set(reflect.ValueOf(result))
+	return nil
+}
+
+// kindOf names the kind of bencoded value that starts with c.
+func kindOf(c byte) string {
+	switch c {
+	case 'i':
+		return "integer"
+	case 'l':
+		return "list"
+	case 'd':
+		return "dictionary"
+	}
+	return "string"
+}
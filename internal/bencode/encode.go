@@ -2,58 +2,305 @@ package bencode
 
 import (
 	"fmt"
+	"io"
+	"reflect"
 	"sort"
+	"strconv"
 
 	log "github.com/sirupsen/logrus"
 )
 
-func encodeString(value string) string {
-	return fmt.Sprintf("%d:%v", len(value), value)
+// Encode returns the bencoding of value. It exits the program if value cannot
+// be encoded; use Marshal to get an error instead.
+func Encode(value interface{}) string {
+	encoded, err := Marshal(value)
+	if err != nil {
+		log.Fatalf("error encoding value: %v", err)
+	}
+	return string(encoded)
+}
+
+// Marshal returns the bencoding of v.
+//
+// Strings, []byte and byte arrays encode as bencoded strings, integer types
+// and big.Int as integers, slices and arrays as lists, and maps with string
+// keys as dictionaries. Structs encode as dictionaries whose keys come from
+// the field's "bencode" tag, e.g. `bencode:"piece length,omitempty"`. A tag
+// of "-" skips the field, an empty name uses the Go field name, and the
+// omitempty option leaves out zero values. A RawMessage is written out
+// verbatim and a Dict keeps the order of its entries. Nil pointers and
+// interfaces are left out of dictionaries and lists.
+func Marshal(v interface{}) ([]byte, error) {
+	e := &encodeState{}
+	if err := e.marshal(v); err != nil {
+		return nil, err
+	}
+	return e.buf, nil
 }
 
-func encodeInt(value int) string {
-	return fmt.Sprintf("i%ve", value)
+// An Encoder writes bencoded values to an output stream.
+type Encoder struct {
+	w io.Writer
 }
 
-func encodeList(list []interface{}) string {
-	result := ""
-	for i := range list {
-		result += Encode(list[i])
+// NewEncoder returns a new encoder that writes to w.
+func NewEncoder(w io.Writer) *Encoder {
+	return &Encoder{w: w}
+}
+
+// Encode writes the bencoding of v to the stream. See Marshal for how Go
+// values are encoded. Output is written as it is produced, so large values
+// are never held in memory as a whole; if an error occurs part of the value
+// may already have been written.
+func (enc *Encoder) Encode(v interface{}) error {
+	e := &encodeState{w: enc.w}
+	if err := e.marshal(v); err != nil {
+		return err
 	}
+	return e.flush()
+}
 
-	return fmt.Sprintf("l%ve", result)
+// flushSize is how much output an Encoder collects before writing it out.
+const flushSize = 32 << 10
+
+// encodeState appends the encoding to buf and, when writing to a stream,
+// passes it on to w whenever it grows beyond flushSize.
+type encodeState struct {
+	buf []byte
+	w   io.Writer
 }
 
-func encodeDict(dict map[string]interface{}) string {
-	result := ""
-	keys := make([]string, 0, len(dict))
-	for key := range dict {
-		keys = append(keys, key)
+func (e *encodeState) flush() error {
+	if e.w == nil || len(e.buf) == 0 {
+		return nil
 	}
+	_, err := e.w.Write(e.buf)
+	e.buf = e.buf[:0]
+	return err
+}
 
-	sort.Strings(keys)
+func (e *encodeState) maybeFlush() error {
+	if e.w != nil && len(e.buf) >= flushSize {
+		return e.flush()
+	}
+	return nil
+}
 
-	for _, key := range keys {
-		result += encodeString(key)
-		result += Encode(dict[key])
+func (e *encodeState) writeInt(n int64) error {
+	e.buf = append(e.buf, 'i')
+	e.buf = strconv.AppendInt(e.buf, n, 10)
+	e.buf = append(e.buf, 'e')
+	return e.maybeFlush()
+}
+
+func (e *encodeState) writeUint(n uint64) error {
+	e.buf = append(e.buf, 'i')
+	e.buf = strconv.AppendUint(e.buf, n, 10)
+	e.buf = append(e.buf, 'e')
+	return e.maybeFlush()
+}
+
+func (e *encodeState) writeString(s string) error {
+	e.buf = strconv.AppendInt(e.buf, int64(len(s)), 10)
+	e.buf = append(e.buf, ':')
+	return e.writeRaw(s)
+}
+
+func (e *encodeState) writeBytes(b []byte) error {
+	e.buf = strconv.AppendInt(e.buf, int64(len(b)), 10)
+	e.buf = append(e.buf, ':')
+	return e.writeRawBytes(b)
+}
+
+// writeRaw appends s verbatim. Large strings go straight to the stream
+// instead of through the buffer.
+func (e *encodeState) writeRaw(s string) error {
+	if e.w != nil && len(s) >= flushSize {
+		if err := e.flush(); err != nil {
+			return err
+		}
+		_, err := io.WriteString(e.w, s)
+		return err
 	}
+	e.buf = append(e.buf, s...)
+	return e.maybeFlush()
+}
 
-	return fmt.Sprintf("d%ve", result)
+func (e *encodeState) writeRawBytes(b []byte) error {
+	if e.w != nil && len(b) >= flushSize {
+		if err := e.flush(); err != nil {
+			return err
+		}
+		_, err := e.w.Write(b)
+		return err
+	}
+	e.buf = append(e.buf, b...)
+	return e.maybeFlush()
 }
 
-func Encode(value interface{}) string {
-	switch v := value.(type) {
+// marshal encodes v, taking a shortcut for the types Decode produces.
+func (e *encodeState) marshal(v interface{}) error {
+	switch x := v.(type) {
 	case string:
-		return encodeString(v)
+		return e.writeString(x)
 	case int:
-		return encodeInt(v)
+		return e.writeInt(int64(x))
 	case []interface{}:
-		return encodeList(v)
+		e.buf = append(e.buf, 'l')
+		for _, elem := range x {
+			if elem == nil {
+				continue
+			}
+			if err := e.marshal(elem); err != nil {
+				return err
+			}
+		}
+		e.buf = append(e.buf, 'e')
+		return nil
 	case map[string]interface{}:
-		return encodeDict(v)
+		keys := make([]string, 0, len(x))
+		for key := range x {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		e.buf = append(e.buf, 'd')
+		for _, key := range keys {
+			if x[key] == nil {
+				continue
+			}
+			if err := e.writeString(key); err != nil {
+				return err
+			}
+			if err := e.marshal(x[key]); err != nil {
+				return err
+			}
+		}
+		e.buf = append(e.buf, 'e')
+		return nil
+	case Dict:
+		// Entries are written as they are, in their original order
+		e.buf = append(e.buf, 'd')
+		for _, entry := range x {
+			if entry.Value == nil {
+				continue
+			}
+			if err := e.writeString(entry.Key); err != nil {
+				return err
+			}
+			if err := e.marshal(entry.Value); err != nil {
+				return err
+			}
+		}
+		e.buf = append(e.buf, 'e')
+		return nil
+	default:
+		return e.marshalValue(reflect.ValueOf(v))
+	}
+}
+
+func (e *encodeState) marshalValue(v reflect.Value) error {
+	if !v.IsValid() {
+		return fmt.Errorf("cannot encode nil value")
+	}
+
+	if v.Type() == dictType {
+		return e.marshal(v.Interface())
+	}
+
+	if v.Type() == rawMessageType {
+		if len(v.Bytes()) == 0 {
+			return fmt.Errorf("cannot encode empty RawMessage")
+		}
+		return e.writeRawBytes(v.Bytes())
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		return e.writeString(v.String())
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return e.writeInt(v.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return e.writeUint(v.Uint())
+	case reflect.Slice, reflect.Array:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			if v.Kind() == reflect.Slice {
+				return e.writeBytes(v.Bytes())
+			}
+			b := make([]byte, v.Len())
+			reflect.Copy(reflect.ValueOf(b), v)
+			return e.writeBytes(b)
+		}
+		e.buf = append(e.buf, 'l')
+		for i := 0; i < v.Len(); i++ {
+			elem := v.Index(i)
+			if isNilValue(elem) {
+				continue
+			}
+			if err := e.marshalValue(elem); err != nil {
+				return err
+			}
+		}
+		e.buf = append(e.buf, 'e')
+	case reflect.Map:
+		if v.Type().Key().Kind() != reflect.String {
+			return fmt.Errorf("cannot encode map with non-string key type %s", v.Type().Key())
+		}
+		keys := make([]string, 0, v.Len())
+		for _, key := range v.MapKeys() {
+			keys = append(keys, key.String())
+		}
+		sort.Strings(keys)
+
+		e.buf = append(e.buf, 'd')
+		for _, key := range keys {
+			elem := v.MapIndex(reflect.ValueOf(key).Convert(v.Type().Key()))
+			if isNilValue(elem) {
+				continue
+			}
+			if err := e.writeString(key); err != nil {
+				return err
+			}
+			if err := e.marshalValue(elem); err != nil {
+				return err
+			}
+		}
+		e.buf = append(e.buf, 'e')
+	case reflect.Struct:
+		if v.Type() == bigIntType {
+			e.buf = append(e.buf, 'i')
+			e.buf = append(e.buf, marshalBigInt(v)...)
+			e.buf = append(e.buf, 'e')
+			return e.maybeFlush()
+		}
+
+		e.buf = append(e.buf, 'd')
+		for _, f := range cachedFields(v.Type()).list {
+			elem := v.Field(f.index)
+			if isNilValue(elem) || (f.omitEmpty && isEmptyValue(elem)) {
+				continue
+			}
+			if err := e.writeString(f.name); err != nil {
+				return err
+			}
+			if err := e.marshalValue(elem); err != nil {
+				return err
+			}
+		}
+		e.buf = append(e.buf, 'e')
+	case reflect.Pointer, reflect.Interface:
+		if v.IsNil() {
+			return fmt.Errorf("cannot encode nil %s", v.Type())
+		}
+		return e.marshalValue(v.Elem())
 	default:
-		log.Fatal("error encoding value")
+		return fmt.Errorf("cannot encode value of type %s", v.Type())
 	}
+	return nil
+}
 
-	return ""
+// isNilValue reports whether v is a nil pointer or interface, which have no
+// bencode representation.
+func isNilValue(v reflect.Value) bool {
+	return (v.Kind() == reflect.Interface || v.Kind() == reflect.Pointer) && v.IsNil()
 }
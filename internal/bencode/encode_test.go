@@ -1,7 +1,9 @@
 package bencode
 
 import (
+	"bytes"
 	"fmt"
+	"strings"
 	"testing"
 )
 
@@ -31,3 +33,87 @@ func TestEncode(t *testing.T) {
 		})
 	}
 }
+
+func TestMarshal(t *testing.T) {
+	type file struct {
+		Length int64    `bencode:"length"`
+		Path   []string `bencode:"path"`
+	}
+	type torrent struct {
+		Announce string   `bencode:"announce"`
+		Comment  string   `bencode:"comment,omitempty"`
+		InfoHash [4]byte  `bencode:"info hash"`
+		Files    []file   `bencode:"files"`
+		Private  *int     `bencode:"private"`
+		Seeds    []string `bencode:"url-list,omitempty"`
+		Skipped  int      `bencode:"-"`
+		Untagged uint16
+	}
+
+	tests := []struct {
+		data interface{}
+		want string
+	}{
+		{[]byte("hello"), "5:hello"},
+		{int64(-7), "i-7e"},
+		{uint64(1) << 63, "i9223372036854775808e"},
+		{map[string][]int{"b": {1}, "a": {}}, "d1:ale1:bli1eee"},
+		{
+			torrent{Announce: "url", InfoHash: [4]byte{'a', 'b', 'c', 'd'}, Files: []file{{1, []string{"x"}}}, Skipped: 5, Untagged: 2},
+			"d8:Untaggedi2e8:announce3:url5:filesld6:lengthi1e4:pathl1:xeee9:info hash4:abcde",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.want, func(t *testing.T) {
+			have, err := Marshal(tt.data)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if string(have) != tt.want {
+				t.Errorf("have: %s, want %s", have, tt.want)
+			}
+		})
+	}
+
+	t.Run("unsupported type throws error", func(t *testing.T) {
+		if _, err := Marshal(map[int]string{1: "a"}); err == nil {
+			t.Error("Should have thrown an error but didn't")
+		}
+	})
+}
+
+func TestEncoder(t *testing.T) {
+	large := strings.Repeat("x", 3*flushSize)
+	values := []interface{}{
+		"hello",
+		map[string]interface{}{"pieces": large, "length": 5},
+		[]interface{}{large, []byte(large), RawMessage("i1e")},
+	}
+
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+	var want string
+	for _, v := range values {
+		if err := enc.Encode(v); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		encoded, err := Marshal(v)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		want += string(encoded)
+	}
+
+	if buf.String() != want {
+		t.Errorf("stream output differs from Marshal output")
+	}
+
+	d := NewDecoder(&buf)
+	for range values {
+		var v interface{}
+		if err := d.Decode(&v); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+}
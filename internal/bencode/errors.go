@@ -0,0 +1,86 @@
+package bencode
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// A SyntaxError describes malformed or oversized bencoded input.
+type SyntaxError struct {
+	Offset int64  // Input offset at which the error was detected
+	Path   string // Location of the offending value, e.g. "info.files[3].length"
+	msg    string
+	err    error // Underlying cause, e.g. io.ErrUnexpectedEOF
+}
+
+func (e *SyntaxError) Error() string {
+	if e.Path == "" {
+		return fmt.Sprintf("%s at offset %d", e.msg, e.Offset)
+	}
+	return fmt.Sprintf("%s at offset %d (%s)", e.msg, e.Offset, e.Path)
+}
+
+func (e *SyntaxError) Unwrap() error {
+	return e.err
+}
+
+// An UnmarshalTypeError describes a bencoded value that cannot be stored in
+// the Go value it was decoded into.
+type UnmarshalTypeError struct {
+	Value  string       // Kind of bencoded value: "string", "integer", "list" or "dictionary"
+	Type   reflect.Type // Type of the Go value it could not be assigned to
+	Offset int64        // Input offset of the value
+	Path   string       // Location of the value, e.g. "info.piece length"
+	msg    string       // Optional detail
+}
+
+func (e *UnmarshalTypeError) Error() string {
+	s := fmt.Sprintf("cannot decode bencoded %s at offset %d into Go value of type %s", e.Value, e.Offset, e.Type)
+	if e.msg != "" {
+		s += ": " + e.msg
+	}
+	if e.Path != "" {
+		s += " (" + e.Path + ")"
+	}
+	return s
+}
+
+// syntaxError returns a SyntaxError at offset for the value currently being
+// decoded.
+func (d *Decoder) syntaxError(offset int64, format string, args ...interface{}) error {
+	return &SyntaxError{Offset: offset, Path: d.pathString(), msg: fmt.Sprintf(format, args...)}
+}
+
+func (d *Decoder) typeError(kind string, t reflect.Type, offset int64, detail ...string) error {
+	return &UnmarshalTypeError{Value: kind, Type: t, Offset: offset, Path: d.pathString(), msg: strings.Join(detail, " ")}
+}
+
+// pushPath records that the decoder is descending into a dictionary key (a
+// string) or list index (an int).
+func (d *Decoder) pushPath(elem interface{}) {
+	d.path = append(d.path, elem)
+}
+
+func (d *Decoder) popPath() {
+	d.path = d.path[:len(d.path)-1]
+}
+
+func (d *Decoder) pathString() string {
+	var sb strings.Builder
+	for _, elem := range d.path {
+		switch e := elem.(type) {
+		case string:
+			if sb.Len() > 0 {
+				sb.WriteByte('.')
+			}
+			sb.WriteString(e)
+		case int:
+			sb.WriteByte('[')
+			sb.WriteString(strconv.Itoa(e))
+			sb.WriteByte(']')
+		}
+	}
+	return sb.String()
+}
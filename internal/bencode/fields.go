@@ -0,0 +1,78 @@
+package bencode
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// field describes how a struct field maps onto a bencode dictionary key.
+//
+// Fields are configured with a tag of the form `bencode:"name,omitempty"`.
+// A tag of "-" skips the field, and fields without a tag use the Go field
+// name as the key.
+type field struct {
+	name      string
+	index     int
+	omitEmpty bool
+}
+
+type structFields struct {
+	list   []field // Sorted by key, the order required when encoding
+	byName map[string]field
+}
+
+var fieldCache sync.Map // map[reflect.Type]*structFields
+
+func cachedFields(t reflect.Type) *structFields {
+	if f, ok := fieldCache.Load(t); ok {
+		return f.(*structFields)
+	}
+	f, _ := fieldCache.LoadOrStore(t, typeFields(t))
+	return f.(*structFields)
+}
+
+func typeFields(t reflect.Type) *structFields {
+	fields := &structFields{byName: make(map[string]field)}
+
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		if !sf.IsExported() {
+			continue
+		}
+
+		tag := sf.Tag.Get("bencode")
+		if tag == "-" {
+			continue
+		}
+
+		name, opts, _ := strings.Cut(tag, ",")
+		if name == "" {
+			name = sf.Name
+		}
+
+		f := field{name: name, index: i, omitEmpty: opts == "omitempty"}
+		fields.list = append(fields.list, f)
+		fields.byName[name] = f
+	}
+
+	sort.Slice(fields.list, func(i, j int) bool {
+		return fields.list[i].name < fields.list[j].name
+	})
+	return fields
+}
+
+func isEmptyValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return v.Uint() == 0
+	case reflect.Interface, reflect.Pointer:
+		return v.IsNil()
+	}
+	return false
+}
@@ -0,0 +1,41 @@
+package bencode
+
+import (
+	"math/big"
+	"reflect"
+	"strconv"
+)
+
+var bigIntType = reflect.TypeOf(big.Int{})
+
+// parseInteger converts the digits of an integer token into the smallest of
+// int, int64, uint64 or *big.Int that holds the value exactly.
+func parseInteger(digits string) (interface{}, bool) {
+	if n, err := strconv.Atoi(digits); err == nil {
+		return n, true
+	}
+	if n, err := strconv.ParseInt(digits, 10, 64); err == nil {
+		return n, true
+	}
+	if n, err := strconv.ParseUint(digits, 10, 64); err == nil {
+		return n, true
+	}
+	return new(big.Int).SetString(digits, 10)
+}
+
+// bigIntValue stores the digits of an integer token in v, a big.Int.
+func (d *Decoder) bigIntValue(v reflect.Value, digits string, offset int64) error {
+	if _, ok := v.Addr().Interface().(*big.Int).SetString(digits, 10); !ok {
+		return d.syntaxError(offset, "invalid integer %q", digits)
+	}
+	return nil
+}
+
+// marshalBigInt returns the decimal digits of v, a big.Int.
+func marshalBigInt(v reflect.Value) string {
+	if v.CanAddr() {
+		return v.Addr().Interface().(*big.Int).String()
+	}
+	n := v.Interface().(big.Int)
+	return n.String()
+}
@@ -0,0 +1,46 @@
+package bencode
+
+// Limits bounds the resources a Decoder spends on a single value, so that
+// input from untrusted trackers and peers cannot exhaust memory or the stack.
+// A zero field means no limit.
+type Limits struct {
+	MaxDepth        int   // Maximum nesting of lists and dictionaries
+	MaxStringLength int64 // Maximum length of a single string
+	MaxSize         int64 // Maximum encoded size of a single top-level value
+}
+
+// DefaultLimits are the limits of a new Decoder. They leave plenty of room for
+// real torrents, whose largest string is the piece hashes.
+var DefaultLimits = Limits{
+	MaxDepth:        256,
+	MaxStringLength: 128 << 20,
+	MaxSize:         256 << 20,
+}
+
+// SetLimits replaces the decoder's resource limits.
+func (d *Decoder) SetLimits(limits Limits) {
+	d.limits = limits
+}
+
+// enter is called when the decoder descends into a list or dictionary that
+// starts at offset.
+func (d *Decoder) enter(offset int64) error {
+	d.depth++
+	if d.limits.MaxDepth > 0 && d.depth > d.limits.MaxDepth {
+		return d.syntaxError(offset, "nesting exceeds maximum depth of %d", d.limits.MaxDepth)
+	}
+	return nil
+}
+
+func (d *Decoder) leave() {
+	d.depth--
+}
+
+// checkSize fails if consuming n more bytes would take the current value past
+// the size limit.
+func (d *Decoder) checkSize(n int64) error {
+	if d.limits.MaxSize > 0 && d.offset()-d.start+n > d.limits.MaxSize {
+		return d.syntaxError(d.offset(), "value exceeds maximum size of %d bytes", d.limits.MaxSize)
+	}
+	return nil
+}
@@ -0,0 +1,24 @@
+package bencode
+
+import "reflect"
+
+// RawMessage is a raw encoded bencode value. Decoding into a RawMessage
+// stores the exact bytes of the value as they appeared in the input, and
+// encoding a RawMessage writes them out verbatim. It is used to delay
+// decoding or to hash a value, such as a torrent's info dictionary, exactly
+// as it was received.
+type RawMessage []byte
+
+var rawMessageType = reflect.TypeOf(RawMessage(nil))
+
+// rawValue consumes the next value and returns the bytes it spans.
+func (d *Decoder) rawValue() ([]byte, error) {
+	// Keep the value in the buffer while we step over it
+	d.keep = d.pos
+	defer func() { d.keep = -1 }()
+
+	if err := d.skip(); err != nil {
+		return nil, err
+	}
+	return d.owned(d.buf[d.keep:d.pos:d.pos]), nil
+}
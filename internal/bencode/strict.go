@@ -0,0 +1,63 @@
+package bencode
+
+import "fmt"
+
+// Strict makes the decoder reject any input that is not in canonical form:
+// integers with leading zeros, negative zero or a plus sign, string lengths
+// with leading zeros, and dictionaries whose keys are duplicated or not sorted
+// by their raw bytes. Canonical input is the only form in which re-encoding
+// a value reproduces the original bytes.
+func (d *Decoder) Strict() {
+	d.strict = true
+}
+
+// DecodeStrict is like Decode but rejects input that is not in canonical
+// form. See Decoder.Strict.
+func DecodeStrict(bencode string) (result interface{}, err error) {
+	d := newBytesDecoder([]byte(bencode))
+	d.Strict()
+	if err = d.decodeAll(&result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// checkCanonicalInt returns why the digits of an integer token are not
+// canonical, or an empty string if they are.
+func checkCanonicalInt(digits string) string {
+	switch {
+	case digits == "-0":
+		return "non-canonical integer: negative zero"
+	case digits[0] == '+':
+		return fmt.Sprintf("non-canonical integer %q: plus sign", digits)
+	case len(digits) > 1 && digits[0] == '0', len(digits) > 2 && digits[:2] == "-0":
+		return fmt.Sprintf("non-canonical integer %q: leading zero", digits)
+	}
+	return ""
+}
+
+// checkCanonicalLength returns why the length prefix of a string token is not
+// canonical, or an empty string if it is.
+func checkCanonicalLength(digits string) string {
+	switch {
+	case digits[0] == '+':
+		return fmt.Sprintf("non-canonical string length %q: plus sign", digits)
+	case len(digits) > 1 && digits[0] == '0':
+		return fmt.Sprintf("non-canonical string length %q: leading zero", digits)
+	}
+	return ""
+}
+
+// checkKeyOrder returns why key may not follow the previous key of the same
+// dictionary, or an empty string if it may.
+func checkKeyOrder(prev *string, key string) string {
+	switch {
+	case prev == nil:
+		return ""
+	case key == *prev:
+		return fmt.Sprintf("duplicate dict key %q", key)
+	case key < *prev:
+		return fmt.Sprintf("dict key %q is not sorted: it follows %q", key, *prev)
+	}
+	return ""
+}
@@ -0,0 +1,70 @@
+package bencode
+
+// A Token holds a value of one of these types:
+//
+//	Delim, for the start and end of lists and dictionaries
+//	string, for bencoded strings, dictionary keys included
+//	int, int64, uint64 or *big.Int, for bencoded integers
+type Token interface{}
+
+// A Delim is a list or dictionary delimiter: 'l' or 'd' to open one, 'e' to
+// close it.
+type Delim byte
+
+func (d Delim) String() string {
+	return string(d)
+}
+
+// Token returns the next bencode token in the input stream, or io.EOF at the
+// end of the input between top-level values. Inside a dictionary, keys and
+// values alternate. Call InputOffset before Token to learn where the token
+// starts.
+//
+// Token checks nesting depth and string length limits, but not the size of
+// a whole value nor, in strict mode, the order of dictionary keys.
+func (d *Decoder) Token() (Token, error) {
+	if d.depth == 0 {
+		if err := d.fill(1); err != nil {
+			return nil, err
+		}
+		d.start = d.offset()
+		d.path = d.path[:0]
+	}
+
+	c, err := d.peekByte()
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case c == 'l' || c == 'd':
+		if err := d.enter(d.offset()); err != nil {
+			return nil, err
+		}
+		d.pos++
+		return Delim(c), nil
+	case c == 'e':
+		if d.depth == 0 {
+			return nil, d.syntaxError(d.offset(), "unexpected end delimiter")
+		}
+		d.leave()
+		d.pos++
+		return Delim(c), nil
+	case c == 'i':
+		return d.decodeInt()
+	case c >= '0' && c <= '9':
+		return d.decodeString()
+	default:
+		return nil, d.syntaxError(d.offset(), "invalid character %q", c)
+	}
+}
+
+// More reports whether there is another element in the current list or
+// dictionary, or another top-level value in the input.
+func (d *Decoder) More() bool {
+	if d.depth == 0 {
+		return d.fill(1) == nil
+	}
+	c, err := d.peekByte()
+	return err == nil && c != 'e'
+}
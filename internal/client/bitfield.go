@@ -6,11 +6,17 @@ type Bitfield []byte
 func (b Bitfield) HasPiece(index int) bool {
 	byteIndex := index / 8
 	offset := index % 8
+	if index < 0 || byteIndex >= len(b) {
+		return false
+	}
 	return b[byteIndex]>>(7-offset)&1 != 0
 }
 
 func (b Bitfield) AddPiece(index int) {
 	byteIndex := index / 8
 	offset := index % 8
+	if index < 0 || byteIndex >= len(b) {
+		return
+	}
 	b[byteIndex] |= 1 << (7 - offset)
 }
@@ -6,12 +6,15 @@ import (
 	"io"
 	"net"
 	"strconv"
-	"strings"
 	"time"
 
 	log "github.com/sirupsen/logrus"
 )
 
+// The longest message we accept from a peer, which leaves room for a
+// bitfield of millions of pieces and for the largest blocks clients send
+const maxMessageLength = 1 << 21
+
 // A Client is a TCP connection with a peer
 type Client struct {
 	Conn     net.Conn
@@ -28,7 +31,7 @@ func New(ip net.IP, port uint16) Client {
 }
 
 func (c *Client) Address() string {
-	address := fmt.Sprintf("%v:%v", c.IP, c.Port)
+	address := net.JoinHostPort(c.IP.String(), strconv.Itoa(int(c.Port)))
 	log.Debugf("Client address: %s", address)
 	return address
 }
@@ -74,6 +77,9 @@ func (c *Client) receiveBitfield() (*Bitfield, error) {
 
 	messageLength := binary.BigEndian.Uint32(buffer)
 	log.Debugf("Bitfield message length: %d", messageLength)
+	if messageLength == 0 || messageLength > maxMessageLength {
+		return nil, fmt.Errorf("invalid bitfield message length: %d", messageLength)
+	}
 	buffer = make([]byte, messageLength)
 	if _, err := io.ReadFull(conn, buffer); err != nil {
 		return nil, fmt.Errorf("cannot read message payload: %v", err)
@@ -110,6 +116,9 @@ func (c *Client) Read() (*Message, error) {
 		log.Debug("Received keep-alive message")
 		return nil, nil
 	}
+	if messageLength > maxMessageLength {
+		return nil, fmt.Errorf("message too long: %d bytes", messageLength)
+	}
 
 	buffer = make([]byte, messageLength)
 	if _, err := io.ReadFull(conn, buffer); err != nil {
@@ -141,15 +150,30 @@ func (c *Client) Send(message *Message) error {
 }
 
 func (c *Client) HasPiece(index int) bool {
+	if c.Bitfield == nil {
+		return false
+	}
 	hasPiece := c.Bitfield.HasPiece(index)
 	log.Debugf("Checking if client has piece %d: %v", index, hasPiece)
 	return hasPiece
 }
 
-func (c *Client) AddPiece(message *Message) {
-	index := binary.BigEndian.Uint32(message.Payload)
+// AddPiece records the piece a have message announces. A malformed message,
+// or one for a piece past the end of the peer's bitfield, is an error.
+func (c *Client) AddPiece(message *Message) error {
+	if len(message.Payload) != 4 {
+		return fmt.Errorf("invalid %s payload length: %d", message.MessageID, len(message.Payload))
+	}
+	index := int(binary.BigEndian.Uint32(message.Payload))
 	log.Debugf("Adding piece index %d to bitfield", index)
-	c.Bitfield.AddPiece(int(index))
+	if c.Bitfield == nil {
+		return nil
+	}
+	if index >= len(*c.Bitfield)*8 {
+		return fmt.Errorf("have message for piece %d past the end of the bitfield", index)
+	}
+	c.Bitfield.AddPiece(index)
+	return nil
 }
 
 func (c *Client) SendKeepAlive() {
@@ -192,6 +216,13 @@ func (c *Client) SendHave(pieceIndex int) {
 	c.Send(&msg)
 }
 
+func (c *Client) SendPiece(pieceIndex, offset int, block []byte) error {
+	log.Infof("Sending piece index %d, offset %d, block size %d", pieceIndex, offset, len(block))
+	msg := Message{MessageID: MSG_PIECE}
+	msg.FormatPiece(pieceIndex, offset, block)
+	return c.Send(&msg)
+}
+
 func (c *Client) SendRequest(pieceIndex, offset, blockSize int) {
 	log.Infof("Sending request for piece index %d, offset %d, block size %d", pieceIndex, offset, blockSize)
 	msg := Message{MessageID: MSG_REQUEST}
@@ -199,23 +230,24 @@ func (c *Client) SendRequest(pieceIndex, offset, blockSize int) {
 	c.Send(&msg)
 }
 
-// StringToClient converts a string in the format "IP:Port" to a Client.
+// StringToClient converts a string in the format "IP:Port", or "[IP]:Port"
+// for IPv6, to a Client.
 func StringToClient(addr string) (Client, error) {
 	// Split the string into IP and port
 	var zero Client
-	parts := strings.Split(addr, ":")
-	if len(parts) != 2 {
+	host, portString, err := net.SplitHostPort(addr)
+	if err != nil {
 		return zero, fmt.Errorf("address must be in the format IP:Port")
 	}
 
 	// Parse the IP
-	ip := net.ParseIP(parts[0])
+	ip := net.ParseIP(host)
 	if ip == nil {
 		return zero, fmt.Errorf("invalid IP address")
 	}
 
 	// Parse the port
-	port, err := strconv.Atoi(parts[1])
+	port, err := strconv.Atoi(portString)
 	if err != nil {
 		return zero, fmt.Errorf("invalid port number")
 	}
@@ -0,0 +1,45 @@
+package client
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestAddPiece(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload []byte
+		want    Bitfield
+		wantErr bool
+	}{
+		{"first piece", []byte{0, 0, 0, 0}, Bitfield{0x80, 0x00}, false},
+		{"last piece", []byte{0, 0, 0, 15}, Bitfield{0x00, 0x01}, false},
+		{"past the end", []byte{0, 0, 0, 16}, Bitfield{0x00, 0x00}, true},
+		{"largest index", []byte{0xff, 0xff, 0xff, 0xff}, Bitfield{0x00, 0x00}, true},
+		{"short", []byte{0, 0, 1}, Bitfield{0x00, 0x00}, true},
+		{"empty", nil, Bitfield{0x00, 0x00}, true},
+		{"long", []byte{0, 0, 0, 0, 0}, Bitfield{0x00, 0x00}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := Client{Bitfield: &Bitfield{0x00, 0x00}}
+			err := c.AddPiece(&Message{MessageID: MSG_HAVE, Payload: tt.payload})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("have error %v, want error: %v", err, tt.wantErr)
+			}
+			if !bytes.Equal(*c.Bitfield, tt.want) {
+				t.Errorf("have %08b, want %08b", *c.Bitfield, tt.want)
+			}
+		})
+	}
+
+	// Without a bitfield, a have message is checked and ignored
+	c := Client{}
+	if err := c.AddPiece(&Message{MessageID: MSG_HAVE, Payload: []byte{0, 0}}); err == nil {
+		t.Error("Should have thrown an error but didn't")
+	}
+	if err := c.AddPiece(&Message{MessageID: MSG_HAVE, Payload: []byte{0, 0, 0, 3}}); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,149 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// How long a peer that connects to us may take to send its handshake
+const handshakeTimeout = 10 * time.Second
+
+// A Listener accepts connections from peers on the port announced to
+// trackers and hands each one to the torrent its handshake asks for.
+type Listener struct {
+	listener net.Listener
+
+	mutex    sync.RWMutex
+	torrents map[[20]byte]*registration // By info hash
+}
+
+// registration is a torrent that accepts peers.
+type registration struct {
+	peerID   [20]byte
+	bitfield func() []byte
+	accept   func(c Client)
+}
+
+// Listen starts accepting peers on address, such as ":6881".
+func Listen(address string) (*Listener, error) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	log.Infof("Listening for peers on %s", listener.Addr())
+
+	l := &Listener{listener: listener, torrents: make(map[[20]byte]*registration)}
+	go l.serve()
+	return l, nil
+}
+
+// Port returns the port the listener accepts peers on.
+func (l *Listener) Port() int {
+	return l.listener.Addr().(*net.TCPAddr).Port
+}
+
+// Register routes peers asking for infoHash to a torrent. They are greeted
+// with peerID and the pieces returned by bitfield, and then handed to accept,
+// which takes over the connection.
+func (l *Listener) Register(infoHash, peerID [20]byte, bitfield func() []byte, accept func(c Client)) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.torrents[infoHash] = &registration{peerID: peerID, bitfield: bitfield, accept: accept}
+}
+
+// Unregister stops accepting peers for infoHash.
+func (l *Listener) Unregister(infoHash [20]byte) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	delete(l.torrents, infoHash)
+}
+
+// Close stops accepting peers. Connections already handed over stay open.
+func (l *Listener) Close() error {
+	return l.listener.Close()
+}
+
+func (l *Listener) serve() {
+	for {
+		conn, err := l.listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			// Such as running out of file descriptors; give it a moment
+			log.Warnf("Error accepting peer: %v", err)
+			time.Sleep(time.Second)
+			continue
+		}
+		go l.handle(conn)
+	}
+}
+
+func (l *Listener) handle(conn net.Conn) {
+	log.Infof("Peer %s connected", conn.RemoteAddr())
+	c, reg, err := l.handshake(conn)
+	if err != nil {
+		log.Warnf("Rejecting peer %s: %v", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+	log.Infof("Accepted peer %s: PeerID=%x", c.Address(), c.PeerID)
+	reg.accept(c)
+}
+
+// handshake reads the handshake of a peer that connected to us and answers it
+// with ours and our bitfield. The peer's bitfield starts out empty, to be
+// filled in by the bitfield and have messages it sends.
+func (l *Listener) handshake(conn net.Conn) (Client, *registration, error) {
+	var zero Client
+
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	buf := make([]byte, handshakeLength)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return zero, nil, fmt.Errorf("cannot read handshake: %v", err)
+	}
+	request, err := parseHandshake(buf)
+	if err != nil {
+		return zero, nil, err
+	}
+	request.log()
+
+	l.mutex.RLock()
+	reg := l.torrents[request.InfoHash]
+	l.mutex.RUnlock()
+	if reg == nil {
+		return zero, nil, fmt.Errorf("unknown info hash %x", request.InfoHash)
+	}
+	if request.PeerID == reg.peerID {
+		return zero, nil, fmt.Errorf("connection from ourselves")
+	}
+
+	if _, err := conn.Write(newHandshake(request.InfoHash, reg.peerID).serialize()); err != nil {
+		return zero, nil, fmt.Errorf("cannot send handshake: %v", err)
+	}
+
+	addr, ok := conn.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		return zero, nil, fmt.Errorf("not a TCP connection")
+	}
+	c := New(addr.IP, uint16(addr.Port))
+	c.Conn = conn
+	c.PeerID = request.PeerID
+
+	bitfield := reg.bitfield()
+	if err := c.Send(&Message{MessageID: MSG_BITFIELD, Payload: bitfield}); err != nil {
+		return zero, nil, fmt.Errorf("cannot send bitfield: %v", err)
+	}
+	peerBitfield := make(Bitfield, len(bitfield))
+	c.Bitfield = &peerBitfield
+
+	return c, reg, nil
+}
@@ -0,0 +1,99 @@
+package client
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestListener(t *testing.T) {
+	l, err := Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	infoHash := [20]byte{1}
+	ourID := [20]byte{'u', 's'}
+	theirID := [20]byte{'t', 'h', 'e', 'm'}
+	accepted := make(chan Client, 1)
+	l.Register(infoHash, ourID, func() []byte { return []byte{0xa0} }, func(c Client) { accepted <- c })
+
+	// connect sends a handshake to the listener and returns the connection
+	connect := func(t *testing.T, infoHash, peerID [20]byte) net.Conn {
+		t.Helper()
+		conn, err := net.Dial("tcp", l.listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		if _, err := conn.Write(newHandshake(infoHash, peerID).serialize()); err != nil {
+			t.Fatal(err)
+		}
+		return conn
+	}
+
+	t.Run("accepts a known torrent", func(t *testing.T) {
+		conn := connect(t, infoHash, theirID)
+
+		buf := make([]byte, handshakeLength)
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			t.Fatalf("cannot read handshake: %v", err)
+		}
+		response, err := parseHandshake(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if response.InfoHash != infoHash || response.PeerID != ourID {
+			t.Errorf("have: %x, %x, want: %x, %x", response.InfoHash, response.PeerID, infoHash, ourID)
+		}
+
+		bitfield := make([]byte, 6)
+		if _, err := io.ReadFull(conn, bitfield); err != nil {
+			t.Fatalf("cannot read bitfield: %v", err)
+		}
+		if want := []byte{0, 0, 0, 2, byte(MSG_BITFIELD), 0xa0}; !bytes.Equal(bitfield, want) {
+			t.Errorf("have: %x, want: %x", bitfield, want)
+		}
+
+		select {
+		case c := <-accepted:
+			if c.PeerID != theirID || c.Address() != conn.LocalAddr().String() {
+				t.Errorf("have: %x from %s, want: %x from %s", c.PeerID, c.Address(), theirID, conn.LocalAddr())
+			}
+			if c.HasPiece(0) || !c.Choked {
+				t.Error("peer should start out choked and without pieces")
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("peer was not accepted")
+		}
+	})
+
+	tests := []struct {
+		name     string
+		infoHash [20]byte
+		peerID   [20]byte
+	}{
+		{"rejects an unknown torrent", [20]byte{2}, theirID},
+		{"rejects ourselves", infoHash, ourID},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn := connect(t, tt.infoHash, tt.peerID)
+			if n, err := conn.Read(make([]byte, 1)); err != io.EOF {
+				t.Errorf("have: %d bytes, %v, want the connection closed", n, err)
+			}
+		})
+	}
+
+	t.Run("rejects after unregistering", func(t *testing.T) {
+		l.Unregister(infoHash)
+		conn := connect(t, infoHash, theirID)
+		if n, err := conn.Read(make([]byte, 1)); err != io.EOF {
+			t.Errorf("have: %d bytes, %v, want the connection closed", n, err)
+		}
+	})
+}
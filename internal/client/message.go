@@ -2,6 +2,7 @@ package client
 
 import (
 	"encoding/binary"
+	"fmt"
 
 	log "github.com/sirupsen/logrus"
 )
@@ -85,12 +86,32 @@ func (p *Message) FormatRequest(pieceIndex, offset, blockSize int) {
 }
 
 func (p *Message) FormatPiece(pieceIndex, offset int, piece []byte) {
-	p.Payload = make([]byte, 8+len(p.Payload))
+	p.Payload = make([]byte, 8+len(piece))
 	binary.BigEndian.PutUint32(p.Payload[0:4], uint32(pieceIndex))
 	binary.BigEndian.PutUint32(p.Payload[4:8], uint32(offset))
 	copy(p.Payload[8:], piece)
 }
 
+// A Request is a block of a piece, as asked for in request and cancel
+// messages.
+type Request struct {
+	Index  int // Index of the piece
+	Begin  int // Offset of the block within the piece
+	Length int
+}
+
+// ParseRequest returns the block a request or cancel message is about.
+func (p *Message) ParseRequest() (Request, error) {
+	if len(p.Payload) != 12 {
+		return Request{}, fmt.Errorf("invalid %s payload length: %d", p.MessageID, len(p.Payload))
+	}
+	return Request{
+		Index:  int(binary.BigEndian.Uint32(p.Payload[0:4])),
+		Begin:  int(binary.BigEndian.Uint32(p.Payload[4:8])),
+		Length: int(binary.BigEndian.Uint32(p.Payload[8:12])),
+	}, nil
+}
+
 func (p *Message) FormatCancel(pieceIndex, offset, blockSize int) {
 	p.Payload = make([]byte, 12)
 	binary.BigEndian.PutUint32(p.Payload[0:4], uint32(pieceIndex))
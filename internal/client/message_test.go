@@ -0,0 +1,49 @@
+package client
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestFormatPiece(t *testing.T) {
+	msg := Message{MessageID: MSG_PIECE}
+	msg.FormatPiece(1, 0x4000, []byte("block"))
+
+	want := []byte{0, 0, 0, 1, 0, 0, 0x40, 0, 'b', 'l', 'o', 'c', 'k'}
+	if !bytes.Equal(msg.Payload, want) {
+		t.Errorf("have %x, want %x", msg.Payload, want)
+	}
+}
+
+func TestParseRequest(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload []byte
+		want    Request
+		wantErr bool
+	}{
+		{"request", []byte{0, 0, 0, 2, 0, 0, 0x40, 0, 0, 0, 0x40, 0}, Request{Index: 2, Begin: 0x4000, Length: 0x4000}, false},
+		{"short", []byte{0, 0, 0, 2, 0, 0, 0x40, 0}, Request{}, true},
+		{"long", make([]byte, 13), Request{}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg := Message{MessageID: MSG_REQUEST, Payload: tt.payload}
+			have, err := msg.ParseRequest()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("have error %v, want error: %v", err, tt.wantErr)
+			}
+			if have != tt.want {
+				t.Errorf("have %+v, want %+v", have, tt.want)
+			}
+		})
+	}
+
+	// Formatting and parsing a request round-trips
+	msg := Message{MessageID: MSG_REQUEST}
+	msg.FormatRequest(7, 0x8000, 0x2000)
+	if have, err := msg.ParseRequest(); err != nil || have != (Request{Index: 7, Begin: 0x8000, Length: 0x2000}) {
+		t.Errorf("have %+v, %v", have, err)
+	}
+}
@@ -0,0 +1,333 @@
+package download
+
+import (
+	"karlan/torrent/internal/client"
+	"karlan/torrent/internal/torrent"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// DefaultUploadSlots is the number of peers unchoked for their rates, on
+	// top of the optimistic unchoke
+	DefaultUploadSlots = 3
+
+	// How often the choker reconsiders which peers to unchoke
+	rechokeInterval = 10 * time.Second
+
+	// The optimistic unchoke moves on every this many rechokes, 30 seconds
+	optimisticRounds = 3
+
+	// A peer that has not sent a block we asked for in this long is
+	// snubbing us
+	snubTimeout = time.Minute
+)
+
+// A Choker decides which peers of a torrent we upload to, using tit-for-tat.
+// Every 10 seconds it unchokes the interested peers that uploaded to us the
+// fastest, or that we uploaded to the fastest once we are seeding. On top of
+// those, an optimistic unchoke moves from peer to peer every 30 seconds, so
+// that new peers get to show what they upload. Peers that snub us, by leaving
+// our requests unanswered for a minute, are only unchoked optimistically.
+type Choker struct {
+	torrent *torrent.Torrent
+	slots   int
+
+	mutex      sync.Mutex
+	peers      []*peerState // In the order they connected
+	optimistic *peerState
+	round      int
+	lastRound  time.Time
+
+	stop chan struct{}
+	done chan struct{}
+	now  func() time.Time
+}
+
+// peerState is what the choker knows of a peer.
+type peerState struct {
+	cl         *client.Client
+	choked     bool      // Whether we choke the peer
+	interested bool      // Whether the peer wants pieces from us
+	waiting    time.Time // Since when we wait for a block from the peer; zero if we do not
+	downloaded int64     // Bytes received from the peer this round
+	uploaded   int64     // Bytes sent to the peer this round
+	downRate   float64   // Bytes per second received from the peer last round
+	upRate     float64   // Bytes per second sent to the peer last round
+
+	requests []client.Request // Blocks the peer asked for and has yet to receive, in order
+	wake     chan struct{}    // Wakes the peer's uploader; nil until it runs
+	removed  chan struct{}    // Closed once the peer is removed
+}
+
+// A chokeChange is a choke or unchoke message to send.
+type chokeChange struct {
+	cl    *client.Client
+	choke bool
+}
+
+// NewChoker returns a Choker that unchokes up to slots peers of the torrent
+// for their rates, and one more optimistically.
+func NewChoker(t *torrent.Torrent, slots int) *Choker {
+	return &Choker{
+		torrent: t,
+		slots:   max(slots, 0),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+		now:     time.Now,
+	}
+}
+
+// Start rechokes in the background until Stop is called.
+func (ch *Choker) Start() {
+	ch.mutex.Lock()
+	ch.lastRound = ch.now()
+	ch.mutex.Unlock()
+	go ch.run()
+}
+
+// Stop stops rechoking. Peers keep their current choke state.
+func (ch *Choker) Stop() {
+	close(ch.stop)
+	<-ch.done
+}
+
+func (ch *Choker) run() {
+	defer close(ch.done)
+
+	ticker := time.NewTicker(rechokeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			send(ch.rechoke())
+		case <-ch.stop:
+			return
+		}
+	}
+}
+
+// rechoke works out which peers to unchoke for the round starting now, and
+// returns the messages that tell the peers.
+func (ch *Choker) rechoke() []chokeChange {
+	ch.mutex.Lock()
+	defer ch.mutex.Unlock()
+
+	now := ch.now()
+	elapsed := now.Sub(ch.lastRound).Seconds()
+	ch.lastRound = now
+	for _, p := range ch.peers {
+		if elapsed > 0 {
+			p.downRate = float64(p.downloaded) / elapsed
+			p.upRate = float64(p.uploaded) / elapsed
+		}
+		p.downloaded, p.uploaded = 0, 0
+	}
+
+	// While downloading, peers are ranked by what they give us. Once seeding,
+	// they are ranked by how fast they take, to spread the torrent quickly.
+	seeding := ch.seeding()
+	var candidates []*peerState
+	for _, p := range ch.peers {
+		if p.interested && (seeding || !ch.snubbing(p, now)) {
+			candidates = append(candidates, p)
+		}
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		if seeding {
+			return candidates[i].upRate > candidates[j].upRate
+		}
+		return candidates[i].downRate > candidates[j].downRate
+	})
+
+	unchoke := make(map[*peerState]bool)
+	for _, p := range candidates[:min(ch.slots, len(candidates))] {
+		unchoke[p] = true
+	}
+
+	// The optimistic unchoke moves on every 30 seconds, and earlier if it
+	// lost interest or earned a regular slot
+	opt := ch.optimistic
+	if ch.round%optimisticRounds == 0 || opt == nil || !opt.interested || unchoke[opt] {
+		ch.optimistic = ch.nextOptimistic(unchoke)
+	}
+	ch.round++
+	if ch.optimistic != nil {
+		unchoke[ch.optimistic] = true
+	}
+
+	var changes []chokeChange
+	for _, p := range ch.peers {
+		if choke := !unchoke[p]; choke != p.choked {
+			p.choked = choke
+			if choke {
+				p.requests = nil
+			}
+			changes = append(changes, chokeChange{p.cl, choke})
+		}
+	}
+	log.Debugf("Rechoked %d peers: %d unchoked, %d changed", len(ch.peers), len(unchoke), len(changes))
+	return changes
+}
+
+// nextOptimistic returns the interested peer after the current optimistic
+// unchoke, in connection order, that is not unchoked already.
+func (ch *Choker) nextOptimistic(unchoke map[*peerState]bool) *peerState {
+	start := slices.Index(ch.peers, ch.optimistic) + 1
+	for i := range ch.peers {
+		p := ch.peers[(start+i)%len(ch.peers)]
+		if p.interested && !unchoke[p] {
+			return p
+		}
+	}
+	return nil
+}
+
+func (ch *Choker) snubbing(p *peerState, now time.Time) bool {
+	return !p.waiting.IsZero() && now.Sub(p.waiting) >= snubTimeout
+}
+
+func (ch *Choker) seeding() bool {
+	_, _, left := ch.torrent.Stats()
+	return left == 0
+}
+
+// unchoked returns the number of peers we do not choke.
+func (ch *Choker) unchoked() int {
+	n := 0
+	for _, p := range ch.peers {
+		if !p.choked {
+			n++
+		}
+	}
+	return n
+}
+
+func (ch *Choker) find(cl *client.Client) *peerState {
+	i := slices.IndexFunc(ch.peers, func(p *peerState) bool { return p.cl == cl })
+	if i < 0 {
+		return nil
+	}
+	return ch.peers[i]
+}
+
+// send tells peers about changes in their choke state. It is called without
+// the mutex held, as sending may block.
+func send(changes []chokeChange) {
+	for _, c := range changes {
+		if c.choke {
+			c.cl.SendChoke()
+		} else {
+			c.cl.SendUnchoke()
+		}
+	}
+}
+
+// The methods below are called by the goroutine that owns the connection of
+// a peer. A nil Choker uploads nothing, and chokes every peer.
+
+// add starts choking a peer, which starts out choked.
+func (ch *Choker) add(cl *client.Client) {
+	if ch == nil {
+		return
+	}
+	ch.mutex.Lock()
+	defer ch.mutex.Unlock()
+	ch.peers = append(ch.peers, &peerState{cl: cl, choked: true, removed: make(chan struct{})})
+}
+
+// remove forgets a peer that disconnected.
+func (ch *Choker) remove(cl *client.Client) {
+	if ch == nil {
+		return
+	}
+	ch.mutex.Lock()
+	defer ch.mutex.Unlock()
+	p := ch.find(cl)
+	if p == nil {
+		return
+	}
+	if ch.optimistic == p {
+		ch.optimistic = nil
+	}
+	close(p.removed)
+	ch.peers = slices.DeleteFunc(ch.peers, func(q *peerState) bool { return q == p })
+}
+
+// setInterested records whether a peer wants pieces from us. A newly
+// interested peer is unchoked right away while there are free slots, rather
+// than at the next rechoke.
+func (ch *Choker) setInterested(cl *client.Client, interested bool) {
+	if ch == nil {
+		return
+	}
+	ch.mutex.Lock()
+	p := ch.find(cl)
+	if p == nil {
+		ch.mutex.Unlock()
+		return
+	}
+	p.interested = interested
+	unchoke := interested && p.choked && ch.unchoked() < ch.slots+1 && hasAnyPiece(ch.torrent)
+	if unchoke {
+		p.choked = false
+	}
+	ch.mutex.Unlock()
+
+	if unchoke {
+		cl.SendUnchoke()
+	}
+}
+
+// choking returns whether we choke a peer.
+func (ch *Choker) choking(cl *client.Client) bool {
+	if ch == nil {
+		return true
+	}
+	ch.mutex.Lock()
+	defer ch.mutex.Unlock()
+	p := ch.find(cl)
+	return p == nil || p.choked
+}
+
+// requested records that we asked a peer for a block, and starts the snubbing
+// clock unless we already wait for one.
+func (ch *Choker) requested(cl *client.Client) {
+	if ch == nil {
+		return
+	}
+	ch.mutex.Lock()
+	defer ch.mutex.Unlock()
+	if p := ch.find(cl); p != nil && p.waiting.IsZero() {
+		p.waiting = ch.now()
+	}
+}
+
+// received records a block of n bytes from a peer.
+func (ch *Choker) received(cl *client.Client, n int) {
+	if ch == nil {
+		return
+	}
+	ch.mutex.Lock()
+	defer ch.mutex.Unlock()
+	if p := ch.find(cl); p != nil {
+		p.downloaded += int64(n)
+		p.waiting = time.Time{}
+	}
+}
+
+// sent records a block of n bytes sent to a peer.
+func (ch *Choker) sent(cl *client.Client, n int) {
+	if ch == nil {
+		return
+	}
+	ch.mutex.Lock()
+	defer ch.mutex.Unlock()
+	if p := ch.find(cl); p != nil {
+		p.uploaded += int64(n)
+	}
+}
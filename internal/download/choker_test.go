@@ -0,0 +1,156 @@
+package download
+
+import (
+	"karlan/torrent/internal/client"
+	"maps"
+	"net"
+	"slices"
+	"testing"
+	"time"
+)
+
+// testChoker returns a choker of count interested peers on a fake clock,
+// with the first round started.
+func testChoker(ch *Choker, count int) ([]*client.Client, *time.Time) {
+	now := time.Unix(1700000000, 0)
+	ch.now = func() time.Time { return now }
+	ch.lastRound = now
+
+	peers := make([]*client.Client, count)
+	for i := range peers {
+		c := client.New(net.IPv4(10, 0, 0, byte(i)), 6881)
+		peers[i] = &c
+		ch.add(peers[i])
+		ch.find(peers[i]).interested = true
+	}
+	return peers, &now
+}
+
+// unchokedPeers returns the indexes of the peers the choker does not choke.
+func unchokedPeers(ch *Choker, peers []*client.Client) map[int]bool {
+	unchoked := make(map[int]bool)
+	for i, c := range peers {
+		if !ch.choking(c) {
+			unchoked[i] = true
+		}
+	}
+	return unchoked
+}
+
+func TestChoker(t *testing.T) {
+	data := make([]byte, 40000)
+	leeching, _ := createTorrent(t, data)
+	seeding := seedingTorrent(t, data)
+
+	tests := []struct {
+		name   string
+		seed   bool
+		setup  func(ch *Choker, peers []*client.Client, now time.Time)
+		want   map[int]bool
+		wantOp int // Index of the optimistic unchoke
+	}{
+		{
+			name: "unchokes the fastest uploaders to us",
+			setup: func(ch *Choker, peers []*client.Client, now time.Time) {
+				ch.received(peers[1], 1000)
+				ch.received(peers[3], 3000)
+				ch.received(peers[4], 2000)
+				ch.sent(peers[0], 9000)
+			},
+			want:   map[int]bool{3: true, 4: true, 0: true},
+			wantOp: 0,
+		},
+		{
+			name: "unchokes the fastest downloaders from us when seeding",
+			seed: true,
+			setup: func(ch *Choker, peers []*client.Client, now time.Time) {
+				ch.sent(peers[2], 1000)
+				ch.sent(peers[4], 3000)
+				ch.received(peers[0], 9000)
+			},
+			want:   map[int]bool{4: true, 2: true, 0: true},
+			wantOp: 0,
+		},
+		{
+			name: "leaves out uninterested peers",
+			setup: func(ch *Choker, peers []*client.Client, now time.Time) {
+				ch.received(peers[3], 3000)
+				ch.find(peers[3]).interested = false
+				ch.find(peers[0]).interested = false
+				ch.received(peers[2], 1000)
+			},
+			want:   map[int]bool{2: true, 1: true, 4: true},
+			wantOp: 4,
+		},
+		{
+			name: "only unchokes snubbing peers optimistically",
+			setup: func(ch *Choker, peers []*client.Client, now time.Time) {
+				ch.received(peers[0], 5000)
+				ch.received(peers[1], 4000)
+				ch.received(peers[2], 3000)
+				ch.find(peers[0]).waiting = now.Add(-snubTimeout)
+				ch.find(peers[1]).waiting = now.Add(-snubTimeout / 2)
+			},
+			want:   map[int]bool{1: true, 2: true, 0: true},
+			wantOp: 0,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tr := leeching
+			if tt.seed {
+				tr = seeding
+			}
+			ch := NewChoker(tr, 2)
+			peers, now := testChoker(ch, 5)
+			tt.setup(ch, peers, *now)
+
+			*now = now.Add(rechokeInterval)
+			changes := ch.rechoke()
+			if have := unchokedPeers(ch, peers); !maps.Equal(have, tt.want) {
+				t.Errorf("have %v unchoked, want %v", have, tt.want)
+			}
+			if ch.optimistic == nil || ch.optimistic.cl != peers[tt.wantOp] {
+				t.Errorf("want peer %d unchoked optimistically", tt.wantOp)
+			}
+			if len(changes) != len(tt.want) {
+				t.Errorf("have %d changes, want %d", len(changes), len(tt.want))
+			}
+		})
+	}
+}
+
+func TestChokerOptimisticRotation(t *testing.T) {
+	tr, _ := createTorrent(t, make([]byte, 40000))
+	ch := NewChoker(tr, 1)
+	peers, now := testChoker(ch, 4)
+
+	// Peer 0 keeps the regular slot, while the optimistic unchoke moves on
+	// every 30 seconds
+	var optimistic []int
+	for round := 0; round < 7; round++ {
+		ch.received(peers[0], 1000)
+		*now = now.Add(rechokeInterval)
+		ch.rechoke()
+		for i, c := range peers {
+			if ch.optimistic != nil && ch.optimistic.cl == c {
+				optimistic = append(optimistic, i)
+			}
+		}
+	}
+	if want := []int{1, 1, 1, 2, 2, 2, 3}; !slices.Equal(optimistic, want) {
+		t.Fatalf("have %v, want %v", optimistic, want)
+	}
+
+	// A peer that disconnects gives up its optimistic unchoke
+	ch.remove(peers[3])
+	*now = now.Add(rechokeInterval)
+	ch.rechoke()
+	if ch.optimistic == nil || ch.optimistic.cl != peers[1] {
+		t.Errorf("want peer 1 unchoked optimistically after peer 3 left")
+	}
+	if have, want := unchokedPeers(ch, peers), map[int]bool{0: true, 1: true}; !maps.Equal(have, want) {
+		t.Errorf("have %v unchoked, want %v", have, want)
+	}
+}
@@ -7,7 +7,6 @@ import (
 	"karlan/torrent/internal/client"
 	"karlan/torrent/internal/queue"
 	"karlan/torrent/internal/torrent"
-	"sync"
 
 	log "github.com/sirupsen/logrus"
 )
@@ -31,10 +30,14 @@ func (p *PieceProgress) validatePiece() error {
 
 const BLOCK_SIZE int = 16 * 1024
 
-func DownloadFile(cl *client.Client, t *torrent.Torrent, q *queue.Queue, wg *sync.WaitGroup) {
+// DownloadFile downloads pieces of t from the queue until it is empty,
+// meanwhile uploading to the peer as the choker allows.
+func DownloadFile(cl *client.Client, t *torrent.Torrent, q *queue.Queue, ch *Choker) {
 	defer cl.Conn.Close()
-	defer wg.Done()
+	ch.add(cl)
+	defer ch.remove(cl)
 
+	misses := 0 // Pieces in a row the peer does not have
 	for !q.IsEmpty() {
 		pieceIndex, err := q.Dequeue()
 		if err != nil {
@@ -46,10 +49,22 @@ func DownloadFile(cl *client.Client, t *torrent.Torrent, q *queue.Queue, wg *syn
 		if !cl.HasPiece(pieceIndex) {
 			log.Debugf("Client does not have piece %d, re-enqueueing", pieceIndex)
 			q.Enqueue(pieceIndex)
+
+			// The peer has none of the pieces left, so wait for it to tell
+			// us about new ones
+			misses++
+			if misses >= q.GetLength() {
+				if _, err := read(cl, ch); err != nil {
+					log.Warnf("Giving up on client %s: %v", cl.Address(), err)
+					return
+				}
+				misses = 0
+			}
 			continue
 		}
+		misses = 0
 
-		pieceProgress, err := DownloadPiece(cl, pieceIndex, t.GetPieceLength(pieceIndex), t.GetPieceHash(pieceIndex))
+		pieceProgress, err := downloadPiece(cl, ch, pieceIndex, t.GetPieceLength(pieceIndex), t.GetPieceHash(pieceIndex))
 		if err != nil {
 			log.Warnf("Failed to download piece %d: %v", pieceIndex, err)
 			q.Enqueue(pieceIndex)
@@ -62,6 +77,12 @@ func DownloadFile(cl *client.Client, t *torrent.Torrent, q *queue.Queue, wg *syn
 }
 
 func DownloadPiece(cl *client.Client, pieceIndex, pieceSize int, pieceHash [20]byte) (PieceProgress, error) {
+	return downloadPiece(cl, nil, pieceIndex, pieceSize, pieceHash)
+}
+
+// downloadPiece downloads a piece, meanwhile serving the requests of the peer
+// as the choker allows. A nil choker serves none.
+func downloadPiece(cl *client.Client, ch *Choker, pieceIndex, pieceSize int, pieceHash [20]byte) (PieceProgress, error) {
 	log.Infof("Starting download of piece: Index=%d, Size=%d", pieceIndex, pieceSize)
 	var zero PieceProgress
 	p := PieceProgress{
@@ -85,11 +106,12 @@ func DownloadPiece(cl *client.Client, pieceIndex, pieceSize int, pieceHash [20]b
 			offset = p.Downloaded
 			log.Debugf("Requesting block: Offset=%d, BlockSize=%d", offset, blockSize)
 			cl.SendRequest(p.Index, offset, blockSize)
+			ch.requested(cl)
 		} else {
 			log.Debug("Client is choked, waiting for unchoke message")
 		}
 
-		data, err := read(cl)
+		data, err := read(cl, ch)
 		if err != nil {
 			log.Errorf("Error reading data: %v", err)
 			return zero, err
@@ -118,7 +140,10 @@ func DownloadPiece(cl *client.Client, pieceIndex, pieceSize int, pieceHash [20]b
 	return p, nil
 }
 
-func read(cl *client.Client) ([]byte, error) {
+// read reads a message from the peer and handles it, returning the block of a
+// piece message. The peer's requests are queued for upload as the choker
+// allows.
+func read(cl *client.Client, ch *Choker) ([]byte, error) {
 	if cl == nil {
 		panic("Client is nil")
 	}
@@ -146,31 +171,46 @@ func read(cl *client.Client) ([]byte, error) {
 
 	case client.MSG_INTERESTED:
 		log.Debug("Received Interested message")
+		ch.setInterested(cl, true)
 
 	case client.MSG_NOT_INTERESTED:
 		log.Debug("Received Not Interested message")
+		ch.setInterested(cl, false)
 
 	case client.MSG_HAVE:
 		log.Debug("Received Have message")
-		cl.AddPiece(msg)
+		if err := cl.AddPiece(msg); err != nil {
+			return nil, err
+		}
 
 	case client.MSG_BITFIELD:
 		log.Debug("Received Bitfield message")
+		bitfield := client.Bitfield(msg.Payload)
+		cl.Bitfield = &bitfield
 
 	case client.MSG_REQUEST:
 		log.Debug("Received Request message")
+		if err := queueRequest(cl, ch, msg); err != nil {
+			return nil, err
+		}
 
 	case client.MSG_PIECE:
 		log.Debug("Received Piece message")
+		if len(msg.Payload) < 8 {
+			return nil, fmt.Errorf("invalid piece payload length: %d", len(msg.Payload))
+		}
+		ch.received(cl, len(msg.Payload)-8)
 		return msg.Payload[8:], nil
 
 	case client.MSG_CANCEL:
 		log.Debug("Received Cancel message")
+		if err := cancelRequest(cl, ch, msg); err != nil {
+			return nil, err
+		}
 
 	default:
 		log.Warnf("Received unknown message ID: %d", msg.MessageID)
 		return nil, fmt.Errorf("received unknown message")
 	}
-
 	return nil, nil
 }
@@ -0,0 +1,111 @@
+package download
+
+import (
+	"karlan/torrent/internal/client"
+	"karlan/torrent/internal/queue"
+	"karlan/torrent/internal/torrent"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// A Swarm downloads a torrent from a set of peers that can grow while the
+// download runs, as trackers hand out new ones. Running out of peers does not
+// end the download, which waits for the next ones.
+type Swarm struct {
+	torrent *torrent.Torrent
+	queue   *queue.Queue
+	choker  *Choker
+
+	mutex  sync.Mutex
+	idle   *sync.Cond // Signalled when a peer is done, and on Stop
+	active int
+	seen   map[string]bool
+	closed bool
+}
+
+// NewSwarm returns a Swarm that downloads the pieces of the queue, uploading
+// to peers as the choker allows.
+func NewSwarm(t *torrent.Torrent, q *queue.Queue, ch *Choker) *Swarm {
+	s := &Swarm{torrent: t, queue: q, choker: ch, seen: make(map[string]bool)}
+	s.idle = sync.NewCond(&s.mutex)
+	return s
+}
+
+// AddPeers connects to the peers that are new to the swarm and downloads from
+// them in the background. Peers are ignored once the swarm is done.
+func (s *Swarm) AddPeers(peers []client.Client) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for _, c := range peers {
+		if s.closed || s.torrent.FinishedDownloading() {
+			return
+		}
+		if s.seen[c.Address()] {
+			continue
+		}
+		s.seen[c.Address()] = true
+		s.active++
+
+		go func(c client.Client) {
+			defer s.peerDone(c.Address())
+			log.Infof("Initiating connection with client %s", c.Address())
+			if err := c.Init(s.torrent.InfoHash, s.torrent.PeerID); err != nil {
+				log.Warnf("Error initializing client: %s, Error: %v", c.Address(), err)
+				return
+			}
+			log.Infof("Downloading file %v from client %s", s.torrent.GetName(), c.Address())
+			DownloadFile(&c, s.torrent, s.queue, s.choker)
+		}(c)
+	}
+}
+
+// AcceptPeer downloads in the background from a peer that connected to us.
+// The connection is closed if the swarm is done.
+func (s *Swarm) AcceptPeer(c client.Client) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.closed || s.torrent.FinishedDownloading() {
+		c.Conn.Close()
+		return
+	}
+	s.seen[c.Address()] = true
+	s.active++
+
+	go func() {
+		defer s.peerDone(c.Address())
+		log.Infof("Downloading file %v from client %s", s.torrent.GetName(), c.Address())
+		DownloadFile(&c, s.torrent, s.queue, s.choker)
+	}()
+}
+
+// peerDone forgets a peer that is done, so that trackers handing it out again
+// give it another try.
+func (s *Swarm) peerDone(address string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.active--
+	delete(s.seen, address)
+	s.idle.Broadcast()
+}
+
+// Wait blocks until the torrent is downloaded or Stop is called, and then
+// closes the swarm to new peers. Peers still connected are left running.
+func (s *Swarm) Wait() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for !s.closed && !s.torrent.FinishedDownloading() {
+		s.idle.Wait()
+	}
+	s.closed = true
+}
+
+// Stop gives up on the download, making Wait return.
+func (s *Swarm) Stop() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.closed = true
+	s.idle.Broadcast()
+}
@@ -0,0 +1,55 @@
+package download
+
+import (
+	"karlan/torrent/internal/queue"
+	"testing"
+	"time"
+)
+
+func TestSwarmWait(t *testing.T) {
+	data := make([]byte, 40000)
+
+	// waitDone returns a channel that is closed when Wait returns
+	waitDone := func(s *Swarm) chan struct{} {
+		done := make(chan struct{})
+		go func() {
+			s.Wait()
+			close(done)
+		}()
+		return done
+	}
+
+	t.Run("waits for peers until stopped", func(t *testing.T) {
+		tr, _ := createTorrent(t, data)
+		s := NewSwarm(tr, queue.NewQueue(tr.GetNumberOfPieces()), nil)
+		done := waitDone(s)
+
+		// Without peers, the download waits for the trackers to hand out some
+		select {
+		case <-done:
+			t.Fatal("Wait returned without peers or pieces")
+		case <-time.After(50 * time.Millisecond):
+		}
+
+		s.Stop()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("Wait did not return after Stop")
+		}
+	})
+
+	t.Run("returns once downloaded", func(t *testing.T) {
+		tr, _ := createTorrent(t, data)
+		for i := 0; i < tr.GetNumberOfPieces(); i++ {
+			start := i * 16 * 1024
+			tr.AddPiece(data[start:min(start+16*1024, len(data))], i)
+		}
+		s := NewSwarm(tr, queue.NewQueue(0), nil)
+		select {
+		case <-waitDone(s):
+		case <-time.After(5 * time.Second):
+			t.Fatal("Wait did not return for a downloaded torrent")
+		}
+	})
+}
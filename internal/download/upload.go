@@ -0,0 +1,151 @@
+package download
+
+import (
+	"fmt"
+	"karlan/torrent/internal/client"
+	"karlan/torrent/internal/torrent"
+	"slices"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Requests a peer may have waiting; further ones are dropped
+const maxQueuedRequests = 256
+
+// Seed serves the block requests of a peer until it disconnects, as the
+// choker allows.
+func Seed(cl *client.Client, ch *Choker) {
+	defer cl.Conn.Close()
+	ch.add(cl)
+	defer ch.remove(cl)
+
+	log.Infof("Seeding %v to client %s", ch.torrent.GetName(), cl.Address())
+	for {
+		if _, err := read(cl, ch); err != nil {
+			log.Infof("Stopped seeding to client %s: %v", cl.Address(), err)
+			return
+		}
+	}
+}
+
+func hasAnyPiece(t *torrent.Torrent) bool {
+	for _, b := range t.Bitfield() {
+		if b != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// queueRequest adds a block the peer asked for to its queue, and starts the
+// peer's uploader if it is not running yet. Requests made while we choke the
+// peer are dropped, as it has to ask again once unchoked.
+func queueRequest(cl *client.Client, ch *Choker, msg *client.Message) error {
+	req, err := msg.ParseRequest()
+	if err != nil {
+		return err
+	}
+	if ch == nil {
+		log.Debugf("Dropping request of client %s, as we do not upload: %+v", cl.Address(), req)
+		return nil
+	}
+
+	ch.mutex.Lock()
+	defer ch.mutex.Unlock()
+	p := ch.find(cl)
+	switch {
+	case p == nil || p.choked:
+		log.Debugf("Dropping request of choked client %s: %+v", cl.Address(), req)
+		return nil
+	case len(p.requests) >= maxQueuedRequests:
+		log.Warnf("Dropping request of client %s, which has %d waiting: %+v", cl.Address(), len(p.requests), req)
+		return nil
+	}
+	p.requests = append(p.requests, req)
+
+	if p.wake == nil {
+		p.wake = make(chan struct{}, 1)
+		go ch.upload(p)
+	}
+	select {
+	case p.wake <- struct{}{}:
+	default: // The uploader is woken already
+	}
+	return nil
+}
+
+// cancelRequest removes a block the peer no longer wants from its queue. A
+// block that is being sent already cannot be taken back.
+func cancelRequest(cl *client.Client, ch *Choker, msg *client.Message) error {
+	req, err := msg.ParseRequest()
+	if err != nil {
+		return err
+	}
+	if ch == nil {
+		return nil
+	}
+
+	ch.mutex.Lock()
+	defer ch.mutex.Unlock()
+	if p := ch.find(cl); p != nil {
+		p.requests = slices.DeleteFunc(p.requests, func(r client.Request) bool { return r == req })
+	}
+	return nil
+}
+
+// upload sends a peer the blocks it asked for, in order, until the peer is
+// removed. It runs in a goroutine of its own, so that requests wait in the
+// queue while earlier blocks are sent, and a cancel can still remove them. A
+// request for anything but a block of a piece we have closes the connection.
+func (ch *Choker) upload(p *peerState) {
+	for {
+		select {
+		case <-p.wake:
+		case <-p.removed:
+			return
+		}
+
+		for {
+			req, ok := ch.nextRequest(p)
+			if !ok {
+				break
+			}
+			if err := ch.serveRequest(p.cl, req); err != nil {
+				log.Warnf("Disconnecting client %s: %v", p.cl.Address(), err)
+				p.cl.Conn.Close()
+				return
+			}
+		}
+	}
+}
+
+// nextRequest takes the next request off the queue of a peer. The queue of a
+// choked peer is dropped, as it has to ask again when unchoked.
+func (ch *Choker) nextRequest(p *peerState) (client.Request, bool) {
+	ch.mutex.Lock()
+	defer ch.mutex.Unlock()
+	if p.choked && len(p.requests) > 0 {
+		log.Debugf("Dropping %d requests of choked client %s", len(p.requests), p.cl.Address())
+		p.requests = nil
+	}
+	if len(p.requests) == 0 {
+		return client.Request{}, false
+	}
+	req := p.requests[0]
+	p.requests = p.requests[1:]
+	return req, true
+}
+
+func (ch *Choker) serveRequest(cl *client.Client, req client.Request) error {
+	t := ch.torrent
+	block, err := t.ReadBlock(req.Index, req.Begin, req.Length)
+	if err != nil {
+		return fmt.Errorf("cannot serve request: %v", err)
+	}
+	if err := cl.SendPiece(req.Index, req.Begin, block); err != nil {
+		return err
+	}
+	t.AddUploaded(len(block))
+	ch.sent(cl, len(block))
+	return nil
+}
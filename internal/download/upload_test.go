@@ -0,0 +1,143 @@
+package download
+
+import (
+	"bytes"
+	"karlan/torrent/internal/client"
+	"karlan/torrent/internal/torrent"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// seedingTorrent returns a torrent of a single file holding data, with its
+// content verified so that every piece can be uploaded.
+func seedingTorrent(t *testing.T, data []byte) *torrent.Torrent {
+	t.Helper()
+	tr, contentPath := createTorrent(t, data)
+	if _, err := tr.VerifyContent(contentPath); err != nil {
+		t.Fatal(err)
+	}
+	return tr
+}
+
+// createTorrent returns a torrent of a single file holding data, with none of
+// its pieces yet, and the path of the file.
+func createTorrent(t *testing.T, data []byte) (*torrent.Torrent, string) {
+	t.Helper()
+	dir := t.TempDir()
+	contentPath := filepath.Join(dir, "content.bin")
+	if err := os.WriteFile(contentPath, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	opts := torrent.CreateOptions{Announce: "http://a.example/announce", PieceLength: 16 * 1024}
+	if _, err := torrent.Create(&out, contentPath, opts); err != nil {
+		t.Fatal(err)
+	}
+	torrentPath := filepath.Join(dir, "content.torrent")
+	if err := os.WriteFile(torrentPath, out.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	tr, err := torrent.Load(torrentPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tr, contentPath
+}
+
+func TestSeed(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789abcdef"), 2000)
+	tr := seedingTorrent(t, data)
+
+	ours, theirs := net.Pipe()
+	seeder := client.New(net.IPv4(127, 0, 0, 1), 6881)
+	seeder.Conn = ours
+	done := make(chan struct{})
+	go func() {
+		Seed(&seeder, NewChoker(tr, DefaultUploadSlots))
+		close(done)
+	}()
+
+	peer := client.New(net.IPv4(127, 0, 0, 1), 6882)
+	peer.Conn = theirs
+	theirs.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// A request before we are unchoked is dropped
+	peer.SendRequest(0, 0, 16)
+	peer.SendInterested()
+	msg, err := peer.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.MessageID != client.MSG_UNCHOKE {
+		t.Fatalf("have %v, want %v", msg.MessageID, client.MSG_UNCHOKE)
+	}
+
+	peer.SendRequest(1, 100, 50)
+	msg, err = peer.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := append([]byte{0, 0, 0, 1, 0, 0, 0, 100}, data[16*1024+100:16*1024+150]...)
+	if msg.MessageID != client.MSG_PIECE || !bytes.Equal(msg.Payload, want) {
+		t.Fatalf("have %v %x, want %v %x", msg.MessageID, msg.Payload, client.MSG_PIECE, want)
+	}
+
+	// A request past the end of the torrent disconnects the peer
+	peer.SendRequest(tr.GetNumberOfPieces(), 0, 16)
+	if _, err := peer.Read(); err == nil {
+		t.Error("expected the connection to be closed")
+	}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("seeding did not stop")
+	}
+	if uploaded, _, _ := tr.Stats(); uploaded != 50 {
+		t.Errorf("have %d bytes uploaded, want 50", uploaded)
+	}
+}
+
+func TestSeedCancel(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789abcdef"), 2000)
+	tr := seedingTorrent(t, data)
+
+	ours, theirs := net.Pipe()
+	defer theirs.Close()
+	seeder := client.New(net.IPv4(127, 0, 0, 1), 6881)
+	seeder.Conn = ours
+	go Seed(&seeder, NewChoker(tr, DefaultUploadSlots))
+
+	peer := client.New(net.IPv4(127, 0, 0, 1), 6882)
+	peer.Conn = theirs
+	theirs.SetDeadline(time.Now().Add(5 * time.Second))
+
+	peer.SendInterested()
+	if msg, err := peer.Read(); err != nil || msg.MessageID != client.MSG_UNCHOKE {
+		t.Fatalf("have %v, %v, want %v", msg, err, client.MSG_UNCHOKE)
+	}
+
+	// The first block is held up in the pipe until we read it, so the second
+	// one waits in the queue when it is cancelled. The third request is only
+	// read once the cancel has been handled.
+	peer.SendRequest(0, 0, 16)
+	peer.SendRequest(0, 16, 16)
+	cancel := client.Message{MessageID: client.MSG_CANCEL}
+	cancel.FormatRequest(0, 16, 16)
+	peer.Send(&cancel)
+	peer.SendRequest(0, 32, 16)
+
+	for _, begin := range []int{0, 32} {
+		msg, err := peer.Read()
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := append([]byte{0, 0, 0, 0, 0, 0, 0, byte(begin)}, data[begin:begin+16]...)
+		if msg.MessageID != client.MSG_PIECE || !bytes.Equal(msg.Payload, want) {
+			t.Fatalf("have %v %x, want %v %x", msg.MessageID, msg.Payload, client.MSG_PIECE, want)
+		}
+	}
+}
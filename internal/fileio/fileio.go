@@ -1,8 +1,10 @@
 package fileio
 
 import (
+	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
 
 	log "github.com/sirupsen/logrus"
 )
@@ -55,3 +57,61 @@ func WriteToAbsolutePath(filePath string, data []byte) {
 		log.Fatal(err)
 	}
 }
+
+// CreateFile creates the file at filePath, along with any missing
+// directories, and sets its size, truncating or extending it as needed.
+func CreateFile(filePath string, size int64) error {
+	filePath = filepath.Clean(filePath)
+	if err := os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(filePath, os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if err := file.Truncate(size); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// WriteAt writes data to the existing file at filePath, starting at offset.
+func WriteAt(filePath string, offset int64, data []byte) error {
+	file, err := os.OpenFile(filepath.Clean(filePath), os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	if _, err := file.WriteAt(data, offset); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// JoinUnder joins path components onto root and makes sure the result lies
+// within root, so that paths taken from a torrent cannot be used to write
+// elsewhere. Components must be plain names: no separators, no "." or "..",
+// and none may be an existing symbolic link, which could lead outside root.
+func JoinUnder(root string, elem ...string) (string, error) {
+	root = filepath.Clean(root)
+	path := root
+	for _, e := range elem {
+		if e == "" || e == "." || e == ".." || strings.ContainsAny(e, `/\`) || filepath.IsAbs(e) || filepath.VolumeName(e) != "" {
+			return "", fmt.Errorf("unsafe path component %q", e)
+		}
+		path = filepath.Join(path, e)
+
+		info, err := os.Lstat(path)
+		if err == nil && info.Mode()&os.ModeSymlink != 0 {
+			return "", fmt.Errorf("%s is a symbolic link", path)
+		}
+	}
+
+	rel, err := filepath.Rel(root, path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("%s is outside of %s", path, root)
+	}
+	return path, nil
+}
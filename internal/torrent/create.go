@@ -0,0 +1,284 @@
+package torrent
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"io/fs"
+	"karlan/torrent/internal/bencode"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Piece lengths are powers of two between the size of a block requested from
+// peers and 16 MiB. When none is given, the smallest one that keeps the number
+// of pieces under targetPieces is chosen.
+const (
+	MinPieceLength = 16 * 1024
+	MaxPieceLength = 16 * 1024 * 1024
+	targetPieces   = 1500
+)
+
+// CreateOptions describes the torrent written by Create. Only Announce or
+// AnnounceList is required.
+type CreateOptions struct {
+	Announce     string     // Primary tracker; defaults to the first tracker of AnnounceList
+	AnnounceList [][]string // Tiers of trackers (BEP 12)
+	Comment      string
+	CreatedBy    string
+	CreationDate time.Time // Left out if zero
+	Private      bool      // Restrict peers to those handed out by the trackers (BEP 27)
+	WebSeeds     []string  // HTTP/FTP seeds (BEP 19)
+	PieceLength  int       // Chosen from the total length if zero
+	Workers      int       // Number of pieces hashed in parallel; defaults to the number of CPUs
+	Exclude      []string  // Files left out, such as the torrent being written into the directory
+}
+
+// Create builds a torrent for the file or directory at root and writes it,
+// bencoded, to w. A directory becomes a multi-file torrent holding every
+// regular file below it, in lexical order. It returns the info hash of the
+// new torrent.
+func Create(w io.Writer, root string, opts CreateOptions) ([20]byte, error) {
+	var zero [20]byte
+
+	announce := opts.Announce
+	if announce == "" && len(opts.AnnounceList) > 0 && len(opts.AnnounceList[0]) > 0 {
+		announce = opts.AnnounceList[0][0]
+	}
+	if announce == "" {
+		return zero, fmt.Errorf("no tracker given")
+	}
+
+	info, paths, err := collectFiles(root, opts.Exclude)
+	if err != nil {
+		return zero, err
+	}
+	var totalLength int64
+	for _, file := range info.Files {
+		totalLength += file.Length
+	}
+	if info.Files == nil {
+		totalLength = info.Length
+	}
+	if totalLength == 0 {
+		return zero, fmt.Errorf("%s is empty", root)
+	}
+
+	info.PieceLength = opts.PieceLength
+	if info.PieceLength == 0 {
+		info.PieceLength = choosePieceLength(totalLength)
+	}
+	if info.PieceLength < MinPieceLength || info.PieceLength > MaxPieceLength || info.PieceLength&(info.PieceLength-1) != 0 {
+		return zero, fmt.Errorf("piece length %d is not a power of two between %d and %d", info.PieceLength, MinPieceLength, MaxPieceLength)
+	}
+	if opts.Private {
+		info.Private = 1
+	}
+
+	workers := opts.Workers
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	log.Infof("Hashing %d bytes in pieces of %d bytes", totalLength, info.PieceLength)
+	info.Pieces, err = hashPieces(paths, info, totalLength, workers)
+	if err != nil {
+		return zero, err
+	}
+
+	encodedInfo, err := bencode.Marshal(info)
+	if err != nil {
+		return zero, fmt.Errorf("error encoding info dictionary: %w", err)
+	}
+
+	m := metainfo{
+		Announce:     announce,
+		AnnounceList: opts.AnnounceList,
+		Comment:      opts.Comment,
+		CreatedBy:    opts.CreatedBy,
+		URLList:      opts.WebSeeds,
+		Info:         encodedInfo,
+	}
+	if !opts.CreationDate.IsZero() {
+		m.CreationDate = opts.CreationDate.Unix()
+	}
+
+	if err := bencode.NewEncoder(w).Encode(m); err != nil {
+		return zero, fmt.Errorf("error writing torrent: %w", err)
+	}
+	return hashInfoDictionary(encodedInfo), nil
+}
+
+// collectFiles returns the info dictionary of root without its pieces, and
+// the paths of the files it describes in torrent order, leaving out the files
+// at the exclude paths.
+func collectFiles(root string, exclude []string) (*infoDict, []string, error) {
+	stat, err := os.Stat(root)
+	if err != nil {
+		return nil, nil, err
+	}
+	// The name of "." or "dir/.." is that of the directory it stands for
+	absRoot, err := filepath.Abs(root)
+	if err != nil {
+		return nil, nil, err
+	}
+	excluded := make(map[string]bool, len(exclude))
+	for _, path := range exclude {
+		if abs, err := filepath.Abs(path); err == nil {
+			excluded[abs] = true
+		}
+	}
+
+	info := &infoDict{Name: filepath.Base(absRoot)}
+	if !stat.IsDir() {
+		info.Length = stat.Size()
+		return info, []string{root}, nil
+	}
+
+	var paths []string
+	err = filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if abs, err := filepath.Abs(path); err == nil && excluded[abs] {
+			log.Debugf("Skipping %s, which is excluded", path)
+			return nil
+		}
+		if !entry.Type().IsRegular() {
+			if !entry.IsDir() {
+				log.Debugf("Skipping %s, which is not a regular file", path)
+			}
+			return nil
+		}
+
+		fileStat, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		info.Files = append(info.Files, fileInfo{
+			Length: fileStat.Size(),
+			Path:   strings.Split(filepath.ToSlash(rel), "/"),
+		})
+		paths = append(paths, path)
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(paths) == 0 {
+		return nil, nil, fmt.Errorf("no files in %s", root)
+	}
+	return info, paths, nil
+}
+
+func choosePieceLength(totalLength int64) int {
+	pieceLength := MinPieceLength
+	for pieceLength < MaxPieceLength && totalLength/int64(pieceLength) > targetPieces {
+		pieceLength *= 2
+	}
+	return pieceLength
+}
+
+// piece is a piece of the content waiting to be hashed.
+type piece struct {
+	index int
+	data  []byte
+}
+
+// hashPieces reads the files one after the other, as the single stream of
+// bytes that pieces are cut from, and returns the concatenated SHA-1 hashes
+// of the pieces. Reading is sequential while hashing is spread over workers.
+func hashPieces(paths []string, info *infoDict, totalLength int64, workers int) (string, error) {
+	numPieces := int((totalLength + int64(info.PieceLength) - 1) / int64(info.PieceLength))
+	hashes := make([]byte, numPieces*sha1.Size)
+
+	// Buffers go around in a circle so that at most one per worker, and one
+	// being read into, are in memory at a time
+	pieces := make(chan piece)
+	free := make(chan []byte, workers+1)
+	for i := 0; i < workers+1; i++ {
+		free <- make([]byte, info.PieceLength)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for p := range pieces {
+				hash := sha1.Sum(p.data)
+				copy(hashes[p.index*sha1.Size:], hash[:])
+				free <- p.data[:cap(p.data)]
+			}
+		}()
+	}
+
+	err := readPieces(paths, info, pieces, free)
+	close(pieces)
+	wg.Wait()
+	if err != nil {
+		return "", err
+	}
+	return string(hashes), nil
+}
+
+func readPieces(paths []string, info *infoDict, pieces chan<- piece, free <-chan []byte) error {
+	lengths := []int64{info.Length}
+	if info.Files != nil {
+		lengths = lengths[:0]
+		for _, file := range info.Files {
+			lengths = append(lengths, file.Length)
+		}
+	}
+
+	index := 0
+	buf := <-free
+	n := 0
+	for i, path := range paths {
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+
+		// Read exactly the length recorded in the info dictionary
+		r := io.LimitReader(file, lengths[i])
+		var read int64
+		for {
+			m, err := io.ReadFull(r, buf[n:])
+			n += m
+			read += int64(m)
+			if n == len(buf) {
+				pieces <- piece{index: index, data: buf}
+				index++
+				buf = <-free
+				n = 0
+			}
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				break
+			}
+			if err != nil {
+				file.Close()
+				return err
+			}
+		}
+		file.Close()
+
+		if read != lengths[i] {
+			return fmt.Errorf("%s changed size while hashing", path)
+		}
+	}
+
+	if n > 0 {
+		pieces <- piece{index: index, data: buf[:n]}
+	}
+	return nil
+}
@@ -0,0 +1,178 @@
+package torrent
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"karlan/torrent/internal/bencode"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestCreate(t *testing.T) {
+	dir := t.TempDir()
+	content := map[string][]byte{
+		"a.txt":        bytes.Repeat([]byte("a"), 20000),
+		"sub/b.bin":    bytes.Repeat([]byte{0, 1, 2}, 10000),
+		"sub/c/d.txt":  []byte("straddles"),
+		"sub/empty.go": {},
+	}
+	for name, data := range content {
+		path := filepath.Join(dir, "artifacts", filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var out bytes.Buffer
+	opts := CreateOptions{
+		AnnounceList: [][]string{{"http://a.example/announce"}, {"udp://b.example:6969"}},
+		Comment:      "build 42",
+		CreatedBy:    "mybittorrent",
+		CreationDate: time.Unix(1700000000, 0),
+		Private:      true,
+		WebSeeds:     []string{"https://example.com/artifacts/"},
+		Workers:      3,
+	}
+	infoHash, err := Create(&out, filepath.Join(dir, "artifacts"), opts)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if _, err := bencode.DecodeStrict(out.String()); err != nil {
+		t.Fatalf("torrent is not canonical: %v", err)
+	}
+	var m metainfo
+	if err := bencode.Unmarshal(out.Bytes(), &m); err != nil {
+		t.Fatal(err)
+	}
+	if m.Announce != "http://a.example/announce" || m.Comment != "build 42" || m.CreatedBy != "mybittorrent" || m.CreationDate != 1700000000 {
+		t.Errorf("unexpected metainfo: %+v", m)
+	}
+	if !reflect.DeepEqual(m.AnnounceList, opts.AnnounceList) || !reflect.DeepEqual(m.URLList, opts.WebSeeds) {
+		t.Errorf("unexpected trackers: %v, %v", m.AnnounceList, m.URLList)
+	}
+	if sha1.Sum(m.Info) != infoHash {
+		t.Errorf("returned info hash does not match the info dictionary")
+	}
+
+	var info infoDict
+	if err := bencode.Unmarshal(m.Info, &info); err != nil {
+		t.Fatal(err)
+	}
+	wantFiles := []fileInfo{
+		{Length: 20000, Path: []string{"a.txt"}},
+		{Length: 30000, Path: []string{"sub", "b.bin"}},
+		{Length: 9, Path: []string{"sub", "c", "d.txt"}},
+		{Length: 0, Path: []string{"sub", "empty.go"}},
+	}
+	if info.Name != "artifacts" || info.Private != 1 || info.PieceLength != MinPieceLength || !reflect.DeepEqual(info.Files, wantFiles) {
+		t.Errorf("unexpected info dictionary: %+v", info)
+	}
+
+	// Pieces are cut from the files laid end to end
+	var all []byte
+	for _, file := range wantFiles {
+		all = append(all, content[filepath.ToSlash(filepath.Join(file.Path...))]...)
+	}
+	var want []byte
+	for i := 0; i < len(all); i += info.PieceLength {
+		hash := sha1.Sum(all[i:min(i+info.PieceLength, len(all))])
+		want = append(want, hash[:]...)
+	}
+	if info.Pieces != string(want) {
+		t.Errorf("have %d bytes of piece hashes, want %d", len(info.Pieces), len(want))
+	}
+}
+
+func TestCreateSingleFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sample.txt")
+	data := bytes.Repeat([]byte("0123456789"), 9206)
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	if _, err := Create(&out, path, CreateOptions{Announce: "http://a.example/announce", PieceLength: 32768}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var m metainfo
+	if err := bencode.Unmarshal(out.Bytes(), &m); err != nil {
+		t.Fatal(err)
+	}
+	var info infoDict
+	if err := bencode.Unmarshal(m.Info, &info); err != nil {
+		t.Fatal(err)
+	}
+	if info.Name != "sample.txt" || info.Length != int64(len(data)) || info.Files != nil || len(info.Pieces) != 3*20 {
+		t.Errorf("unexpected info dictionary: %+v", info)
+	}
+	if m.CreationDate != 0 || m.AnnounceList != nil {
+		t.Errorf("unexpected optional keys: %+v", m)
+	}
+}
+
+func TestCreateDirectoryPaths(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "content")
+	if err := os.MkdirAll(filepath.Join(dir, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a.txt", "self.torrent"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte("data"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The root is named after the directory it resolves to, and the torrent
+	// being written inside it is left out
+	var out bytes.Buffer
+	opts := CreateOptions{Announce: "http://a.example/announce", Exclude: []string{filepath.Join(dir, "self.torrent")}}
+	if _, err := Create(&out, dir+string(filepath.Separator)+"sub"+string(filepath.Separator)+"..", opts); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var m metainfo
+	if err := bencode.Unmarshal(out.Bytes(), &m); err != nil {
+		t.Fatal(err)
+	}
+	var info infoDict
+	if err := bencode.Unmarshal(m.Info, &info); err != nil {
+		t.Fatal(err)
+	}
+	if want := []fileInfo{{Length: 4, Path: []string{"a.txt"}}}; info.Name != "content" || !reflect.DeepEqual(info.Files, want) {
+		t.Errorf("have %q with %+v, want %q with %+v", info.Name, info.Files, "content", want)
+	}
+}
+
+func TestCreateErrors(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sample.txt")
+	if err := os.WriteFile(path, []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		root string
+		opts CreateOptions
+	}{
+		{"no tracker", path, CreateOptions{}},
+		{"missing file", path + ".missing", CreateOptions{Announce: "http://a.example"}},
+		{"piece length not a power of two", path, CreateOptions{Announce: "http://a.example", PieceLength: 20000}},
+		{"piece length too small", path, CreateOptions{Announce: "http://a.example", PieceLength: 1024}},
+		{"empty directory", t.TempDir(), CreateOptions{Announce: "http://a.example"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := Create(&bytes.Buffer{}, tt.root, tt.opts); err == nil {
+				t.Error("Should have thrown an error but didn't")
+			}
+		})
+	}
+}
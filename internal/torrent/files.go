@@ -0,0 +1,138 @@
+package torrent
+
+import (
+	"fmt"
+	"karlan/torrent/internal/fileio"
+	"sort"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// A File is one of the files of a torrent. The content of a torrent is the
+// concatenation of its files, which pieces are cut from without regard for
+// where one file ends and the next begins.
+type File struct {
+	Path   []string // Path components, starting with the torrent name for multi-file torrents
+	Length int64
+	Offset int64 // Offset of the first byte of the file in the torrent content
+}
+
+// A FileSpan is the part of a piece that lies within a single file.
+type FileSpan struct {
+	File        int   // Index of the file in Files
+	FileOffset  int64 // Offset of the span within the file
+	PieceOffset int   // Offset of the span within the piece
+	Length      int
+}
+
+// layoutFiles places the files of the torrent one after the other. Their
+// paths are sanitized, since they are used to create files on disk.
+func (f *torrentDictionary) layoutFiles(info *infoDict) ([]File, error) {
+	var nameUTF8 []string
+	if info.NameUTF8 != "" {
+		nameUTF8 = []string{info.NameUTF8}
+	}
+	name, err := sanitizePath(preferUTF8([]string{info.Name}, nameUTF8))
+	if err != nil {
+		return nil, fmt.Errorf("invalid name: %w", err)
+	}
+
+	if f.Type == SINGLE {
+		return []File{{Path: name, Length: f.FileLength}}, nil
+	}
+
+	files := make([]File, len(info.Files))
+	seen := make(map[string]bool, len(info.Files))
+	var offset int64
+	for i, file := range info.Files {
+		if file.Length < 0 {
+			return nil, fmt.Errorf("invalid length %d of file %d", file.Length, i)
+		}
+		path, err := sanitizePath(preferUTF8(file.Path, file.PathUTF8))
+		if err != nil {
+			return nil, fmt.Errorf("invalid path of file %d: %w", i, err)
+		}
+		path = append(append([]string{}, name...), path...)
+
+		// Rewriting can make two paths the same
+		key := strings.ToLower(strings.Join(path, "/"))
+		if seen[key] {
+			return nil, fmt.Errorf("duplicate path %q", strings.Join(path, "/"))
+		}
+		seen[key] = true
+
+		files[i] = File{Path: path, Length: file.Length, Offset: offset}
+		offset += file.Length
+	}
+	return files, nil
+}
+
+// Files returns the files of the torrent in the order of their content.
+func (t *Torrent) Files() []File {
+	return t.infoDictionary.Layout
+}
+
+func (t *Torrent) IsMultiFile() bool {
+	return t.infoDictionary.Type == MULTI
+}
+
+// PieceSpans maps the piece at index onto the files it covers. A piece can
+// cover the end of one file, any number of whole files and the start of
+// another; empty files are never covered.
+func (t *Torrent) PieceSpans(index int) []FileSpan {
+	files := t.infoDictionary.Layout
+	start := int64(index) * int64(t.infoDictionary.PieceLength)
+	end := start + int64(t.GetPieceLength(index))
+
+	// The first file that ends after the start of the piece
+	i := sort.Search(len(files), func(i int) bool {
+		return files[i].Offset+files[i].Length > start
+	})
+
+	var spans []FileSpan
+	for ; i < len(files) && files[i].Offset < end; i++ {
+		if files[i].Length == 0 {
+			continue
+		}
+		from := max(start, files[i].Offset)
+		to := min(end, files[i].Offset+files[i].Length)
+		spans = append(spans, FileSpan{
+			File:        i,
+			FileOffset:  from - files[i].Offset,
+			PieceOffset: int(from - start),
+			Length:      int(to - from),
+		})
+	}
+	return spans
+}
+
+// WriteFiles writes the downloaded content of the torrent as its files,
+// laid out under dir.
+func (t *Torrent) WriteFiles(dir string) error {
+	files := t.Files()
+	paths := make([]string, len(files))
+	for i, file := range files {
+		path, err := fileio.JoinUnder(dir, file.Path...)
+		if err != nil {
+			return err
+		}
+		paths[i] = path
+		log.Debugf("Creating file %s of %d bytes", paths[i], file.Length)
+		if err := fileio.CreateFile(paths[i], file.Length); err != nil {
+			return fmt.Errorf("error creating file: %w", err)
+		}
+	}
+
+	data := t.GetData()
+	for index := 0; index < t.GetNumberOfPieces(); index++ {
+		piece := data[int64(index)*int64(t.infoDictionary.PieceLength):]
+		for _, span := range t.PieceSpans(index) {
+			block := piece[span.PieceOffset : span.PieceOffset+span.Length]
+			if err := fileio.WriteAt(paths[span.File], span.FileOffset, block); err != nil {
+				return fmt.Errorf("error writing piece %d: %w", index, err)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,77 @@
+package torrent
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// newTestTorrent returns a multi-file torrent holding data, split into files
+// of the given lengths.
+func newTestTorrent(data []byte, pieceLength int, lengths ...int64) *Torrent {
+	info := &infoDict{Name: "root", PieceLength: pieceLength}
+	numPieces := (len(data) + pieceLength - 1) / pieceLength
+	for i := 0; i < numPieces; i++ {
+		hash := sha1.Sum(data[i*pieceLength : min((i+1)*pieceLength, len(data))])
+		info.Pieces += string(hash[:])
+	}
+	for i, length := range lengths {
+		info.Files = append(info.Files, fileInfo{Length: length, Path: []string{"dir", string(rune('a' + i))}})
+	}
+
+	infoDictionary, err := createInfoDictionary(info)
+	if err != nil {
+		panic(err)
+	}
+	t := &Torrent{infoDictionary: *infoDictionary, pieces: make([]byte, (numPieces+7)/8)}
+	for i := 0; i < numPieces; i++ {
+		start := i * pieceLength
+		t.AddPiece(data[start:min(start+pieceLength, len(data))], i)
+	}
+	return t
+}
+
+func TestPieceSpans(t *testing.T) {
+	// Files of 3, 0, 10 and 5 bytes in pieces of 4 bytes
+	tr := newTestTorrent(make([]byte, 18), 4, 3, 0, 10, 5)
+
+	tests := []struct {
+		index int
+		want  []FileSpan
+	}{
+		{0, []FileSpan{{File: 0, FileOffset: 0, PieceOffset: 0, Length: 3}, {File: 2, FileOffset: 0, PieceOffset: 3, Length: 1}}},
+		{1, []FileSpan{{File: 2, FileOffset: 1, PieceOffset: 0, Length: 4}}},
+		{3, []FileSpan{{File: 2, FileOffset: 9, PieceOffset: 0, Length: 1}, {File: 3, FileOffset: 0, PieceOffset: 1, Length: 3}}},
+		{4, []FileSpan{{File: 3, FileOffset: 3, PieceOffset: 0, Length: 2}}},
+	}
+
+	for _, tt := range tests {
+		if have := tr.PieceSpans(tt.index); !reflect.DeepEqual(have, tt.want) {
+			t.Errorf("piece %d: have %+v, want %+v", tt.index, have, tt.want)
+		}
+	}
+}
+
+func TestWriteFiles(t *testing.T) {
+	data := []byte("abcdefghijklmnopqrstuvwxyz")
+	tr := newTestTorrent(data, 8, 5, 0, 13, 8)
+
+	dir := t.TempDir()
+	if err := tr.WriteFiles(dir); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	want := map[string][]byte{"a": data[:5], "b": {}, "c": data[5:18], "d": data[18:]}
+	for name, content := range want {
+		have, err := os.ReadFile(filepath.Join(dir, "root", "dir", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(have, content) {
+			t.Errorf("%s: have %q, want %q", name, have, content)
+		}
+	}
+}
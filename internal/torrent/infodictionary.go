@@ -2,6 +2,7 @@ package torrent
 
 import (
 	"fmt"
+	"math"
 
 	log "github.com/sirupsen/logrus"
 )
@@ -10,78 +11,98 @@ const MULTI = "Multi-File Torrent"
 const SINGLE = "Single-File Torrent"
 
 type torrentDictionary struct {
-	Data            []byte
+	Data            []byte // Downloaded content, allocated by the first piece added
 	Type            string
 	Name            string     // Name of the file (for single-file) or root directory (for multi-file)
-	FileLength      int        // Length of the file, single file torrent
+	FileLength      int64      // Length of the file, single file torrent
 	PieceLength     int        // Length of each piece
 	LastPieceLength int        // Length of last piece
 	NumberOfPieces  int        // Number of pieces
 	PieceHashes     [][20]byte // SHA1 hashes of each piece
 	Files           []fileInfo // List of files for multitorrent
+	Layout          []File     // Files placed in the torrent content
 }
 
 type fileInfo struct {
-	Length int
-	Path   []string
+	Length   int64    `bencode:"length"`
+	Path     []string `bencode:"path"`
+	PathUTF8 []string `bencode:"path.utf-8,omitempty"`
 }
 
-func createInfoDictionary(infoDict map[string]interface{}) *torrentDictionary {
+// infoDict mirrors the 'info' section of a .torrent file.
+type infoDict struct {
+	Name        string     `bencode:"name"`
+	NameUTF8    string     `bencode:"name.utf-8,omitempty"`
+	PieceLength int        `bencode:"piece length"`
+	Pieces      string     `bencode:"pieces"`
+	Length      int64      `bencode:"length,omitempty"`
+	Files       []fileInfo `bencode:"files,omitempty"`
+	Private     int        `bencode:"private,omitempty"`
+}
+
+// createInfoDictionary checks the info dictionary of a torrent and works out
+// its pieces and files. Lengths come from untrusted torrent data, so they are
+// checked before anything is sized by them.
+func createInfoDictionary(info *infoDict) (*torrentDictionary, error) {
 	infoDictionaryStruct := &torrentDictionary{}
 
-	infoDictionaryStruct.Name = infoDict["name"].(string)
-	infoDictionaryStruct.PieceLength = infoDict["piece length"].(int)
-	infoDictionaryStruct.PieceHashes = splitPieceHashes(infoDict["pieces"])
+	if info.PieceLength <= 0 {
+		return nil, fmt.Errorf("invalid piece length %d", info.PieceLength)
+	}
+	if len(info.Pieces)%20 != 0 {
+		return nil, fmt.Errorf("invalid pieces length %d, not a multiple of 20", len(info.Pieces))
+	}
+
+	infoDictionaryStruct.Name = info.Name
+	infoDictionaryStruct.PieceLength = info.PieceLength
+	infoDictionaryStruct.PieceHashes = splitPieceHashes(info.Pieces)
 	infoDictionaryStruct.NumberOfPieces = len(infoDictionaryStruct.PieceHashes)
 
-	if length, ok := infoDict["length"].(int); ok {
+	if len(info.Files) == 0 {
 		// Single-file torrent
+		if info.Length < 0 {
+			return nil, fmt.Errorf("invalid length %d", info.Length)
+		}
 		infoDictionaryStruct.Type = SINGLE
-		infoDictionaryStruct.FileLength = length
-		infoDictionaryStruct.LastPieceLength = infoDictionaryStruct.FileLength - (infoDictionaryStruct.NumberOfPieces-1)*infoDictionaryStruct.PieceLength
-		infoDictionaryStruct.Data = make([]byte, infoDictionaryStruct.FileLength)
+		infoDictionaryStruct.FileLength = info.Length
 	} else {
 		// Multi-file torrent
 		infoDictionaryStruct.Type = MULTI
-		files := infoDict["files"].([]interface{})
-		totalLength := 0
-		var fileStructs []fileInfo
-
-		for _, file := range files {
-			fileMap := file.(map[string]interface{})
-			length := fileMap["length"].(int)
-			pathInterface := fileMap["path"].([]interface{})
-			path := make([]string, len(pathInterface))
-
-			for i, p := range pathInterface {
-				path[i] = p.(string)
-			}
-
-			fileStruct := fileInfo{
-				Length: length,
-				Path:   path,
+		var totalLength int64
+		for i, file := range info.Files {
+			if file.Length < 0 || file.Length > math.MaxInt64-totalLength {
+				return nil, fmt.Errorf("invalid length %d of file %d", file.Length, i)
 			}
-
-			fileStructs = append(fileStructs, fileStruct)
-			totalLength += length
+			totalLength += file.Length
 		}
 
-		infoDictionaryStruct.Files = fileStructs
+		infoDictionaryStruct.Files = info.Files
 		infoDictionaryStruct.FileLength = totalLength
-		infoDictionaryStruct.LastPieceLength = totalLength - (infoDictionaryStruct.NumberOfPieces-1)*infoDictionaryStruct.PieceLength
-		infoDictionaryStruct.Data = make([]byte, totalLength)
 	}
 
-	return infoDictionaryStruct
-}
+	layout, err := infoDictionaryStruct.layoutFiles(info)
+	if err != nil {
+		return nil, err
+	}
+	infoDictionaryStruct.Layout = layout
 
-func splitPieceHashes(piece_hashes interface{}) [][20]byte {
-	hash, ok := piece_hashes.(string)
-	if !ok {
-		log.Info("Not a string")
-		return nil
+	// Every piece but the last is full, and the last is not empty
+	length, pieceLength := infoDictionaryStruct.FileLength, int64(info.PieceLength)
+	numPieces := length / pieceLength
+	if length%pieceLength != 0 {
+		numPieces++
+	}
+	if int64(infoDictionaryStruct.NumberOfPieces) != numPieces {
+		return nil, fmt.Errorf("%d pieces given for %d bytes in pieces of %d bytes, want %d", infoDictionaryStruct.NumberOfPieces, length, pieceLength, numPieces)
 	}
+	if numPieces > 0 {
+		infoDictionaryStruct.LastPieceLength = int(length - (numPieces-1)*pieceLength)
+	}
+
+	return infoDictionaryStruct, nil
+}
 
+func splitPieceHashes(hash string) [][20]byte {
 	// Ensure that the hash length is a multiple of 20
 	if len(hash)%20 != 0 {
 		log.Info("String length is not a multiple of 20")
@@ -109,6 +130,10 @@ func (f *torrentDictionary) GetPieceLength(index int) int {
 }
 
 func (f *torrentDictionary) addPiece(piece []byte, pieceIndex int) {
+	// Only downloads need the content in memory, so loading a torrent does not
+	if f.Data == nil {
+		f.Data = make([]byte, f.FileLength)
+	}
 	offset := f.PieceLength * pieceIndex
 	copy(f.Data[offset:offset+len(piece)], piece)
 }
@@ -0,0 +1,53 @@
+package torrent
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCreateInfoDictionary(t *testing.T) {
+	pieces := func(n int) string { return strings.Repeat("x", 20*n) }
+
+	tests := []struct {
+		name          string
+		info          infoDict
+		wantLastPiece int
+		wantErr       bool
+	}{
+		{"full last piece", infoDict{Name: "a", PieceLength: 4, Pieces: pieces(2), Length: 8}, 4, false},
+		{"short last piece", infoDict{Name: "a", PieceLength: 4, Pieces: pieces(3), Length: 9}, 1, false},
+		{"empty", infoDict{Name: "a", PieceLength: 4, Length: 0}, 0, false},
+		{"multi-file", infoDict{Name: "a", PieceLength: 4, Pieces: pieces(2), Files: []fileInfo{{Length: 3, Path: []string{"b"}}, {Length: 3, Path: []string{"c"}}}}, 2, false},
+		{"negative length", infoDict{Name: "a", PieceLength: 4, Pieces: pieces(1), Length: -5}, 0, true},
+		{"zero piece length", infoDict{Name: "a", PieceLength: 0, Pieces: pieces(1), Length: 4}, 0, true},
+		{"negative piece length", infoDict{Name: "a", PieceLength: -4, Pieces: pieces(1), Length: 4}, 0, true},
+		{"too few pieces", infoDict{Name: "a", PieceLength: 4, Pieces: pieces(1), Length: 100}, 0, true},
+		{"too many pieces", infoDict{Name: "a", PieceLength: 4, Pieces: pieces(3), Length: 8}, 0, true},
+		{"truncated piece hash", infoDict{Name: "a", PieceLength: 4, Pieces: pieces(1)[:19], Length: 4}, 0, true},
+		{"overflowing files", infoDict{Name: "a", PieceLength: 4, Pieces: pieces(1), Files: []fileInfo{{Length: 1 << 62, Path: []string{"b"}}, {Length: 1 << 62, Path: []string{"c"}}, {Length: 1 << 62, Path: []string{"d"}}}}, 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := createInfoDictionary(&tt.info)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("have error %v, want error: %v", err, tt.wantErr)
+			}
+			if err == nil && f.LastPieceLength != tt.wantLastPiece {
+				t.Errorf("have last piece of %d bytes, want %d", f.LastPieceLength, tt.wantLastPiece)
+			}
+		})
+	}
+}
+
+func TestCreateInfoDictionaryLeavesContentUnallocated(t *testing.T) {
+	// A terabyte of content in pieces of 16 MiB
+	info := infoDict{Name: "big", PieceLength: 1 << 24, Pieces: strings.Repeat("x", 20<<16), Length: 1 << 40}
+	f, err := createInfoDictionary(&info)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if f.Data != nil {
+		t.Errorf("have %d bytes of content allocated, want none", len(f.Data))
+	}
+}
@@ -0,0 +1,97 @@
+package torrent
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+)
+
+// maxNameLength is the longest file name, in bytes, that common file systems
+// accept.
+const maxNameLength = 255
+
+// reservedNames cannot be used as file names on Windows, whatever their
+// extension.
+var reservedNames = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true, "COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true, "LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// sanitizeName turns a file name from a torrent into one that is safe to
+// create on any platform. Names come from untrusted torrent data, so anything
+// that could escape the download directory or confuse a file system is
+// rewritten: separators, control characters and characters Windows does not
+// allow become '_', trailing dots and spaces are dropped, reserved names get
+// a trailing '_', and overlong names are shortened, keeping the extension.
+// It returns an empty string for empty names and "." and fails on "..", as
+// there is no sensible rewrite for it.
+func sanitizeName(name string) (string, error) {
+	if name == ".." {
+		return "", fmt.Errorf("path component %q is not allowed", name)
+	}
+
+	name = strings.ToValidUTF8(name, "_")
+	name = strings.Map(func(r rune) rune {
+		if r < 0x20 || r == 0x7f || strings.ContainsRune(`/\:*?"<>|`, r) {
+			return '_'
+		}
+		return r
+	}, name)
+	name = strings.TrimRight(name, ". ")
+	if name == "" {
+		return "", nil
+	}
+
+	base, _, _ := strings.Cut(name, ".")
+	if reservedNames[strings.ToUpper(strings.TrimRight(base, " "))] {
+		name = base + "_" + name[len(base):]
+	}
+
+	if len(name) > maxNameLength {
+		ext := filepath.Ext(name)
+		if len(ext) > maxNameLength/8 {
+			ext = ""
+		}
+		n := maxNameLength - len(ext)
+		for !utf8.RuneStart(name[n]) {
+			n--
+		}
+		name = name[:n] + ext
+	}
+	return name, nil
+}
+
+// sanitizePath sanitizes each component of a file path from a torrent,
+// leaving out empty ones. It fails if nothing is left.
+func sanitizePath(components []string) ([]string, error) {
+	path := make([]string, 0, len(components))
+	for _, component := range components {
+		name, err := sanitizeName(component)
+		if err != nil {
+			return nil, err
+		}
+		if name != "" {
+			path = append(path, name)
+		}
+	}
+	if len(path) == 0 {
+		return nil, fmt.Errorf("empty path %q", components)
+	}
+	return path, nil
+}
+
+// preferUTF8 returns the UTF-8 variant of a name or path given by the
+// name.utf-8 and path.utf-8 keys, if there is a valid one.
+func preferUTF8(value, utf8Value []string) []string {
+	if len(utf8Value) == 0 {
+		return value
+	}
+	for _, component := range utf8Value {
+		if !utf8.ValidString(component) {
+			return value
+		}
+	}
+	return utf8Value
+}
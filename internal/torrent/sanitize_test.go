@@ -0,0 +1,134 @@
+package torrent
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSanitizeName(t *testing.T) {
+	tests := []struct {
+		name    string
+		want    string
+		wantErr bool
+	}{
+		{"file.txt", "file.txt", false},
+		{"", "", false},
+		{".", "", false},
+		{"..", "", true},
+		{"...", "", false},
+		{"/etc/passwd", "_etc_passwd", false},
+		{`..\windows`, `.._windows`, false},
+		{"C:", "C_", false},
+		{"bell\a\nnewline", "bell__newline", false},
+		{"trailing. . ", "trailing", false},
+		{"con", "con_", false},
+		{"COM1.txt", "COM1_.txt", false},
+		{"console.txt", "console.txt", false},
+		{"bad\xffutf8", "bad_utf8", false},
+		{"日本語.txt", "日本語.txt", false},
+		{strings.Repeat("a", 300) + ".iso", strings.Repeat("a", 251) + ".iso", false},
+		{strings.Repeat("é", 200), strings.Repeat("é", 127), false},
+	}
+
+	for _, tt := range tests {
+		have, err := sanitizeName(tt.name)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%q: unexpected error: %v", tt.name, err)
+			continue
+		}
+		if have != tt.want {
+			t.Errorf("%q: have %q, want %q", tt.name, have, tt.want)
+		}
+	}
+}
+
+func TestLayoutFiles(t *testing.T) {
+	tests := []struct {
+		name    string
+		info    infoDict
+		want    [][]string
+		wantErr bool
+	}{
+		{
+			name: "empty and dot components",
+			info: infoDict{Name: "root", Files: []fileInfo{{Length: 1, Path: []string{"", "a", ".", "b"}}}},
+			want: [][]string{{"root", "a", "b"}},
+		},
+		{
+			name: "utf-8 keys",
+			info: infoDict{Name: "\xe4\xbd", NameUTF8: "名前", Files: []fileInfo{{Length: 1, Path: []string{"\xff"}, PathUTF8: []string{"ファイル"}}}},
+			want: [][]string{{"名前", "ファイル"}},
+		},
+		{
+			name: "invalid utf-8 keys are ignored",
+			info: infoDict{Name: "root", NameUTF8: "\xff", Files: []fileInfo{{Length: 1, Path: []string{"a"}}}},
+			want: [][]string{{"root", "a"}},
+		},
+		{
+			name:    "parent directory",
+			info:    infoDict{Name: "root", Files: []fileInfo{{Length: 1, Path: []string{"..", "..", "etc", "passwd"}}}},
+			wantErr: true,
+		},
+		{
+			name:    "empty path",
+			info:    infoDict{Name: "root", Files: []fileInfo{{Length: 1, Path: []string{"", "."}}}},
+			wantErr: true,
+		},
+		{
+			name:    "empty name",
+			info:    infoDict{Name: "", Length: 1},
+			wantErr: true,
+		},
+		{
+			name:    "paths that become the same",
+			info:    infoDict{Name: "root", Files: []fileInfo{{Length: 1, Path: []string{"a:b"}}, {Length: 1, Path: []string{"A?b"}}}},
+			wantErr: true,
+		},
+		{
+			name:    "negative length",
+			info:    infoDict{Name: "root", Files: []fileInfo{{Length: -1, Path: []string{"a"}}}},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.info.PieceLength = 16384
+			tt.info.Pieces = strings.Repeat("x", 20)
+			f, err := createInfoDictionary(&tt.info)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if err != nil {
+				return
+			}
+
+			var have [][]string
+			for _, file := range f.Layout {
+				have = append(have, file.Path)
+			}
+			if !reflect.DeepEqual(have, tt.want) {
+				t.Errorf("have %q, want %q", have, tt.want)
+			}
+		})
+	}
+}
+
+func TestWriteFilesRefusesSymlinks(t *testing.T) {
+	dir := t.TempDir()
+	outside := t.TempDir()
+	if err := os.Symlink(outside, filepath.Join(dir, "root")); err != nil {
+		t.Skip("symbolic links are not supported")
+	}
+
+	tr := newTestTorrent([]byte("data"), 4, 4)
+	if err := tr.WriteFiles(dir); err == nil {
+		t.Error("Should have thrown an error but didn't")
+	}
+	if entries, _ := os.ReadDir(outside); len(entries) != 0 {
+		t.Errorf("wrote outside of the download directory: %v", entries)
+	}
+}
@@ -0,0 +1,116 @@
+package torrent
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// MaxBlockLength is the largest block peers may request. Like most clients,
+// we refuse larger requests.
+const MaxBlockLength = 128 * 1024
+
+// VerifyContent checks the content of the torrent at path, which is the file
+// or directory the torrent was created from, and marks the pieces found
+// intact as ones we have, counting them as downloaded. Blocks of those pieces
+// are read from the files from then on. It returns the number of intact
+// pieces.
+func (t *Torrent) VerifyContent(path string) (int, error) {
+	files := t.Files()
+	paths := make([]string, len(files))
+	for i, file := range files {
+		// The first component of a path is the name of the torrent
+		paths[i] = filepath.Join(append([]string{path}, file.Path[1:]...)...)
+
+		stat, err := os.Stat(paths[i])
+		if err != nil {
+			return 0, err
+		}
+		if !stat.Mode().IsRegular() || stat.Size() != file.Length {
+			return 0, fmt.Errorf("%s is not a file of %d bytes", paths[i], file.Length)
+		}
+	}
+
+	verified := 0
+	for index := 0; index < t.GetNumberOfPieces(); index++ {
+		pieceLength := t.GetPieceLength(index)
+		piece, err := t.readFiles(paths, index, 0, pieceLength)
+		if err != nil {
+			return verified, err
+		}
+		if sha1.Sum(piece) != t.GetPieceHash(index) {
+			continue
+		}
+
+		t.mutex.Lock()
+		if !t.hasPiece(index) {
+			t.pieces[index/8] |= 1 << (7 - index%8)
+			t.Downloaded += int64(pieceLength)
+			t.Left -= int64(pieceLength)
+		}
+		t.mutex.Unlock()
+		verified++
+	}
+
+	t.mutex.Lock()
+	t.contentPaths = paths
+	t.mutex.Unlock()
+	return verified, nil
+}
+
+// ReadBlock returns length bytes of the piece at index from offset, to send
+// to a peer. It fails unless the block lies within a piece we have and is no
+// longer than MaxBlockLength.
+func (t *Torrent) ReadBlock(index, offset, length int) ([]byte, error) {
+	if index < 0 || index >= t.GetNumberOfPieces() {
+		return nil, fmt.Errorf("invalid piece index %d", index)
+	}
+	if offset < 0 || length <= 0 || length > MaxBlockLength || offset+length > t.GetPieceLength(index) {
+		return nil, fmt.Errorf("invalid block of %d bytes at offset %d of piece %d", length, offset, index)
+	}
+
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	if !t.hasPiece(index) {
+		return nil, fmt.Errorf("piece %d is not available", index)
+	}
+	if t.contentPaths != nil {
+		return t.readFiles(t.contentPaths, index, offset, length)
+	}
+
+	start := int64(index)*int64(t.infoDictionary.PieceLength) + int64(offset)
+	return append([]byte{}, t.infoDictionary.Data[start:start+int64(length)]...), nil
+}
+
+// readFiles reads length bytes of the piece at index from offset out of the
+// files at paths.
+func (t *Torrent) readFiles(paths []string, index, offset, length int) ([]byte, error) {
+	block := make([]byte, length)
+	for _, span := range t.PieceSpans(index) {
+		// The part of the span that lies within the block
+		from := max(span.PieceOffset, offset)
+		to := min(span.PieceOffset+span.Length, offset+length)
+		if from >= to {
+			continue
+		}
+
+		file, err := os.Open(paths[span.File])
+		if err != nil {
+			return nil, err
+		}
+		_, err = file.ReadAt(block[from-offset:to-offset], span.FileOffset+int64(from-span.PieceOffset))
+		file.Close()
+		if err != nil {
+			return nil, fmt.Errorf("error reading %s: %w", paths[span.File], err)
+		}
+	}
+	return block, nil
+}
+
+// AddUploaded counts bytes sent to peers, as reported to trackers.
+func (t *Torrent) AddUploaded(n int) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.Uploaded += int64(n)
+}
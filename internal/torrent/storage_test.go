@@ -0,0 +1,117 @@
+package torrent
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestVerifyContent(t *testing.T) {
+	a := bytes.Repeat([]byte("a"), 20000)
+	b := bytes.Repeat([]byte("0123456789"), 3000)
+	tr := newTestTorrent(append(bytes.Clone(a), b...), 16*1024, int64(len(a)), int64(len(b)))
+	dir := t.TempDir()
+	if err := tr.WriteFiles(dir); err != nil {
+		t.Fatal(err)
+	}
+	content := filepath.Join(dir, "root")
+
+	// Forget every piece, as if nothing were downloaded
+	tr.pieces = make([]byte, len(tr.pieces))
+	tr.Downloaded, tr.Left = 0, int64(len(a)+len(b))
+
+	// Piece 1 straddles the two files, the last piece 3 lies within b
+	corrupted := bytes.Clone(b)
+	corrupted[len(b)-1] = 'x'
+	if err := os.WriteFile(filepath.Join(content, "dir", "b"), corrupted, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	verified, err := tr.VerifyContent(content)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if verified != 3 || !tr.HasPiece(0) || !tr.HasPiece(1) || !tr.HasPiece(2) || tr.HasPiece(3) {
+		t.Errorf("have %d pieces intact, %08b, want pieces 0 to 2", verified, tr.Bitfield())
+	}
+	if _, downloaded, left := tr.Stats(); downloaded != 3*16*1024 || left != int64(tr.GetPieceLength(3)) {
+		t.Errorf("have %d bytes downloaded and %d left, want %d and %d", downloaded, left, 3*16*1024, tr.GetPieceLength(3))
+	}
+	if tr.FinishedDownloading() {
+		t.Error("finished downloading with a piece missing")
+	}
+
+	// A block spanning both files
+	block, err := tr.ReadBlock(1, 20000-16384-10, 20)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if want := append(bytes.Clone(a[len(a)-10:]), b[:10]...); !bytes.Equal(block, want) {
+		t.Errorf("have %q, want %q", block, want)
+	}
+
+	// Once the content is intact, the torrent is complete, and pieces that
+	// were verified before are not counted again
+	if err := os.WriteFile(filepath.Join(content, "dir", "b"), b, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if verified, err := tr.VerifyContent(content); err != nil || verified != 4 {
+		t.Fatalf("have %d pieces intact, %v, want 4", verified, err)
+	}
+	if _, downloaded, left := tr.Stats(); downloaded != int64(len(a)+len(b)) || left != 0 {
+		t.Errorf("have %d bytes downloaded and %d left, want %d and 0", downloaded, left, len(a)+len(b))
+	}
+	if !tr.FinishedDownloading() {
+		t.Error("not finished downloading with every piece intact")
+	}
+
+	if err := os.Truncate(filepath.Join(content, "dir", "a"), 10); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tr.VerifyContent(content); err == nil {
+		t.Error("expected an error for a file of the wrong size")
+	}
+}
+
+func TestReadBlock(t *testing.T) {
+	data := []byte("abcdefghijklmnopqrstuvwxyz")
+	tr := newTestTorrent(data, 8, 26)
+	tr.pieces[0] &^= 1 << 6 // Forget piece 1
+
+	tests := []struct {
+		name                  string
+		index, offset, length int
+		want                  string
+		wantErr               bool
+	}{
+		{"whole piece", 0, 0, 8, "abcdefgh", false},
+		{"within a piece", 2, 3, 4, "tuvw", false},
+		{"last piece", 3, 0, 2, "yz", false},
+		{"missing piece", 1, 0, 8, "", true},
+		{"past the last piece", 4, 0, 1, "", true},
+		{"negative index", -1, 0, 1, "", true},
+		{"past the end of a piece", 0, 4, 5, "", true},
+		{"past the end of the last piece", 3, 0, 3, "", true},
+		{"negative offset", 0, -1, 2, "", true},
+		{"empty", 0, 0, 0, "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			have, err := tr.ReadBlock(tt.index, tt.offset, tt.length)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("expected an error, have %q", have)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if string(have) != tt.want {
+				t.Errorf("have %q, want %q", have, tt.want)
+			}
+		})
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"encoding/hex"
 	"fmt"
 	"karlan/torrent/internal/bencode"
+	mathrand "math/rand"
 	"os"
 	"sync"
 
@@ -14,70 +15,156 @@ import (
 
 // Torrent holds the decoded information from a .torrent file.
 type Torrent struct {
-	Announce       string   // URL of the torrent tracker
-	InfoHash       [20]byte // SHA1 hash of the 'info' section of the torrent file
+	Announce       string     // URL of the torrent tracker
+	AnnounceList   [][]string // Tiers of tracker URLs (BEP 12), shuffled within each tier
+	InfoHash       [20]byte   // SHA1 hash of the 'info' section of the torrent file
 	infoDictionary torrentDictionary
 
 	Comment string // Comments about the torrent
 	Creator string // Software used to create the torrent
-	Date    int    // Date created
+	Date    int64  // Date created
 
 	PeerID [20]byte // Peer ID for this client
 	Port   int      // Port number this client is listening on
 
-	Uploaded   int // Total uploaded data in bytes
-	Downloaded int // Total downloaded data in bytes
-	Left       int // Number of bytes left to download
+	Uploaded   int64 // Total uploaded data in bytes
+	Downloaded int64 // Total downloaded data in bytes
+	Left       int64 // Number of bytes left to download
+
+	pieces       []byte   // Bitfield of the pieces we have
+	contentPaths []string // Files blocks are read from, by file index; Data is used if nil
 
 	mutex sync.RWMutex
 }
 
+// metainfo mirrors the layout of a .torrent file.
+type metainfo struct {
+	Announce     string             `bencode:"announce"`
+	AnnounceList [][]string         `bencode:"announce-list,omitempty"`
+	Comment      string             `bencode:"comment,omitempty"`
+	CreatedBy    string             `bencode:"created by,omitempty"`
+	CreationDate int64              `bencode:"creation date,omitempty"`
+	URLList      []string           `bencode:"url-list,omitempty"`
+	Info         bencode.RawMessage `bencode:"info"`
+}
+
 // read and decode torrent file. Returns a torrent struct
 func Open(filePath string) *Torrent {
-	bytes, err := os.ReadFile(filePath)
+	torrent, err := Load(filePath)
 	if err != nil {
-		log.Fatal(fmt.Sprintf("Error reading file: %v\n", err))
+		log.Fatal(err)
 	}
+	return torrent
+}
 
-	decoding, err := bencode.Decode(string(bytes))
+// Load reads and decodes a torrent file like Open, but returns an error
+// instead of exiting.
+func Load(filePath string) (*Torrent, error) {
+	file, err := os.Open(filePath)
 	if err != nil {
-		log.Fatal(fmt.Sprintf("Error decoding file: %v\n", err))
+		return nil, fmt.Errorf("error reading file: %v", err)
 	}
+	defer file.Close()
 
-	dict := decoding.(map[string]interface{})
-	return createTorrentStruct(dict)
-}
-
-func createTorrentStruct(dict map[string]interface{}) *Torrent {
+	var m metainfo
+	err = bencode.NewDecoder(file).Decode(&m)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding file: %v", err)
+	}
 
-	infoDict := dict["info"].(map[string]interface{})
+	torrent, err := createTorrentStruct(&m)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding file: %v", err)
+	}
+	return torrent, nil
+}
 
+func createTorrentStruct(m *metainfo) (*Torrent, error) {
 	torrent := &Torrent{}
-	torrent.Announce = dict["announce"].(string)
-	torrent.InfoHash = hashInfoDictionary(bencode.Encode(dict["info"]))
+	torrent.Announce = m.Announce
+	torrent.AnnounceList = shuffleTiers(m.AnnounceList)
+	torrent.Comment = m.Comment
+	torrent.Creator = m.CreatedBy
+	torrent.Date = m.CreationDate
 
-	if comment, ok := dict["comment"].(string); ok {
-		torrent.Comment = comment
-	}
-	if creator, ok := dict["created by"].(string); ok {
-		torrent.Creator = creator
+	// The info hash must be computed from the info dictionary exactly as it
+	// appears in the file, or we end up in a different swarm
+	torrent.InfoHash = hashInfoDictionary(m.Info)
+
+	var info infoDict
+	if err := bencode.Unmarshal(m.Info, &info); err != nil {
+		return nil, fmt.Errorf("invalid info dictionary: %w", err)
 	}
-	if date, ok := dict["creation date"].(int); ok {
-		torrent.Date = date
+	infoDictionary, err := createInfoDictionary(&info)
+	if err != nil {
+		return nil, fmt.Errorf("invalid info dictionary: %w", err)
 	}
-
-	torrent.infoDictionary = *createInfoDictionary(infoDict)
+	torrent.infoDictionary = *infoDictionary
 
 	torrent.generatePeerID()
 	torrent.Port = 6881
 
 	torrent.Left = torrent.infoDictionary.FileLength
+	torrent.pieces = make([]byte, (torrent.infoDictionary.NumberOfPieces+7)/8)
 
-	return torrent
+	return torrent, nil
 }
 
-func hashInfoDictionary(encoding string) [20]byte {
-	hash := sha1.Sum([]byte(encoding))
+// shuffleTiers returns the non-empty tiers of an announce-list, each in
+// random order as BEP 12 asks for when a torrent is loaded.
+func shuffleTiers(announceList [][]string) [][]string {
+	var tiers [][]string
+	for _, tier := range announceList {
+		if len(tier) == 0 {
+			continue
+		}
+		shuffled := append([]string{}, tier...)
+		mathrand.Shuffle(len(shuffled), func(i, j int) {
+			shuffled[i], shuffled[j] = shuffled[j], shuffled[i]
+		})
+		tiers = append(tiers, shuffled)
+	}
+	return tiers
+}
+
+// Trackers returns the tiers of trackers to announce to, in the order they
+// should be tried. A torrent without an announce-list has a single tier
+// holding its announce URL.
+func (t *Torrent) Trackers() [][]string {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+
+	if len(t.AnnounceList) == 0 {
+		if t.Announce == "" {
+			return nil
+		}
+		return [][]string{{t.Announce}}
+	}
+
+	tiers := make([][]string, len(t.AnnounceList))
+	for i, tier := range t.AnnounceList {
+		tiers[i] = append([]string{}, tier...)
+	}
+	return tiers
+}
+
+// PromoteTracker moves the tracker at index to the front of its tier after a
+// successful announce, so that it is tried first next time.
+func (t *Torrent) PromoteTracker(tier, index int) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if tier >= len(t.AnnounceList) || index >= len(t.AnnounceList[tier]) {
+		return
+	}
+	trackers := t.AnnounceList[tier]
+	promoted := trackers[index]
+	copy(trackers[1:index+1], trackers[:index])
+	trackers[0] = promoted
+}
+
+func hashInfoDictionary(encoding []byte) [20]byte {
+	hash := sha1.Sum(encoding)
 	return hash
 }
 
@@ -94,6 +181,9 @@ func (t *Torrent) generatePeerID() {
 func (t *Torrent) Log() {
 	log.Infof("Torrent Details:\n")
 	log.Infof("Tracker URL: %s\n", t.Announce)
+	for i, tier := range t.AnnounceList {
+		log.Infof("Tracker Tier %d: %v\n", i, tier)
+	}
 	log.Infof("Info Hash: %s\n", hex.EncodeToString(t.InfoHash[:]))
 	if t.Comment != "" {
 		log.Infof("Comment: %s\n", t.Comment)
@@ -115,6 +205,9 @@ func (t *Torrent) Log() {
 func (t *Torrent) Print() {
 	fmt.Printf("Torrent Details:\n")
 	fmt.Printf("Tracker URL: %s\n", t.Announce)
+	for i, tier := range t.AnnounceList {
+		fmt.Printf("Tracker Tier %d: %v\n", i, tier)
+	}
 	fmt.Printf("Info Hash: %s\n", hex.EncodeToString(t.InfoHash[:]))
 	if t.Comment != "" {
 		fmt.Printf("Comment: %s\n", t.Comment)
@@ -145,11 +238,42 @@ func (t *Torrent) AddPiece(data []byte, index int) {
 	t.mutex.Lock()
 	defer t.mutex.Unlock()
 	t.infoDictionary.addPiece(data, index)
-	t.Downloaded += len(data)
-	t.Left -= len(data)
+	t.Downloaded += int64(len(data))
+	t.Left -= int64(len(data))
+	if index >= 0 && index/8 < len(t.pieces) {
+		t.pieces[index/8] |= 1 << (7 - index%8)
+	}
+}
+
+// Bitfield returns the pieces we have, as sent to peers: the high bit of the
+// first byte is piece 0.
+func (t *Torrent) Bitfield() []byte {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	return append([]byte{}, t.pieces...)
+}
+
+// HasPiece reports whether we have the piece at index.
+func (t *Torrent) HasPiece(index int) bool {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	return t.hasPiece(index)
+}
+
+func (t *Torrent) hasPiece(index int) bool {
+	return index >= 0 && index/8 < len(t.pieces) && t.pieces[index/8]>>(7-index%8)&1 != 0
+}
+
+// Stats returns the byte counts reported to trackers.
+func (t *Torrent) Stats() (uploaded, downloaded, left int64) {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	return t.Uploaded, t.Downloaded, t.Left
 }
 
 func (t *Torrent) FinishedDownloading() bool {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
 	return t.Downloaded == t.infoDictionary.FileLength && t.Left == 0
 }
 
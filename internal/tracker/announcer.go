@@ -0,0 +1,185 @@
+package tracker
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"karlan/torrent/internal/client"
+	"karlan/torrent/internal/torrent"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// Used when a tracker gives no interval
+	defaultInterval = 30 * 60
+
+	// After failing to reach any tracker, wait this long before trying again,
+	// doubling the wait after each failure up to maxRetryInterval
+	retryInterval    = 15
+	maxRetryInterval = 30 * 60
+
+	// How long Stop waits for the stopped event to be sent
+	stopTimeout = 10 * time.Second
+)
+
+// An Announcer keeps a torrent announced to its trackers for as long as it
+// runs. It sends the started event when started, regular announces as often
+// as the tracker asks, the completed event when told the download finished,
+// and the stopped event when stopped. Peers from every answer are handed to
+// the onPeers callback, so a running download can pick up new ones.
+type Announcer struct {
+	torrent *torrent.Torrent
+	config  Config
+	onPeers func(peers []client.Client)
+
+	key        uint32            // Sent with every announce so trackers can recognize us
+	trackerIDs map[string]string // Tracker IDs by announce URL
+
+	started   bool // Whether a tracker answered the started event
+	failures  int
+	completed chan struct{}
+	stop      chan struct{}
+	stopOnce  sync.Once
+	done      chan struct{}
+
+	timeUnit time.Duration // Length of a second, shortened in tests
+}
+
+// NewAnnouncer returns an Announcer for the torrent that reaches its trackers
+// as cfg sets. onPeers is called from the announcer's goroutine and must not
+// block for long.
+func NewAnnouncer(t *torrent.Torrent, cfg Config, onPeers func(peers []client.Client)) *Announcer {
+	var key [4]byte
+	if _, err := rand.Read(key[:]); err != nil {
+		log.Errorf("Generate announce key: %s", err)
+	}
+
+	return &Announcer{
+		torrent:    t,
+		config:     cfg,
+		onPeers:    onPeers,
+		key:        binary.BigEndian.Uint32(key[:]),
+		trackerIDs: make(map[string]string),
+		completed:  make(chan struct{}, 1),
+		stop:       make(chan struct{}),
+		done:       make(chan struct{}),
+		timeUnit:   time.Second,
+	}
+}
+
+// Start sends the started event and then keeps announcing in the background
+// until Stop is called. It returns an error if no tracker answered the started
+// event, in which case the announcer keeps sending it until one does.
+func (a *Announcer) Start() error {
+	resp, err := a.announce("started")
+	go a.run(a.wait(resp))
+	return err
+}
+
+// Completed sends the completed event. It is only sent once, however often
+// Completed is called.
+func (a *Announcer) Completed() {
+	select {
+	case a.completed <- struct{}{}:
+	default:
+	}
+}
+
+// Stop sends the stopped event and stops announcing. It gives up waiting for
+// the trackers after a while. Calling it again does nothing.
+func (a *Announcer) Stop() {
+	a.stopOnce.Do(func() { close(a.stop) })
+	select {
+	case <-a.done:
+	case <-time.After(stopTimeout):
+		log.Warn("Timed out sending the stopped event")
+	}
+}
+
+func (a *Announcer) run(wait time.Duration) {
+	defer close(a.done)
+
+	completed := a.completed
+	for {
+		var resp *AnnounceResponse
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+			resp, _ = a.announce(a.nextEvent())
+		case <-completed:
+			// Events are sent right away, regardless of the interval
+			completed = nil
+			if !a.started {
+				a.announce("started")
+			}
+			resp, _ = a.announce("completed")
+		case <-a.stop:
+			timer.Stop()
+			// A completion reported just before stopping still counts
+			select {
+			case <-completed:
+				a.announce("completed")
+			default:
+			}
+			a.announce("stopped")
+			return
+		}
+		timer.Stop()
+		wait = a.wait(resp)
+	}
+}
+
+// nextEvent returns the event of a regular announce, which is the started
+// event until a tracker answers it.
+func (a *Announcer) nextEvent() string {
+	if !a.started {
+		return "started"
+	}
+	return ""
+}
+
+// announce sends an announce with the torrent's current statistics and hands
+// the returned peers on.
+func (a *Announcer) announce(event string) (*AnnounceResponse, error) {
+	req := newAnnounceRequest(a.torrent, a.config)
+	req.Event = event
+	req.Key = a.key
+
+	log.Infof("Announcing to trackers, event %q", event)
+	resp, err := announceTiers(a.torrent, a.config, req, a.trackerIDs)
+	if err != nil {
+		log.Warnf("Error announcing: %v", err)
+		a.failures++
+		return nil, err
+	}
+	a.failures = 0
+	if event == "started" {
+		a.started = true
+	}
+
+	if event != "stopped" && a.onPeers != nil && len(resp.Peers) > 0 {
+		a.onPeers(resp.Peers)
+	}
+	return resp, nil
+}
+
+// wait returns how long to wait before the next regular announce: the
+// interval the tracker asked for, but no less than its minimum interval, or
+// an increasing delay while no tracker can be reached.
+func (a *Announcer) wait(resp *AnnounceResponse) time.Duration {
+	if resp == nil {
+		seconds := retryInterval << max(min(a.failures-1, 10), 0)
+		return time.Duration(min(seconds, maxRetryInterval)) * a.timeUnit
+	}
+
+	seconds := resp.Interval
+	if seconds <= 0 {
+		seconds = defaultInterval
+	}
+	if seconds < resp.MinInterval {
+		seconds = resp.MinInterval
+	}
+	return time.Duration(seconds) * a.timeUnit
+}
@@ -0,0 +1,154 @@
+package tracker
+
+import (
+	"karlan/torrent/internal/client"
+	"karlan/torrent/internal/torrent"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestAnnouncer(t *testing.T) {
+	var mutex sync.Mutex
+	var queries []url.Values
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		queries = append(queries, r.URL.Query())
+		mutex.Unlock()
+		// Asks for announces every 2 seconds, while allowing only one per 5
+		w.Write([]byte("d8:intervali2e12:min intervali5e5:peers6:\xa5\xe8\x6f\x7a\xc9\x2610:tracker id3:abce"))
+	}))
+	defer ts.Close()
+
+	tr := &torrent.Torrent{Announce: ts.URL, Left: 100}
+	var peers []client.Client
+	a := NewAnnouncer(tr, Config{}, func(p []client.Client) {
+		mutex.Lock()
+		peers = append(peers, p...)
+		mutex.Unlock()
+	})
+	a.timeUnit = 10 * time.Millisecond
+
+	if err := a.Start(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Wait for a regular announce, which comes after the minimum interval
+	waitFor := func(n int) {
+		t.Helper()
+		for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(5 * time.Millisecond) {
+			mutex.Lock()
+			count := len(queries)
+			mutex.Unlock()
+			if count >= n {
+				return
+			}
+		}
+		t.Fatalf("timed out waiting for announce %d", n)
+	}
+	start := time.Now()
+	waitFor(2)
+	if elapsed := time.Since(start); elapsed < 5*a.timeUnit {
+		t.Errorf("announced again after %v, before the minimum interval", elapsed)
+	}
+
+	a.Completed()
+	waitFor(3)
+	a.Stop()
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	wantEvents := []string{"started", "", "completed", "stopped"}
+	if len(queries) != len(wantEvents) {
+		t.Fatalf("have %d announces, want %d", len(queries), len(wantEvents))
+	}
+	for i, q := range queries {
+		if q.Get("event") != wantEvents[i] {
+			t.Errorf("announce %d: have event %q, want %q", i, q.Get("event"), wantEvents[i])
+		}
+		if q.Get("key") == "" || q.Get("key") != queries[0].Get("key") {
+			t.Errorf("announce %d: key %q differs from %q", i, q.Get("key"), queries[0].Get("key"))
+		}
+		// The tracker ID is sent back once the tracker handed one out
+		if wantID := map[bool]string{true: "", false: "abc"}[i == 0]; q.Get("trackerid") != wantID {
+			t.Errorf("announce %d: have tracker ID %q, want %q", i, q.Get("trackerid"), wantID)
+		}
+	}
+
+	if len(peers) != 3 || peers[0].Address() != "165.232.111.122:51494" {
+		t.Errorf("unexpected peers: %v", peers)
+	}
+}
+
+func TestAnnouncerRetries(t *testing.T) {
+	a := NewAnnouncer(&torrent.Torrent{}, Config{}, nil)
+
+	tests := []struct {
+		failures int
+		resp     *AnnounceResponse
+		want     time.Duration
+	}{
+		{0, &AnnounceResponse{Interval: 1800}, 1800 * time.Second},
+		{0, &AnnounceResponse{Interval: 60, MinInterval: 300}, 300 * time.Second},
+		{0, &AnnounceResponse{}, defaultInterval * time.Second},
+		{1, nil, 15 * time.Second},
+		{3, nil, 60 * time.Second},
+		{50, nil, maxRetryInterval * time.Second},
+	}
+
+	for _, tt := range tests {
+		a.failures = tt.failures
+		if have := a.wait(tt.resp); have != tt.want {
+			t.Errorf("%d failures, %+v: have %v, want %v", tt.failures, tt.resp, have, tt.want)
+		}
+	}
+}
+
+func TestAnnouncerRetriesStarted(t *testing.T) {
+	var mutex sync.Mutex
+	var events []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		events = append(events, r.URL.Query().Get("event"))
+		// The first two announces fail
+		if len(events) <= 2 {
+			http.Error(w, "busy", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("d8:intervali60e5:peers0:e"))
+	}))
+	defer ts.Close()
+
+	a := NewAnnouncer(&torrent.Torrent{Announce: ts.URL, Left: 100}, Config{}, nil)
+	a.timeUnit = time.Millisecond
+	if err := a.Start(); err == nil {
+		t.Fatal("Should have thrown an error but didn't")
+	}
+
+	for start := time.Now(); ; time.Sleep(5 * time.Millisecond) {
+		mutex.Lock()
+		count := len(events)
+		mutex.Unlock()
+		if count >= 3 {
+			break
+		}
+		if time.Since(start) > 5*time.Second {
+			t.Fatalf("timed out waiting for announce 3")
+		}
+	}
+	a.Stop()
+	a.Stop() // Does nothing
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	want := []string{"started", "started", "started", "stopped"}
+	if !reflect.DeepEqual(events, want) {
+		t.Errorf("have events %q, want %q", events, want)
+	}
+}
@@ -0,0 +1,106 @@
+package tracker
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+)
+
+// DefaultTimeout bounds tracker requests when Config does not.
+const DefaultTimeout = 30 * time.Second
+
+// Config sets how trackers are reached. The zero value uses the defaults.
+type Config struct {
+	Timeout   time.Duration // Bounds each request, including UDP retransmissions; DefaultTimeout if zero
+	Proxy     string        // URL of an HTTP or SOCKS5 proxy for HTTP trackers; taken from the environment if empty
+	CAFile    string        // PEM bundle of certificate authorities trusted by HTTPS trackers besides the system ones
+	UserAgent string        // User-Agent header of HTTP requests; Go's default if empty
+
+	// Sent with every announce
+	NumWant  int    // Number of peers wanted; the tracker's default if zero
+	IP       string // Address to announce instead of the one requests come from
+	NoPeerID bool   // Ask for peer lists without peer IDs
+
+	client *http.Client // Built by Resolve
+}
+
+// Resolve checks cfg and builds the HTTP client it describes. Requests made
+// with the returned Config share that client, and so its connections, while a
+// Config that was not resolved builds a client for every request.
+func (cfg Config) Resolve() (Config, error) {
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = DefaultTimeout
+	}
+	client, err := newHTTPClient(cfg)
+	if err != nil {
+		return Config{}, err
+	}
+	cfg.client = client
+	return cfg, nil
+}
+
+// httpClient returns the client built by Resolve, or a new one.
+func (cfg Config) httpClient() (*http.Client, error) {
+	if cfg.client != nil {
+		return cfg.client, nil
+	}
+	return newHTTPClient(cfg)
+}
+
+// timeout returns how long a request may take.
+func (cfg Config) timeout() time.Duration {
+	if cfg.Timeout <= 0 {
+		return DefaultTimeout
+	}
+	return cfg.Timeout
+}
+
+func newHTTPClient(cfg Config) (*http.Client, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+
+	if cfg.Proxy != "" {
+		proxy, err := url.Parse(cfg.Proxy)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing proxy URL: %v", err)
+		}
+		transport.Proxy = http.ProxyURL(proxy)
+	}
+
+	if cfg.CAFile != "" {
+		pem, err := os.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("error reading CA bundle: %v", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in CA bundle %s", cfg.CAFile)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+
+	var roundTripper http.RoundTripper = transport
+	if cfg.UserAgent != "" {
+		roundTripper = &userAgentTransport{base: transport, userAgent: cfg.UserAgent}
+	}
+
+	return &http.Client{Transport: roundTripper, Timeout: cfg.timeout()}, nil
+}
+
+// userAgentTransport sets the User-Agent header of every request.
+type userAgentTransport struct {
+	base      http.RoundTripper
+	userAgent string
+}
+
+func (t *userAgentTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	r = r.Clone(r.Context())
+	r.Header.Set("User-Agent", t.userAgent)
+	return t.base.RoundTrip(r)
+}
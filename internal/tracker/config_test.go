@@ -0,0 +1,132 @@
+package tracker
+
+import (
+	"encoding/pem"
+	"errors"
+	"karlan/torrent/internal/torrent"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const okResponse = "d8:intervali60e5:peers0:e"
+
+func resolve(t *testing.T, cfg Config) Config {
+	t.Helper()
+	cfg, err := cfg.Resolve()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return cfg
+}
+
+func TestConfigRequests(t *testing.T) {
+	var request *http.Request
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		request = r
+		w.Write([]byte(okResponse))
+	}))
+	defer ts.Close()
+
+	cfg := resolve(t, Config{UserAgent: "mybittorrent/1.0", NumWant: 30, IP: "192.0.2.7", NoPeerID: true})
+	if _, _, err := GET(&torrent.Torrent{Announce: ts.URL}, cfg); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if have := request.Header.Get("User-Agent"); have != "mybittorrent/1.0" {
+		t.Errorf("have User-Agent %q, want %q", have, "mybittorrent/1.0")
+	}
+	query := request.URL.Query()
+	for key, want := range map[string]string{"numwant": "30", "ip": "192.0.2.7", "no_peer_id": "1"} {
+		if have := query.Get(key); have != want {
+			t.Errorf("have %s=%q, want %q", key, have, want)
+		}
+	}
+}
+
+func TestConfigTimeout(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+	}))
+	defer ts.Close()
+
+	cfg := resolve(t, Config{Timeout: 50 * time.Millisecond})
+	_, _, err := GET(&torrent.Torrent{Announce: ts.URL}, cfg)
+	var timeout *TimeoutError
+	if !errors.As(err, &timeout) {
+		t.Errorf("have: %v, want: a TimeoutError", err)
+	}
+}
+
+func TestConfigProxy(t *testing.T) {
+	// The proxy answers for the tracker, which does not exist
+	var proxied *url.URL
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied = r.URL
+		w.Write([]byte(okResponse))
+	}))
+	defer proxy.Close()
+
+	cfg := resolve(t, Config{Proxy: proxy.URL})
+	if _, _, err := GET(&torrent.Torrent{Announce: "http://tracker.invalid/announce"}, cfg); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if proxied == nil || proxied.Host != "tracker.invalid" {
+		t.Errorf("have: %v, want a request for tracker.invalid", proxied)
+	}
+}
+
+func TestConfigCAFile(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(okResponse))
+	}))
+	defer ts.Close()
+	tr := &torrent.Torrent{Announce: ts.URL}
+
+	// The test server's certificate is not trusted by default
+	if _, _, err := GET(tr, Config{}); err == nil {
+		t.Fatal("Should have thrown an error but didn't")
+	}
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	certificate := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ts.Certificate().Raw})
+	if err := os.WriteFile(caFile, certificate, 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg := resolve(t, Config{CAFile: caFile})
+	if _, _, err := GET(tr, cfg); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestConfigErrors(t *testing.T) {
+	notPEM := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(notPEM, []byte("not a certificate"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		cfg  Config
+	}{
+		{"bad proxy URL", Config{Proxy: "%"}},
+		{"missing CA bundle", Config{CAFile: filepath.Join(t.TempDir(), "missing.pem")}},
+		{"CA bundle without certificates", Config{CAFile: notPEM}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := tt.cfg.Resolve(); err == nil {
+				t.Error("Should have thrown an error but didn't")
+			}
+			// Without Resolve, the error comes with the request
+			if _, err := New("http://tracker.invalid/announce", tt.cfg); err == nil {
+				t.Error("Should have thrown an error but didn't")
+			}
+		})
+	}
+}
@@ -0,0 +1,75 @@
+package tracker
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+)
+
+// A FailureError is a tracker refusing a request, giving its failure reason.
+type FailureError struct {
+	Tracker string // Announce URL
+	Reason  string
+}
+
+func (e *FailureError) Error() string {
+	return fmt.Sprintf("tracker %s failed: %s", e.Tracker, e.Reason)
+}
+
+// A StatusError is an HTTP tracker answering with a status other than 200 OK.
+type StatusError struct {
+	Tracker    string
+	StatusCode int
+	Status     string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("tracker %s returned HTTP status %s", e.Tracker, e.Status)
+}
+
+// A TimeoutError is a tracker not answering in time.
+type TimeoutError struct {
+	Tracker string
+	Err     error
+}
+
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("tracker %s timed out: %v", e.Tracker, e.Err)
+}
+
+func (e *TimeoutError) Unwrap() error {
+	return e.Err
+}
+
+// Timeout reports true, so that TimeoutError satisfies net.Error.
+func (e *TimeoutError) Timeout() bool {
+	return true
+}
+
+// A MalformedResponseError is a tracker answer that cannot be understood.
+type MalformedResponseError struct {
+	Tracker string
+	Err     error
+}
+
+func (e *MalformedResponseError) Error() string {
+	return fmt.Sprintf("malformed response from tracker %s: %v", e.Tracker, e.Err)
+}
+
+func (e *MalformedResponseError) Unwrap() error {
+	return e.Err
+}
+
+// ErrNoTrackers is returned for torrents without any tracker to announce to.
+var ErrNoTrackers = errors.New("torrent has no trackers")
+
+// requestError turns an error from sending a request to a tracker into a
+// TimeoutError if it is one.
+func requestError(tracker string, err error) error {
+	var netErr net.Error
+	if errors.Is(err, os.ErrDeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		return &TimeoutError{Tracker: tracker, Err: err}
+	}
+	return err
+}
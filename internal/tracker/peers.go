@@ -0,0 +1,115 @@
+package tracker
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"karlan/torrent/internal/bencode"
+	"karlan/torrent/internal/client"
+	"net"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	PeerIpBytesCount   = 4
+	PeerPortBytesCount = 2
+	PeerSize           = PeerIpBytesCount + PeerPortBytesCount
+	Peer6Size          = net.IPv6len + PeerPortBytesCount
+)
+
+// peerDict is a peer in the original, non-compact peer list model.
+type peerDict struct {
+	PeerID string `bencode:"peer id,omitempty"`
+	IP     string `bencode:"ip"`
+	Port   int    `bencode:"port"`
+}
+
+// parsePeers parses the peers key of a tracker response, which is either a
+// compact string of IPv4 addresses and ports (BEP 23) or a list of
+// dictionaries that may also hold peer IDs.
+func parsePeers(raw bencode.RawMessage) ([]client.Client, error) {
+	if len(raw) == 0 {
+		return nil, nil
+	}
+
+	if raw[0] != 'l' {
+		var compact string
+		if err := bencode.Unmarshal(raw, &compact); err != nil {
+			return nil, fmt.Errorf("invalid 'peers': %v", err)
+		}
+		peers, err := parseCompactPeers([]byte(compact), net.IPv4len)
+		if err != nil {
+			return nil, fmt.Errorf("invalid 'peers': %v", err)
+		}
+		return peers, nil
+	}
+
+	var list []peerDict
+	if err := bencode.Unmarshal(raw, &list); err != nil {
+		return nil, fmt.Errorf("invalid 'peers': %v", err)
+	}
+
+	peers := make([]client.Client, 0, len(list))
+	for i, p := range list {
+		if p.Port <= 0 || p.Port > 65535 {
+			log.Warnf("Skipping peer %d with invalid port %d", i, p.Port)
+			continue
+		}
+
+		// The address may also be a DNS name, but looking up names a tracker
+		// hands out would let it stall every announce, so those are skipped
+		ip := net.ParseIP(p.IP)
+		if ip == nil {
+			log.Warnf("Skipping peer %d with address %q, which is not an IP address", i, p.IP)
+			continue
+		}
+
+		peer := client.New(ip, uint16(p.Port))
+		if len(p.PeerID) == len(peer.PeerID) {
+			copy(peer.PeerID[:], p.PeerID)
+		}
+		peers = append(peers, peer)
+	}
+	return peers, nil
+}
+
+// parseCompactPeers parses a compact peer list, where each peer is an IP
+// address of ipLen bytes followed by a 2-byte port, both in network order.
+func parseCompactPeers(data []byte, ipLen int) ([]client.Client, error) {
+	size := ipLen + PeerPortBytesCount
+	if len(data)%size != 0 {
+		return nil, fmt.Errorf("length %d is not a multiple of %d", len(data), size)
+	}
+
+	peers := make([]client.Client, 0, len(data)/size)
+	for i := 0; i < len(data); i += size {
+		peerBytes := data[i : i+size]
+		log.Tracef("Extracting peer %d: %s", i/size, hex.EncodeToString(peerBytes))
+
+		ip := net.IP(append([]byte{}, peerBytes[:ipLen]...))
+		port := binary.BigEndian.Uint16(peerBytes[ipLen:])
+		log.Debugf("Parsed peer: IP=%s, Port=%d", ip.String(), port)
+		peers = append(peers, client.New(ip, port))
+	}
+	return peers, nil
+}
+
+// dedupePeers removes peers with the same address, keeping the first one but
+// taking the peer ID of a later one if the first has none.
+func dedupePeers(peers []client.Client) []client.Client {
+	index := make(map[string]int, len(peers))
+	unique := peers[:0]
+	for _, peer := range peers {
+		address := peer.Address()
+		if i, ok := index[address]; ok {
+			if unique[i].PeerID == [20]byte{} {
+				unique[i].PeerID = peer.PeerID
+			}
+			continue
+		}
+		index[address] = len(unique)
+		unique = append(unique, peer)
+	}
+	return unique
+}
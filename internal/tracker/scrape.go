@@ -0,0 +1,100 @@
+package tracker
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+
+	"karlan/torrent/internal/bencode"
+)
+
+// ErrScrapeUnsupported is returned for HTTP trackers whose announce URL does
+// not follow the scrape convention, so that no scrape URL can be derived.
+var ErrScrapeUnsupported = errors.New("tracker does not support scrape")
+
+// Scrape asks the tracker at announce for statistics on the torrents with the
+// given info hashes, in as few requests as the protocol allows. HTTP trackers
+// leave out torrents they do not know, while UDP trackers report zeros.
+func Scrape(announce string, infoHashes [][20]byte, cfg Config) ([]ScrapeResult, error) {
+	tracker, err := New(announce, cfg)
+	if err != nil {
+		return nil, err
+	}
+	return tracker.Scrape(infoHashes)
+}
+
+// scrapeURL derives the scrape URL of an HTTP tracker from its announce URL by
+// the scrape convention: the last path segment must start with "announce",
+// which is replaced with "scrape".
+func scrapeURL(announce string) (*url.URL, error) {
+	u, err := url.Parse(announce)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing announce URL: %v", err)
+	}
+
+	i := strings.LastIndex(u.Path, "/")
+	if !strings.HasPrefix(u.Path[i+1:], "announce") {
+		return nil, ErrScrapeUnsupported
+	}
+	u.Path = u.Path[:i+1] + "scrape" + strings.TrimPrefix(u.Path[i+1:], "announce")
+	u.RawPath = ""
+	return u, nil
+}
+
+// scrapeResponse mirrors the bencoded dictionary returned by a scrape.
+type scrapeResponse struct {
+	FailureReason string                `bencode:"failure reason,omitempty"`
+	Files         map[string]scrapeFile `bencode:"files"` // Keyed by info hash
+}
+
+type scrapeFile struct {
+	Complete   int `bencode:"complete"`
+	Downloaded int `bencode:"downloaded"`
+	Incomplete int `bencode:"incomplete"`
+}
+
+func (h *httpTracker) Scrape(infoHashes [][20]byte) ([]ScrapeResult, error) {
+	u, err := scrapeURL(h.announce)
+	if err != nil {
+		return nil, err
+	}
+
+	// Keep any parameters of the announce URL, such as a passkey
+	params := u.Query()
+	for _, infoHash := range infoHashes {
+		params.Add("info_hash", string(infoHash[:]))
+	}
+	u.RawQuery = params.Encode()
+	log.Debugf("Created scrape request URL: %s", u)
+
+	body, err := sendTrackerRequest(h.client, h.announce, u)
+	if err != nil {
+		return nil, err
+	}
+
+	var response scrapeResponse
+	if err := bencode.Unmarshal(body, &response); err != nil {
+		return nil, &MalformedResponseError{Tracker: h.announce, Err: fmt.Errorf("error decoding body: %w", err)}
+	}
+	if response.FailureReason != "" {
+		return nil, &FailureError{Tracker: h.announce, Reason: response.FailureReason}
+	}
+
+	results := make([]ScrapeResult, 0, len(infoHashes))
+	for _, infoHash := range infoHashes {
+		file, ok := response.Files[string(infoHash[:])]
+		if !ok {
+			continue
+		}
+		results = append(results, ScrapeResult{
+			InfoHash:  infoHash,
+			Seeders:   file.Complete,
+			Completed: file.Downloaded,
+			Leechers:  file.Incomplete,
+		})
+	}
+	return results, nil
+}
@@ -0,0 +1,84 @@
+package tracker
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestScrapeURL(t *testing.T) {
+	tests := []struct {
+		announce string
+		want     string
+		wantErr  error
+	}{
+		{"http://example.com/announce", "http://example.com/scrape", nil},
+		{"http://example.com/x/announce", "http://example.com/x/scrape", nil},
+		{"http://example.com/announce.php", "http://example.com/scrape.php", nil},
+		{"http://example.com/announce?x2%0644", "http://example.com/scrape?x2%0644", nil},
+		{"http://example.com/announce?key=abc", "http://example.com/scrape?key=abc", nil},
+		{"http://example.com/a", "", ErrScrapeUnsupported},
+		{"http://example.com/announce?x=2/4", "http://example.com/scrape?x=2/4", nil},
+		{"http://example.com/x%064announce", "", ErrScrapeUnsupported},
+		{"http://example.com/announce/x", "", ErrScrapeUnsupported},
+	}
+
+	for _, tt := range tests {
+		have, err := scrapeURL(tt.announce)
+		if !errors.Is(err, tt.wantErr) {
+			t.Errorf("%s: have error %v, want %v", tt.announce, err, tt.wantErr)
+			continue
+		}
+		if err == nil && have.String() != tt.want {
+			t.Errorf("%s: have %s, want %s", tt.announce, have, tt.want)
+		}
+	}
+}
+
+func TestHTTPScrape(t *testing.T) {
+	known := [20]byte{1, 2, 3}
+	unknown := [20]byte{4, 5, 6}
+
+	var query map[string][]string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/scrape" {
+			http.NotFound(w, r)
+			return
+		}
+		query = r.URL.Query()
+		w.Write([]byte("d5:filesd20:" + string(known[:]) + "d8:completei5e10:downloadedi50e10:incompletei10eeee"))
+	}))
+	defer ts.Close()
+
+	results, err := Scrape(ts.URL+"/announce?passkey=secret", [][20]byte{known, unknown}, Config{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	want := []ScrapeResult{{InfoHash: known, Seeders: 5, Completed: 50, Leechers: 10}}
+	if !reflect.DeepEqual(results, want) {
+		t.Errorf("have: %+v, want: %+v", results, want)
+	}
+	wantQuery := map[string][]string{
+		"info_hash": {string(known[:]), string(unknown[:])},
+		"passkey":   {"secret"},
+	}
+	if !reflect.DeepEqual(query, wantQuery) {
+		t.Errorf("have query: %q, want: %q", query, wantQuery)
+	}
+
+	t.Run("failure reason", func(t *testing.T) {
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("d14:failure reason8:disablede"))
+		}))
+		defer ts.Close()
+
+		_, err := Scrape(ts.URL+"/announce", [][20]byte{known}, Config{})
+		var failure *FailureError
+		if !errors.As(err, &failure) || failure.Reason != "disabled" {
+			t.Errorf("have: %v, want: a FailureError", err)
+		}
+	})
+}
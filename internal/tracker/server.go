@@ -0,0 +1,396 @@
+package tracker
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"karlan/torrent/internal/bencode"
+	"karlan/torrent/internal/torrent"
+)
+
+const (
+	// Used when ServerOptions leaves the announce interval out
+	defaultServerInterval = 30 * time.Minute
+
+	// Peers handed out when a client does not ask for a number, and the most
+	// handed out however many it asks for
+	defaultNumWant = 50
+	maxNumWant     = 200
+
+	// Used when ServerOptions leaves the number of torrents out
+	defaultMaxSwarms = 100000
+)
+
+// ServerOptions configures a Server. Zero values choose the defaults.
+type ServerOptions struct {
+	Interval    time.Duration     // How often clients should announce; 30 minutes by default
+	MinInterval time.Duration     // How often clients may announce at most; not sent if zero
+	PeerTimeout time.Duration     // Peers that have not announced for this long are dropped; twice Interval by default
+	AllowList   map[[20]byte]bool // Info hashes of the torrents tracked; any torrent if nil
+	MaxSwarms   int               // Torrents tracked at once, after which new ones are refused; 100000 by default
+}
+
+// A Server is an HTTP tracker. It answers announces at /announce and scrapes
+// at /scrape, keeping the peers of each torrent in memory only.
+type Server struct {
+	opts ServerOptions
+	mux  *http.ServeMux
+
+	mutex     sync.Mutex
+	swarms    map[[20]byte]*swarm // By info hash
+	lastSweep time.Time
+
+	now func() time.Time // Replaced in tests
+}
+
+// swarm holds the peers of a torrent.
+type swarm struct {
+	peers     map[[20]byte]*swarmPeer // By peer ID
+	completed int                     // Completed events received
+}
+
+type swarmPeer struct {
+	id       [20]byte
+	ip       net.IP
+	port     int
+	left     int64
+	lastSeen time.Time
+}
+
+// NewServer returns a tracker configured by opts.
+func NewServer(opts ServerOptions) *Server {
+	if opts.Interval <= 0 {
+		opts.Interval = defaultServerInterval
+	}
+	if opts.PeerTimeout <= 0 {
+		opts.PeerTimeout = 2 * opts.Interval
+	}
+	if opts.MaxSwarms <= 0 {
+		opts.MaxSwarms = defaultMaxSwarms
+	}
+
+	s := &Server{
+		opts:   opts,
+		mux:    http.NewServeMux(),
+		swarms: make(map[[20]byte]*swarm),
+		now:    time.Now,
+	}
+	s.mux.HandleFunc("/announce", s.handleAnnounce)
+	s.mux.HandleFunc("/scrape", s.handleScrape)
+	return s
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+// LoadAllowList returns the info hashes of the .torrent files in dir, for use
+// as ServerOptions.AllowList.
+func LoadAllowList(dir string) (map[[20]byte]bool, error) {
+	if _, err := os.Stat(dir); err != nil {
+		return nil, err
+	}
+	paths, err := filepath.Glob(filepath.Join(dir, "*.torrent"))
+	if err != nil {
+		return nil, err
+	}
+
+	allowed := make(map[[20]byte]bool, len(paths))
+	for _, path := range paths {
+		t, err := torrent.Load(path)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		allowed[t.InfoHash] = true
+	}
+	return allowed, nil
+}
+
+// announceQuery holds the parameters of an announce.
+type announceQuery struct {
+	infoHash [20]byte
+	peerID   [20]byte
+	port     int
+	left     int64
+	event    string
+	compact  bool
+	noPeerID bool
+	numWant  int
+}
+
+func parseAnnounceQuery(values url.Values) (*announceQuery, error) {
+	q := &announceQuery{
+		event:    values.Get("event"),
+		compact:  values.Get("compact") != "0",
+		noPeerID: values.Get("no_peer_id") == "1",
+		numWant:  defaultNumWant,
+	}
+
+	infoHash, peerID := values.Get("info_hash"), values.Get("peer_id")
+	if len(infoHash) != 20 {
+		return nil, fmt.Errorf("invalid info_hash")
+	}
+	if len(peerID) != 20 {
+		return nil, fmt.Errorf("invalid peer_id")
+	}
+	copy(q.infoHash[:], infoHash)
+	copy(q.peerID[:], peerID)
+
+	var err error
+	q.port, err = strconv.Atoi(values.Get("port"))
+	if err != nil || q.port <= 0 || q.port > 65535 {
+		return nil, fmt.Errorf("invalid port")
+	}
+	q.left, err = strconv.ParseInt(values.Get("left"), 10, 64)
+	if err != nil || q.left < 0 {
+		return nil, fmt.Errorf("invalid left")
+	}
+	if _, ok := udpEvents[q.event]; !ok {
+		return nil, fmt.Errorf("invalid event")
+	}
+	if numWant, err := strconv.Atoi(values.Get("numwant")); err == nil && numWant >= 0 {
+		q.numWant = min(numWant, maxNumWant)
+	}
+	return q, nil
+}
+
+// announceReply is the bencoded dictionary sent in answer to an announce.
+type announceReply struct {
+	Interval    int         `bencode:"interval"`
+	MinInterval int         `bencode:"min interval,omitempty"`
+	Complete    int         `bencode:"complete"`
+	Incomplete  int         `bencode:"incomplete"`
+	Peers       interface{} `bencode:"peers"`            // Compact string or list of peerDict
+	Peers6      string      `bencode:"peers6,omitempty"` // Compact IPv6 peers (BEP 7)
+}
+
+type failureReply struct {
+	FailureReason string `bencode:"failure reason"`
+}
+
+func (s *Server) handleAnnounce(w http.ResponseWriter, r *http.Request) {
+	q, err := parseAnnounceQuery(r.URL.Query())
+	if err != nil {
+		s.fail(w, err.Error())
+		return
+	}
+	if s.opts.AllowList != nil && !s.opts.AllowList[q.infoHash] {
+		s.fail(w, "torrent not allowed")
+		return
+	}
+	ip := remoteIP(r)
+	if ip == nil {
+		s.fail(w, "unknown address")
+		return
+	}
+
+	peers, seeders, leechers, err := s.announce(q, ip)
+	if err != nil {
+		s.fail(w, err.Error())
+		return
+	}
+	log.Debugf("Announce from %s for %x, event %q: %d peers handed out", net.JoinHostPort(ip.String(), strconv.Itoa(q.port)), q.infoHash, q.event, len(peers))
+
+	reply := announceReply{
+		Interval:    int(s.opts.Interval / time.Second),
+		MinInterval: int(s.opts.MinInterval / time.Second),
+		Complete:    seeders,
+		Incomplete:  leechers,
+	}
+	if q.compact {
+		// IPv4 peers go in peers and IPv6 peers in peers6
+		var peers4, peers6 []byte
+		for _, p := range peers {
+			if ip4 := p.ip.To4(); ip4 != nil {
+				peers4 = binary.BigEndian.AppendUint16(append(peers4, ip4...), uint16(p.port))
+			} else {
+				peers6 = binary.BigEndian.AppendUint16(append(peers6, p.ip.To16()...), uint16(p.port))
+			}
+		}
+		reply.Peers = string(peers4)
+		reply.Peers6 = string(peers6)
+	} else {
+		list := make([]peerDict, 0, len(peers))
+		for _, p := range peers {
+			dict := peerDict{IP: p.ip.String(), Port: p.port}
+			if !q.noPeerID {
+				dict.PeerID = string(p.id[:])
+			}
+			list = append(list, dict)
+		}
+		reply.Peers = list
+	}
+	s.reply(w, reply)
+}
+
+// announce records an announce and returns the peers to hand out, which are
+// the other peers of the torrent up to the number wanted, leaving out seeders
+// for a seeder, and the number of seeders and leechers. It fails for a new
+// torrent once MaxSwarms torrents are tracked.
+func (s *Server) announce(q *announceQuery, ip net.IP) (peers []swarmPeer, seeders, leechers int, err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := s.now()
+	if now.Sub(s.lastSweep) >= s.opts.PeerTimeout {
+		s.sweep(now)
+	}
+
+	sw := s.swarms[q.infoHash]
+	if sw == nil {
+		if len(s.swarms) >= s.opts.MaxSwarms {
+			s.sweep(now)
+		}
+		if len(s.swarms) >= s.opts.MaxSwarms {
+			return nil, 0, 0, fmt.Errorf("tracker is full")
+		}
+		sw = &swarm{peers: make(map[[20]byte]*swarmPeer)}
+		s.swarms[q.infoHash] = sw
+	}
+	s.expire(sw, now)
+
+	if q.event == "stopped" {
+		delete(sw.peers, q.peerID)
+	} else {
+		// A completed event only counts once per download
+		if p := sw.peers[q.peerID]; q.event == "completed" && (p == nil || p.left > 0) {
+			sw.completed++
+		}
+		sw.peers[q.peerID] = &swarmPeer{id: q.peerID, ip: ip, port: q.port, left: q.left, lastSeen: now}
+	}
+
+	// Map order is random, so every announce gets a different selection
+	for id, p := range sw.peers {
+		if p.left == 0 {
+			seeders++
+		} else {
+			leechers++
+		}
+		if id == q.peerID || len(peers) >= q.numWant || (q.left == 0 && p.left == 0) {
+			continue
+		}
+		peers = append(peers, *p)
+	}
+
+	if len(sw.peers) == 0 && sw.completed == 0 {
+		delete(s.swarms, q.infoHash)
+	}
+	return peers, seeders, leechers, nil
+}
+
+// sweep drops expired peers from every torrent, and the torrents left without
+// peers along with their completed counts, so that torrents nobody announces
+// anymore do not pile up. Announces sweep once per PeerTimeout. The caller
+// holds the mutex.
+func (s *Server) sweep(now time.Time) {
+	s.lastSweep = now
+	for infoHash, sw := range s.swarms {
+		s.expire(sw, now)
+		if len(sw.peers) == 0 {
+			delete(s.swarms, infoHash)
+		}
+	}
+}
+
+// expire drops the peers of sw that have not announced for too long. The
+// caller holds the mutex.
+func (s *Server) expire(sw *swarm, now time.Time) {
+	for id, p := range sw.peers {
+		if now.Sub(p.lastSeen) > s.opts.PeerTimeout {
+			delete(sw.peers, id)
+		}
+	}
+}
+
+func (s *Server) handleScrape(w http.ResponseWriter, r *http.Request) {
+	var infoHashes [][20]byte
+	for _, infoHash := range r.URL.Query()["info_hash"] {
+		if len(infoHash) != 20 {
+			s.fail(w, "invalid info_hash")
+			return
+		}
+		infoHashes = append(infoHashes, [20]byte([]byte(infoHash)))
+	}
+	s.reply(w, scrapeResponse{Files: s.scrape(infoHashes)})
+}
+
+// scrape returns the statistics of the torrents with the given info hashes,
+// or of every torrent if there are none. Torrents the server does not track
+// are left out.
+func (s *Server) scrape(infoHashes [][20]byte) map[string]scrapeFile {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if len(infoHashes) == 0 {
+		for infoHash := range s.swarms {
+			infoHashes = append(infoHashes, infoHash)
+		}
+	}
+
+	now := s.now()
+	files := make(map[string]scrapeFile, len(infoHashes))
+	for _, infoHash := range infoHashes {
+		sw := s.swarms[infoHash]
+		if sw == nil {
+			if s.opts.AllowList[infoHash] {
+				files[string(infoHash[:])] = scrapeFile{}
+			}
+			continue
+		}
+
+		s.expire(sw, now)
+		var file scrapeFile
+		for _, p := range sw.peers {
+			if p.left == 0 {
+				file.Complete++
+			} else {
+				file.Incomplete++
+			}
+		}
+		file.Downloaded = sw.completed
+		files[string(infoHash[:])] = file
+	}
+	return files
+}
+
+// reply writes the bencoding of v as the response.
+func (s *Server) reply(w http.ResponseWriter, v interface{}) {
+	body, err := bencode.Marshal(v)
+	if err != nil {
+		log.Errorf("Error encoding tracker response: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write(body)
+}
+
+// fail answers with a failure reason. Like most trackers, it does so with
+// 200 OK, as clients only look for the reason in successful responses.
+func (s *Server) fail(w http.ResponseWriter, reason string) {
+	s.reply(w, failureReply{FailureReason: reason})
+}
+
+// remoteIP returns the address a request came from, with IPv4-mapped IPv6
+// addresses turned back into IPv4.
+func remoteIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return nil
+	}
+	ip := net.ParseIP(host)
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4
+	}
+	return ip
+}
@@ -0,0 +1,242 @@
+package tracker
+
+import (
+	"errors"
+	"karlan/torrent/internal/bencode"
+	"karlan/torrent/internal/torrent"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+// serverPeer announces to a Server from a fixed address.
+type serverPeer struct {
+	remote string // host:port the requests come from
+	id     string
+	port   string
+	left   string
+}
+
+func (p serverPeer) announce(t *testing.T, s *Server, infoHash [20]byte, extra url.Values) []byte {
+	t.Helper()
+	params := url.Values{
+		"info_hash": {string(infoHash[:])},
+		"peer_id":   {p.id},
+		"port":      {p.port},
+		"left":      {p.left},
+	}
+	for key, values := range extra {
+		params[key] = values
+	}
+
+	r := httptest.NewRequest("GET", "/announce?"+params.Encode(), nil)
+	r.RemoteAddr = p.remote
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	return w.Body.Bytes()
+}
+
+func peerAddresses(t *testing.T, body []byte) []string {
+	t.Helper()
+	resp, err := parseResponse("test", body)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var addresses []string
+	for _, peer := range resp.Peers {
+		addresses = append(addresses, peer.Address())
+	}
+	sort.Strings(addresses)
+	return addresses
+}
+
+func TestServerAnnounce(t *testing.T) {
+	infoHash := [20]byte{1}
+	leecher := serverPeer{"10.0.0.1:40000", "-XX0001-leecher00001", "6881", "100"}
+	leecher6 := serverPeer{"[2001:db8::1]:40000", "-XX0001-leecher00002", "6882", "100"}
+	seeder := serverPeer{"10.0.0.2:40000", "-XX0001-seeder000001", "6883", "0"}
+	seeder2 := serverPeer{"10.0.0.3:40000", "-XX0001-seeder000002", "6884", "0"}
+
+	s := NewServer(ServerOptions{Interval: time.Minute})
+	for _, p := range []serverPeer{leecher, leecher6, seeder} {
+		p.announce(t, s, infoHash, url.Values{"event": {"started"}})
+	}
+
+	t.Run("compact", func(t *testing.T) {
+		body := seeder2.announce(t, s, infoHash, nil)
+		want := []string{"10.0.0.1:6881", "[2001:db8::1]:6882"}
+		if have := peerAddresses(t, body); !reflect.DeepEqual(have, want) {
+			t.Errorf("have: %v, want: %v", have, want)
+		}
+
+		var reply announceReply
+		if err := bencode.Unmarshal(body, &reply); err != nil {
+			t.Fatal(err)
+		}
+		if reply.Interval != 60 || reply.Complete != 2 || reply.Incomplete != 2 {
+			t.Errorf("have: %+v, want interval 60, 2 seeders and 2 leechers", reply)
+		}
+	})
+
+	t.Run("non-compact", func(t *testing.T) {
+		body := leecher.announce(t, s, infoHash, url.Values{"compact": {"0"}})
+		var reply struct {
+			Peers []peerDict `bencode:"peers"`
+		}
+		if err := bencode.Unmarshal(body, &reply); err != nil {
+			t.Fatal(err)
+		}
+		sort.Slice(reply.Peers, func(i, j int) bool { return reply.Peers[i].PeerID < reply.Peers[j].PeerID })
+		want := []peerDict{
+			{PeerID: leecher6.id, IP: "2001:db8::1", Port: 6882},
+			{PeerID: seeder.id, IP: "10.0.0.2", Port: 6883},
+			{PeerID: seeder2.id, IP: "10.0.0.3", Port: 6884},
+		}
+		if !reflect.DeepEqual(reply.Peers, want) {
+			t.Errorf("have: %+v, want: %+v", reply.Peers, want)
+		}
+	})
+
+	t.Run("no peer id", func(t *testing.T) {
+		body := leecher.announce(t, s, infoHash, url.Values{"compact": {"0"}, "no_peer_id": {"1"}, "numwant": {"1"}})
+		var reply struct {
+			Peers []peerDict `bencode:"peers"`
+		}
+		if err := bencode.Unmarshal(body, &reply); err != nil {
+			t.Fatal(err)
+		}
+		if len(reply.Peers) != 1 || reply.Peers[0].PeerID != "" {
+			t.Errorf("have: %+v, want one peer without peer ID", reply.Peers)
+		}
+	})
+
+	t.Run("stopped", func(t *testing.T) {
+		leecher6.announce(t, s, infoHash, url.Values{"event": {"stopped"}})
+		body := seeder2.announce(t, s, infoHash, nil)
+		want := []string{"10.0.0.1:6881"}
+		if have := peerAddresses(t, body); !reflect.DeepEqual(have, want) {
+			t.Errorf("have: %v, want: %v", have, want)
+		}
+	})
+}
+
+func TestServerAnnounceErrors(t *testing.T) {
+	s := NewServer(ServerOptions{})
+	p := serverPeer{"10.0.0.1:40000", "-XX0001-abcdefghijkl", "6881", "0"}
+
+	tests := []struct {
+		name   string
+		peer   serverPeer
+		params url.Values
+		want   string
+	}{
+		{"short peer ID", serverPeer{p.remote, "x", p.port, p.left}, nil, "invalid peer_id"},
+		{"bad port", serverPeer{p.remote, p.id, "0", p.left}, nil, "invalid port"},
+		{"bad left", serverPeer{p.remote, p.id, p.port, "-1"}, nil, "invalid left"},
+		{"bad event", p, url.Values{"event": {"paused"}}, "invalid event"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := tt.peer.announce(t, s, [20]byte{1}, tt.params)
+			_, err := parseResponse("test", body)
+			var failure *FailureError
+			if !errors.As(err, &failure) || failure.Reason != tt.want {
+				t.Errorf("have: %v, want failure %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestServerExpiry(t *testing.T) {
+	infoHash := [20]byte{1}
+	first := serverPeer{"10.0.0.1:40000", "-XX0001-first0000000", "6881", "100"}
+	second := serverPeer{"10.0.0.2:40000", "-XX0001-second000000", "6882", "100"}
+
+	now := time.Now()
+	s := NewServer(ServerOptions{Interval: time.Minute})
+	s.now = func() time.Time { return now }
+
+	first.announce(t, s, infoHash, nil)
+	now = now.Add(90 * time.Second)
+	if have := peerAddresses(t, second.announce(t, s, infoHash, nil)); len(have) != 1 {
+		t.Errorf("have: %v, want the first peer", have)
+	}
+
+	// The first peer has missed two intervals
+	now = now.Add(60 * time.Second)
+	if have := peerAddresses(t, second.announce(t, s, infoHash, nil)); len(have) != 0 {
+		t.Errorf("have: %v, want no peers", have)
+	}
+}
+
+func TestServerSweep(t *testing.T) {
+	p := serverPeer{"10.0.0.1:40000", "-XX0001-first0000000", "6881", "100"}
+
+	now := time.Now()
+	s := NewServer(ServerOptions{Interval: time.Minute, MaxSwarms: 2})
+	s.now = func() time.Time { return now }
+
+	p.announce(t, s, [20]byte{1}, url.Values{"event": {"completed"}})
+	p.announce(t, s, [20]byte{2}, nil)
+
+	// The table is full until its peers expire
+	body := p.announce(t, s, [20]byte{3}, nil)
+	var failure *FailureError
+	if _, err := parseResponse("test", body); !errors.As(err, &failure) || failure.Reason != "tracker is full" {
+		t.Errorf("have: %v, want the tracker full", err)
+	}
+
+	// Torrents nobody announces anymore are swept by announces of others
+	now = now.Add(3 * time.Minute)
+	p.announce(t, s, [20]byte{3}, nil)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if len(s.swarms) != 1 || s.swarms[[20]byte{3}] == nil {
+		t.Errorf("have %d torrents, want only the last one", len(s.swarms))
+	}
+}
+
+func TestServerScrape(t *testing.T) {
+	sample, err := torrent.Load("../../torrents/sample.torrent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	allowList, err := LoadAllowList("../../torrents")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !allowList[sample.InfoHash] || len(allowList) != 5 {
+		t.Fatalf("have: %d torrents, want 5 including sample.torrent", len(allowList))
+	}
+
+	s := NewServer(ServerOptions{AllowList: allowList})
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	p := serverPeer{"10.0.0.1:40000", "-XX0001-abcdefghijkl", "6881", "100"}
+	p.announce(t, s, sample.InfoHash, url.Values{"event": {"started"}})
+	p.left = "0"
+	// Only the first completed event counts
+	p.announce(t, s, sample.InfoHash, url.Values{"event": {"completed"}})
+	p.announce(t, s, sample.InfoHash, url.Values{"event": {"completed"}})
+
+	notAllowed := [20]byte{1}
+	results, err := Scrape(ts.URL+"/announce", [][20]byte{sample.InfoHash, notAllowed}, Config{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := []ScrapeResult{{InfoHash: sample.InfoHash, Seeders: 1, Completed: 1}}
+	if !reflect.DeepEqual(results, want) {
+		t.Errorf("have: %+v, want: %+v", results, want)
+	}
+
+	_, err = announceTo(ts.URL+"/announce", Config{}, AnnounceRequest{InfoHash: notAllowed, Port: 6881})
+	var failure *FailureError
+	if !errors.As(err, &failure) || failure.Reason != "torrent not allowed" {
+		t.Errorf("have: %v, want: a FailureError", err)
+	}
+}
@@ -1,8 +1,7 @@
 package tracker
 
 import (
-	"encoding/binary"
-	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"net"
@@ -16,119 +15,285 @@ import (
 	"karlan/torrent/internal/torrent"
 )
 
-const (
-	PeerIpBytesCount   = 4
-	PeerPortBytesCount = 2
-	PeerSize           = PeerIpBytesCount + PeerPortBytesCount
-)
+// The largest response body read from an HTTP tracker. Even a dictionary peer
+// list of thousands of peers fits well within it.
+const maxResponseSize = 4 << 20
 
-func GET(torrent *torrent.Torrent) (int, []client.Client) {
-	baseURL := createTrackerRequest(torrent)
-	body := sendTrackerRequest(http.DefaultClient, baseURL)
-	interval, peers := parseResponse(body)
-	return interval, peers
+// A Tracker hands out the peers of torrents. Each Tracker talks to the
+// tracker at a single announce URL.
+type Tracker interface {
+	Announce(req AnnounceRequest) (*AnnounceResponse, error)
+	Scrape(infoHashes [][20]byte) ([]ScrapeResult, error)
 }
 
-func createTrackerRequest(torrent *torrent.Torrent) *url.URL {
-	// Prepare query parameters for the tracker request
-	params := url.Values{}
-	params.Add("info_hash", string(torrent.InfoHash[:]))
-	params.Add("peer_id", string(torrent.PeerID[:])) // This should ideally be dynamically generated or unique
-	params.Add("port", fmt.Sprintf("%d", torrent.Port))
-	params.Add("uploaded", fmt.Sprintf("%d", torrent.Uploaded))
-	params.Add("downloaded", fmt.Sprintf("%d", torrent.Downloaded))
-	params.Add("left", fmt.Sprintf("%d", torrent.Left))
-	params.Add("compact", "1") // Indicates compact response format is preferred
+// AnnounceRequest is what a client tells a tracker about itself and its
+// progress on a torrent.
+type AnnounceRequest struct {
+	InfoHash   [20]byte
+	PeerID     [20]byte
+	Port       int
+	Uploaded   int64
+	Downloaded int64
+	Left       int64
+	Event      string // "started", "completed", "stopped" or empty for a regular announce
+	Key        uint32 // Identifies the client across IP address changes
+	NumWant    int    // Number of peers wanted; the tracker's default if zero
+	TrackerID  string // Tracker ID from an earlier response of the same tracker
+	IP         string // Address to announce instead of the one the request comes from
+	NoPeerID   bool   // Ask HTTP trackers to leave peer IDs out of the peer list
+}
+
+// AnnounceResponse is a tracker's answer to an announce.
+type AnnounceResponse struct {
+	Interval    int // Seconds to wait before the next regular announce
+	MinInterval int // Seconds to wait at least before announcing again; zero if not given
+	TrackerID   string
+	Peers       []client.Client
+	Seeders     int    // Zero if the tracker does not report it
+	Leechers    int    // Zero if the tracker does not report it
+	Warning     string // Warning message of a tracker that answered nonetheless
+}
 
-	// Build URL with query parameters
-	baseURL, err := url.Parse(torrent.Announce)
+// ScrapeResult holds a tracker's statistics on a torrent.
+type ScrapeResult struct {
+	InfoHash  [20]byte
+	Seeders   int
+	Completed int // Number of times the torrent was downloaded
+	Leechers  int
+}
+
+// New returns a Tracker for an announce URL, chosen by its scheme, that is
+// reached as cfg sets.
+func New(announce string, cfg Config) (Tracker, error) {
+	u, err := url.Parse(announce)
 	if err != nil {
-		log.Errorf("Error parsing announce URL: %v", err)
-		return nil
+		return nil, fmt.Errorf("error parsing announce URL: %v", err)
 	}
-	baseURL.RawQuery = params.Encode()
 
-	log.Debugf("Created tracker request URL: %s", baseURL.String())
-	return baseURL
+	switch u.Scheme {
+	case "http", "https":
+		client, err := cfg.httpClient()
+		if err != nil {
+			return nil, err
+		}
+		return &httpTracker{client: client, announce: announce}, nil
+	case "udp":
+		return newUDPTracker(u, cfg.timeout())
+	default:
+		return nil, fmt.Errorf("unsupported tracker URL scheme %q", u.Scheme)
+	}
 }
 
-func sendTrackerRequest(client *http.Client, baseURL *url.URL) []byte {
-	// Make GET request
-	resp, err := client.Get(baseURL.String())
+func newAnnounceRequest(torrent *torrent.Torrent, config Config) AnnounceRequest {
+	uploaded, downloaded, left := torrent.Stats()
+	return AnnounceRequest{
+		InfoHash:   torrent.InfoHash,
+		PeerID:     torrent.PeerID,
+		Port:       torrent.Port,
+		Uploaded:   uploaded,
+		Downloaded: downloaded,
+		Left:       left,
+		NumWant:    config.NumWant,
+		IP:         config.IP,
+		NoPeerID:   config.NoPeerID,
+	}
+}
+
+// GET announces the torrent to its trackers and returns the announce interval
+// and the peers of the first tracker that answers. Trackers are tried tier by
+// tier, in the order of each tier, and one that answers is moved to the front
+// of its tier, as described in BEP 12. If none answers, the error wraps the
+// error of each tracker, which can be told apart with errors.As.
+func GET(torrent *torrent.Torrent, cfg Config) (int, []client.Client, error) {
+	resp, err := announceTiers(torrent, cfg, newAnnounceRequest(torrent, cfg), nil)
 	if err != nil {
-		log.Errorf("Error making GET request: %v", err)
-		return nil
+		return 0, nil, err
 	}
-	defer resp.Body.Close()
+	return resp.Interval, resp.Peers, nil
+}
 
-	body, err := io.ReadAll(resp.Body)
+// announceTiers sends req to the trackers of the torrent, tier by tier, until
+// one answers, and moves that one to the front of its tier. trackerIDs holds
+// the tracker IDs handed out so far by announce URL, if they are kept.
+func announceTiers(torrent *torrent.Torrent, cfg Config, req AnnounceRequest, trackerIDs map[string]string) (*AnnounceResponse, error) {
+	var errs []error
+	for tier, trackers := range torrent.Trackers() {
+		for i, announce := range trackers {
+			req.TrackerID = trackerIDs[announce]
+			resp, err := announceTo(announce, cfg, req)
+			if err != nil {
+				log.Warnf("Error announcing to tracker %s: %v", announce, err)
+				errs = append(errs, err)
+				continue
+			}
+			if trackerIDs != nil && resp.TrackerID != "" {
+				trackerIDs[announce] = resp.TrackerID
+			}
+			torrent.PromoteTracker(tier, i)
+			return resp, nil
+		}
+	}
+	if len(errs) == 0 {
+		return nil, ErrNoTrackers
+	}
+	return nil, fmt.Errorf("no tracker responded: %w", errors.Join(errs...))
+}
+
+func announceTo(announce string, cfg Config, req AnnounceRequest) (*AnnounceResponse, error) {
+	tracker, err := New(announce, cfg)
 	if err != nil {
-		log.Errorf("Error reading response body: %v", err)
-		return nil
+		return nil, err
 	}
+	return tracker.Announce(req)
+}
 
-	log.Debugf("Received tracker response: %x", body)
-	return body
+// httpTracker talks to a tracker over HTTP.
+type httpTracker struct {
+	client   *http.Client
+	announce string
 }
 
-func parseResponse(body []byte) (int, []client.Client) {
-	// Decoding Body
-	decoded, err := bencode.Decode(string(body))
+func (h *httpTracker) Announce(req AnnounceRequest) (*AnnounceResponse, error) {
+	baseURL, err := createTrackerRequest(req, h.announce)
 	if err != nil {
-		log.Errorf("Error decoding body: %v", err)
-		return 0, nil
+		return nil, err
 	}
+	body, err := sendTrackerRequest(h.client, h.announce, baseURL)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := parseResponse(h.announce, body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Warning != "" {
+		log.Warnf("Tracker %s warns: %s", h.announce, resp.Warning)
+	}
+	return resp, nil
+}
 
-	response, ok := decoded.(map[string]interface{})
-	if !ok {
-		log.Error("Decoded response is not a map[string]interface{}")
-		return 0, nil
+func createTrackerRequest(req AnnounceRequest, announce string) (*url.URL, error) {
+	baseURL, err := url.Parse(announce)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing announce URL: %v", err)
 	}
 
-	interval, ok := response["interval"].(int)
-	if !ok {
-		log.Error("Error: 'interval' field is missing or not an int")
-		return 0, nil
+	// Prepare query parameters for the tracker request, keeping any of the
+	// announce URL, such as a passkey
+	params := baseURL.Query()
+	params.Add("info_hash", string(req.InfoHash[:]))
+	params.Add("peer_id", string(req.PeerID[:]))
+	params.Add("port", fmt.Sprintf("%d", req.Port))
+	params.Add("uploaded", fmt.Sprintf("%d", req.Uploaded))
+	params.Add("downloaded", fmt.Sprintf("%d", req.Downloaded))
+	params.Add("left", fmt.Sprintf("%d", req.Left))
+	params.Add("compact", "1") // Indicates compact response format is preferred
+	if req.Event != "" {
+		params.Add("event", req.Event)
+	}
+	if req.Key != 0 {
+		params.Add("key", fmt.Sprintf("%08x", req.Key))
+	}
+	if req.NumWant > 0 {
+		params.Add("numwant", fmt.Sprintf("%d", req.NumWant))
+	}
+	if req.TrackerID != "" {
+		params.Add("trackerid", req.TrackerID)
+	}
+	if req.IP != "" {
+		params.Add("ip", req.IP)
+	}
+	if req.NoPeerID {
+		params.Add("no_peer_id", "1")
 	}
 
-	peersStr, ok := response["peers"].(string)
-	if !ok {
-		log.Error("Error: 'peers' field is missing or not a string")
-		return 0, nil
+	baseURL.RawQuery = params.Encode()
+
+	log.Debugf("Created tracker request URL: %s", baseURL.String())
+	return baseURL, nil
+}
+
+// sendTrackerRequest sends a request to the tracker at announce and returns
+// the body of its response. Anything but 200 OK is a StatusError, and a body
+// larger than maxResponseSize a MalformedResponseError.
+func sendTrackerRequest(client *http.Client, announce string, baseURL *url.URL) ([]byte, error) {
+	// Make GET request
+	resp, err := client.Get(baseURL.String())
+	if err != nil {
+		return nil, requestError(announce, err)
 	}
+	defer resp.Body.Close()
 
-	peersBytes := []byte(peersStr)
-	if len(peersBytes)%PeerSize != 0 {
-		log.Error("Error: 'peers' string length is not a multiple of 6")
-		return 0, nil
+	if resp.StatusCode != http.StatusOK {
+		return nil, &StatusError{Tracker: announce, StatusCode: resp.StatusCode, Status: resp.Status}
 	}
 
-	peersCount := len(peersBytes) / PeerSize
-	peers := make([]client.Client, 0, peersCount)
-	for i := 0; i < peersCount; i++ {
-		peerBytes := peersBytes[i*PeerSize : (i+1)*PeerSize]
-		log.Tracef("Extracting peer %d: %s", i, hex.EncodeToString(peerBytes))
-		ip, port, err := parsePeers(peerBytes)
-		if err != nil {
-			log.Warnf("Error converting bytes to PeerAddress: %v", err)
-			continue
-		}
-		peers = append(peers, client.New(ip, port))
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxResponseSize+1))
+	if err != nil {
+		return nil, requestError(announce, fmt.Errorf("error reading response body: %w", err))
+	}
+	if len(body) > maxResponseSize {
+		return nil, &MalformedResponseError{Tracker: announce, Err: fmt.Errorf("response body exceeds %d bytes", maxResponseSize)}
 	}
 
-	log.Infof("Successfully extracted %d peers", len(peers))
-	return interval, peers
+	log.Debugf("Received tracker response: %x", body)
+	return body, nil
+}
+
+// trackerResponse mirrors the bencoded dictionary returned by the tracker.
+type trackerResponse struct {
+	FailureReason  string             `bencode:"failure reason"`
+	WarningMessage string             `bencode:"warning message"`
+	Interval       int                `bencode:"interval"`
+	MinInterval    int                `bencode:"min interval"`
+	TrackerID      string             `bencode:"tracker id"`
+	Complete       int                `bencode:"complete"`
+	Incomplete     int                `bencode:"incomplete"`
+	Peers          bencode.RawMessage `bencode:"peers"`  // Compact string or list of dictionaries
+	Peers6         string             `bencode:"peers6"` // Compact IPv6 peers (BEP 7)
 }
 
-// bytesToPeerAddress converts a 6-byte array to an IP address and port.
-func parsePeers(data []byte) (net.IP, uint16, error) {
-	if len(data) != PeerSize {
-		return nil, 0, fmt.Errorf("data must be exactly %d bytes long", PeerSize)
+// parseResponse decodes the response of the tracker at announce. A failure
+// reason in it is returned as a FailureError, and anything that cannot be
+// understood as a MalformedResponseError.
+func parseResponse(announce string, body []byte) (*AnnounceResponse, error) {
+	malformed := func(format string, a ...any) error {
+		return &MalformedResponseError{Tracker: announce, Err: fmt.Errorf(format, a...)}
 	}
 
-	ip := net.IP(data[:PeerIpBytesCount])
-	port := binary.BigEndian.Uint16(data[PeerIpBytesCount:])
+	// Decoding Body
+	var response trackerResponse
+	if err := bencode.Unmarshal(body, &response); err != nil {
+		return nil, malformed("error decoding body: %w", err)
+	}
+
+	// Nothing else is given when the request failed
+	if response.FailureReason != "" {
+		return nil, &FailureError{Tracker: announce, Reason: response.FailureReason}
+	}
 
-	log.Debugf("Parsed peer: IP=%s, Port=%d", ip.String(), port)
-	return ip, port, nil
+	if response.Interval == 0 {
+		return nil, malformed("'interval' field is missing")
+	}
+
+	peers, err := parsePeers(response.Peers)
+	if err != nil {
+		return nil, malformed("%w", err)
+	}
+	peers6, err := parseCompactPeers([]byte(response.Peers6), net.IPv6len)
+	if err != nil {
+		return nil, malformed("invalid 'peers6': %w", err)
+	}
+	peers = dedupePeers(append(peers, peers6...))
+
+	log.Infof("Successfully extracted %d peers", len(peers))
+	return &AnnounceResponse{
+		Interval:    response.Interval,
+		MinInterval: response.MinInterval,
+		TrackerID:   response.TrackerID,
+		Peers:       peers,
+		Seeders:     response.Complete,
+		Leechers:    response.Incomplete,
+		Warning:     response.WarningMessage,
+	}, nil
 }
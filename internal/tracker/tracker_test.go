@@ -2,12 +2,17 @@ package tracker
 
 import (
 	"encoding/binary"
+	"errors"
+	"fmt"
 	"karlan/torrent/internal/torrent"
 	"net"
 	"net/http"
 	"net/http/httptest"
+	"reflect"
 	"strconv"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestGET(t *testing.T) {
@@ -74,15 +79,25 @@ func TestGET(t *testing.T) {
 		Downloaded: 2048,
 		Left:       4096,
 	}
-	baseURL := createTrackerRequest(torrent)
+	baseURL, err := createTrackerRequest(newAnnounceRequest(torrent, Config{}), torrent.Announce)
+	if err != nil {
+		t.Fatalf("Cannot create tracker request: %v", err)
+	}
 	// baseURL, err := url.Parse(ts.URL)
 	//
 	// if err != nil {
 	// 	t.Errorf("Cannot parse URL: %s", ts.URL)
 	// }
 
-	body := sendTrackerRequest(ts.Client(), baseURL)
-	interval, peers := parseResponse(body)
+	body, err := sendTrackerRequest(ts.Client(), torrent.Announce, baseURL)
+	if err != nil {
+		t.Fatalf("Cannot send tracker request: %v", err)
+	}
+	resp, err := parseResponse(torrent.Announce, body)
+	if err != nil {
+		t.Fatalf("Cannot parse tracker response: %v", err)
+	}
+	interval, peers := resp.Interval, resp.Peers
 
 	t.Run("Verifying interval", func(t *testing.T) {
 		have := interval
@@ -120,3 +135,298 @@ func create6ByteArray(ipStr string, port uint16, t *testing.T) [PeerSize]byte {
 
 	return data
 }
+
+func TestCreateTrackerRequest(t *testing.T) {
+	tests := []struct {
+		announce string
+		want     map[string]string
+	}{
+		{"http://tracker.test/announce", map[string]string{"port": "6881", "compact": "1"}},
+		{"http://tracker.test/announce?passkey=secret", map[string]string{"passkey": "secret", "port": "6881"}},
+		{"http://tracker.test/announce.php?uid=1&passkey=a%2Fb", map[string]string{"uid": "1", "passkey": "a/b", "left": "0"}},
+	}
+
+	for _, tt := range tests {
+		u, err := createTrackerRequest(AnnounceRequest{Port: 6881}, tt.announce)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tt.announce, err)
+			continue
+		}
+		query := u.Query()
+		for key, want := range tt.want {
+			if have := query.Get(key); have != want {
+				t.Errorf("%s: have %s=%q, want %q", tt.announce, key, have, want)
+			}
+		}
+
+		// Announce and scrape URLs keep the same parameters
+		scrape, err := scrapeURL(tt.announce)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for key, values := range scrape.Query() {
+			if have := query[key]; !reflect.DeepEqual(have, values) {
+				t.Errorf("%s: have %s=%q, want %q as when scraping", tt.announce, key, have, values)
+			}
+		}
+	}
+}
+
+func TestGETTiers(t *testing.T) {
+	response := []byte("d8:intervali60e5:peers6:\xa5\xe8\x6f\x7a\xc9\x26e")
+
+	var hits []string
+	newServer := func(name string, ok bool) *httptest.Server {
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			hits = append(hits, name)
+			if !ok {
+				w.Write([]byte("not bencode"))
+				return
+			}
+			w.Write(response)
+		}))
+		t.Cleanup(ts.Close)
+		return ts
+	}
+
+	dead := newServer("dead", false)
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+	alive := newServer("alive", true)
+	backup := newServer("backup", true)
+
+	tr := &torrent.Torrent{
+		Announce:     dead.URL,
+		AnnounceList: [][]string{{dead.URL, down.URL, alive.URL}, {backup.URL}},
+	}
+
+	interval, peers, err := GET(tr, Config{})
+	if err != nil {
+		t.Fatalf("GET failed: %v", err)
+	}
+	if interval != 60 || len(peers) != 1 {
+		t.Fatalf("have: %d, %v, want: 60 and one peer", interval, peers)
+	}
+	if want := []string{"dead", "alive"}; !reflect.DeepEqual(hits, want) {
+		t.Errorf("have: %v, want: %v", hits, want)
+	}
+
+	// The tracker that answered is tried first from now on
+	want := [][]string{{alive.URL, dead.URL, down.URL}, {backup.URL}}
+	if have := tr.Trackers(); !reflect.DeepEqual(have, want) {
+		t.Errorf("have: %v, want: %v", have, want)
+	}
+
+	t.Run("falls back to the next tier", func(t *testing.T) {
+		hits = nil
+		fallback := &torrent.Torrent{AnnounceList: [][]string{{dead.URL}, {backup.URL}}}
+		if interval, _, err := GET(fallback, Config{}); err != nil || interval != 60 {
+			t.Errorf("have: %d, %v, want: 60", interval, err)
+		}
+		if want := []string{"dead", "backup"}; !reflect.DeepEqual(hits, want) {
+			t.Errorf("have: %v, want: %v", hits, want)
+		}
+	})
+}
+
+func TestParseResponsePeers(t *testing.T) {
+	peerID := "-XX0001-abcdefghijkl"
+
+	tests := []struct {
+		name    string
+		body    string
+		want    []string
+		wantIDs map[string]string
+		wantErr bool
+	}{
+		{
+			name: "compact",
+			body: "d8:intervali60e5:peers12:\xa5\xe8\x6f\x7a\xc9\x26\x0a\x00\x00\x01\x1a\xe1e",
+			want: []string{"165.232.111.122:51494", "10.0.0.1:6881"},
+		},
+		{
+			name:    "dictionaries",
+			body:    "d8:intervali60e5:peersld2:ip15:165.232.111.1227:peer id20:" + peerID + "4:porti51494eed2:ip7:2001::14:porti6881eeee",
+			want:    []string{"165.232.111.122:51494", "[2001::1]:6881"},
+			wantIDs: map[string]string{"165.232.111.122:51494": peerID},
+		},
+		{
+			name: "compact IPv6",
+			body: "d8:intervali60e5:peers0:6:peers618:\x20\x01\x0d\xb8\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01\x1a\xe1e",
+			want: []string{"[2001:db8::1]:6881"},
+		},
+		{
+			name:    "mixed and duplicated",
+			body:    "d8:intervali60e5:peersld2:ip8:10.0.0.14:porti6881eed2:ip8:10.0.0.17:peer id20:" + peerID + "4:porti6881eee6:peers618:\x20\x01\x0d\xb8\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01\x1a\xe1e",
+			want:    []string{"10.0.0.1:6881", "[2001:db8::1]:6881"},
+			wantIDs: map[string]string{"10.0.0.1:6881": peerID},
+		},
+		{
+			name: "invalid ports are skipped",
+			body: "d8:intervali60e5:peersld2:ip8:10.0.0.14:porti0eed2:ip8:10.0.0.24:porti70000eeee",
+		},
+		{
+			name: "host names are skipped",
+			body: "d8:intervali60e5:peersld2:ip17:peer.example.test4:porti6881eed2:ip8:10.0.0.14:porti6881eeee",
+			want: []string{"10.0.0.1:6881"},
+		},
+		{
+			name: "no peers",
+			body: "d8:intervali60ee",
+		},
+		{
+			name:    "compact length",
+			body:    "d8:intervali60e5:peers5:abcdee",
+			wantErr: true,
+		},
+		{
+			name:    "peers6 length",
+			body:    "d8:intervali60e6:peers66:abcdefe",
+			wantErr: true,
+		},
+		{
+			name:    "peers of the wrong type",
+			body:    "d8:intervali60e5:peersi5ee",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := parseResponse("http://tracker.test/announce", []byte(tt.body))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if err != nil {
+				return
+			}
+
+			var have []string
+			for _, peer := range resp.Peers {
+				have = append(have, peer.Address())
+				wantID := tt.wantIDs[peer.Address()]
+				if wantID == "" && peer.PeerID != [20]byte{} || wantID != "" && string(peer.PeerID[:]) != wantID {
+					t.Errorf("%s: have peer ID %q, want %q", peer.Address(), peer.PeerID, wantID)
+				}
+			}
+			if !reflect.DeepEqual(have, tt.want) {
+				t.Errorf("have: %v, want: %v", have, tt.want)
+			}
+		})
+	}
+}
+
+func TestHTTPTrackerErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		timeout time.Duration // Of the client; 50ms if zero
+		check   func(err error) bool
+	}{
+		{
+			name: "failure reason",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte("d14:failure reason17:unknown info hashe"))
+			},
+			check: func(err error) bool {
+				var failure *FailureError
+				return errors.As(err, &failure) && failure.Reason == "unknown info hash"
+			},
+		},
+		{
+			name: "HTTP status",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				http.Error(w, "gone", http.StatusServiceUnavailable)
+			},
+			check: func(err error) bool {
+				var status *StatusError
+				return errors.As(err, &status) && status.StatusCode == http.StatusServiceUnavailable
+			},
+		},
+		{
+			name: "timeout",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				time.Sleep(200 * time.Millisecond)
+			},
+			check: func(err error) bool {
+				var timeout *TimeoutError
+				return errors.As(err, &timeout)
+			},
+		},
+		{
+			name: "malformed body",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte("<html>"))
+			},
+			check: func(err error) bool {
+				var malformed *MalformedResponseError
+				return errors.As(err, &malformed)
+			},
+		},
+		{
+			name: "oversized body",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				fmt.Fprintf(w, "d8:intervali60e5:peers%d:%se", maxResponseSize, strings.Repeat("x", maxResponseSize))
+			},
+			timeout: 30 * time.Second,
+			check: func(err error) bool {
+				var malformed *MalformedResponseError
+				return errors.As(err, &malformed) && strings.Contains(malformed.Error(), "exceeds")
+			},
+		},
+		{
+			name: "missing interval",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte("d5:peers0:e"))
+			},
+			check: func(err error) bool {
+				var malformed *MalformedResponseError
+				return errors.As(err, &malformed)
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := httptest.NewServer(tt.handler)
+			defer ts.Close()
+
+			timeout := tt.timeout
+			if timeout == 0 {
+				timeout = 50 * time.Millisecond
+			}
+			tracker := &httpTracker{client: &http.Client{Timeout: timeout}, announce: ts.URL}
+			resp, err := tracker.Announce(AnnounceRequest{})
+			if resp != nil || !tt.check(err) {
+				t.Errorf("have: %v, %v", resp, err)
+			}
+		})
+	}
+
+	t.Run("warning message", func(t *testing.T) {
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("d8:intervali60e5:peers0:15:warning message9:slow downe"))
+		}))
+		defer ts.Close()
+
+		tracker := &httpTracker{client: ts.Client(), announce: ts.URL}
+		resp, err := tracker.Announce(AnnounceRequest{})
+		if err != nil || resp.Warning != "slow down" {
+			t.Errorf("have: %v, %v, want: warning %q", resp, err, "slow down")
+		}
+	})
+
+	t.Run("GET wraps the error of every tracker", func(t *testing.T) {
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			http.NotFound(w, r)
+		}))
+		defer ts.Close()
+
+		tr := &torrent.Torrent{AnnounceList: [][]string{{ts.URL}, {"wss://tracker.test/announce"}}}
+		_, peers, err := GET(tr, Config{})
+		var status *StatusError
+		if peers != nil || !errors.As(err, &status) || status.StatusCode != http.StatusNotFound {
+			t.Errorf("have: %v, %v, want: a StatusError", peers, err)
+		}
+	})
+}
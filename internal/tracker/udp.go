@@ -0,0 +1,329 @@
+package tracker
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// UDP tracker protocol, as described in BEP 15.
+const (
+	udpProtocolID = 0x41727101980
+
+	actionConnect  = 0
+	actionAnnounce = 1
+	actionScrape   = 2
+	actionError    = 3
+
+	// A connection ID may be used for a minute after it was handed out
+	connectionIDLifetime = time.Minute
+
+	// Requests are resent after 15 * 2^n seconds, for n up to 8
+	udpTimeout    = 15 * time.Second
+	udpMaxRetries = 8
+
+	// Scrape requests hold at most this many info hashes
+	maxScrapeHashes = 74
+)
+
+// Events sent in the event field of a UDP announce.
+var udpEvents = map[string]uint32{
+	"":          0,
+	"completed": 1,
+	"started":   2,
+	"stopped":   3,
+}
+
+// udpTracker talks to a tracker over UDP. Requests go over a single socket,
+// one at a time, so that the connection ID, which trackers tie to the
+// address it was handed out to, can be reused until it expires. Once the
+// tracker has not been used for that long, the socket is closed.
+type udpTracker struct {
+	host string
+	key  udpTrackerKey
+
+	mutex        sync.Mutex
+	conn         net.Conn
+	connectionID uint64
+	connectedAt  time.Time
+	lastUsed     time.Time
+	idleTimer    *time.Timer
+
+	timeout     time.Duration // Base of the retransmission timeout
+	maxRetries  int
+	limit       time.Duration // Longest a request may take, retransmissions included
+	idleTimeout time.Duration // How long the socket is kept open without requests
+}
+
+// UDP trackers are shared by host and port so that their connection IDs
+// survive between announces, and forgotten once idle. Those used with
+// different timeouts are kept apart, so that each request gets the timeout it
+// was made with.
+var udpTrackers sync.Map // map[udpTrackerKey]*udpTracker
+
+type udpTrackerKey struct {
+	host  string
+	limit time.Duration
+}
+
+func newUDPTracker(u *url.URL, limit time.Duration) (*udpTracker, error) {
+	if u.Port() == "" {
+		return nil, fmt.Errorf("missing port in UDP tracker URL %s", u)
+	}
+	key := udpTrackerKey{u.Host, limit}
+	tracker, _ := udpTrackers.LoadOrStore(key, &udpTracker{
+		host:        u.Host,
+		key:         key,
+		timeout:     udpTimeout,
+		maxRetries:  udpMaxRetries,
+		limit:       limit,
+		idleTimeout: connectionIDLifetime,
+	})
+	return tracker.(*udpTracker), nil
+}
+
+func (u *udpTracker) Announce(req AnnounceRequest) (*AnnounceResponse, error) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	event, ok := udpEvents[req.Event]
+	if !ok {
+		return nil, fmt.Errorf("unknown event %q", req.Event)
+	}
+
+	packet := make([]byte, 98)
+	binary.BigEndian.PutUint32(packet[8:], actionAnnounce)
+	copy(packet[16:], req.InfoHash[:])
+	copy(packet[36:], req.PeerID[:])
+	binary.BigEndian.PutUint64(packet[56:], uint64(req.Downloaded))
+	binary.BigEndian.PutUint64(packet[64:], uint64(req.Left))
+	binary.BigEndian.PutUint64(packet[72:], uint64(req.Uploaded))
+	binary.BigEndian.PutUint32(packet[80:], event)
+	if ip := net.ParseIP(req.IP).To4(); ip != nil {
+		copy(packet[84:], ip)
+	}
+	binary.BigEndian.PutUint32(packet[88:], req.Key)
+	numWant := int32(-1) // The tracker's default
+	if req.NumWant > 0 {
+		numWant = int32(req.NumWant)
+	}
+	binary.BigEndian.PutUint32(packet[92:], uint32(numWant))
+	binary.BigEndian.PutUint16(packet[96:], uint16(req.Port))
+
+	response, err := u.request(packet, actionAnnounce)
+	if err != nil {
+		return nil, err
+	}
+	if len(response) < 20 {
+		return nil, u.malformed("announce response too short: %d bytes", len(response))
+	}
+
+	// Peers have the address family of the tracker
+	ipLen := net.IPv4len
+	if addr, ok := u.conn.RemoteAddr().(*net.UDPAddr); ok && addr.IP.To4() == nil {
+		ipLen = net.IPv6len
+	}
+	peers, err := parseCompactPeers(response[20:], ipLen)
+	if err != nil {
+		return nil, u.malformed("invalid peer list: %w", err)
+	}
+
+	resp := &AnnounceResponse{
+		Interval: int(binary.BigEndian.Uint32(response[8:])),
+		Leechers: int(binary.BigEndian.Uint32(response[12:])),
+		Seeders:  int(binary.BigEndian.Uint32(response[16:])),
+		Peers:    dedupePeers(peers),
+	}
+
+	log.Infof("Tracker %s returned %d peers", u.host, len(resp.Peers))
+	return resp, nil
+}
+
+// Scrape asks the tracker for statistics on the torrents with the given info
+// hashes, in batches as large as a UDP packet allows.
+func (u *udpTracker) Scrape(infoHashes [][20]byte) ([]ScrapeResult, error) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	results := make([]ScrapeResult, 0, len(infoHashes))
+	for start := 0; start < len(infoHashes); start += maxScrapeHashes {
+		batch := infoHashes[start:min(start+maxScrapeHashes, len(infoHashes))]
+
+		packet := make([]byte, 16+20*len(batch))
+		binary.BigEndian.PutUint32(packet[8:], actionScrape)
+		for i, infoHash := range batch {
+			copy(packet[16+20*i:], infoHash[:])
+		}
+
+		response, err := u.request(packet, actionScrape)
+		if err != nil {
+			return nil, err
+		}
+		if len(response) < 8+12*len(batch) {
+			return nil, u.malformed("scrape response too short: %d bytes for %d torrents", len(response), len(batch))
+		}
+
+		for i, infoHash := range batch {
+			stats := response[8+12*i:]
+			results = append(results, ScrapeResult{
+				InfoHash:  infoHash,
+				Seeders:   int(binary.BigEndian.Uint32(stats[0:])),
+				Completed: int(binary.BigEndian.Uint32(stats[4:])),
+				Leechers:  int(binary.BigEndian.Uint32(stats[8:])),
+			})
+		}
+	}
+	return results, nil
+}
+
+// request fills in the connection ID and a fresh transaction ID of packet,
+// which must leave room for both, and sends it until a response to it comes
+// back. A new connection ID is obtained first if there is none or it has
+// expired, within the same time limit.
+func (u *udpTracker) request(packet []byte, action uint32) ([]byte, error) {
+	var deadline time.Time
+	if u.limit > 0 {
+		deadline = time.Now().Add(u.limit)
+	}
+	defer u.closeWhenIdle()
+
+	if u.conn == nil {
+		conn, err := net.Dial("udp", u.host)
+		if err != nil {
+			return nil, err
+		}
+		u.conn = conn
+	}
+
+	if u.connectedAt.IsZero() || time.Since(u.connectedAt) > connectionIDLifetime {
+		if err := u.connect(deadline); err != nil {
+			return nil, err
+		}
+	}
+
+	binary.BigEndian.PutUint64(packet[0:], u.connectionID)
+	response, err := u.exchange(packet, action, deadline)
+	if err != nil {
+		// The tracker may have forgotten the connection ID before it expired
+		u.connectedAt = time.Time{}
+		return nil, err
+	}
+	return response, nil
+}
+
+// closeWhenIdle closes the socket and forgets the tracker once it has not
+// been used for idleTimeout. It is called with the mutex held.
+func (u *udpTracker) closeWhenIdle() {
+	u.lastUsed = time.Now()
+	if u.idleTimer == nil {
+		u.idleTimer = time.AfterFunc(u.idleTimeout, u.closeIdle)
+	} else {
+		u.idleTimer.Reset(u.idleTimeout)
+	}
+}
+
+func (u *udpTracker) closeIdle() {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	if time.Since(u.lastUsed) < u.idleTimeout {
+		return // Used again while the timer fired
+	}
+
+	// Anyone still holding the tracker reopens the socket on its next request
+	udpTrackers.CompareAndDelete(u.key, u)
+	if u.conn != nil {
+		u.conn.Close()
+		u.conn = nil
+	}
+	u.connectedAt = time.Time{}
+	log.Debugf("Closed idle UDP tracker %s", u.host)
+}
+
+func (u *udpTracker) connect(deadline time.Time) error {
+	packet := make([]byte, 16)
+	binary.BigEndian.PutUint64(packet[0:], udpProtocolID)
+	binary.BigEndian.PutUint32(packet[8:], actionConnect)
+
+	response, err := u.exchange(packet, actionConnect, deadline)
+	if err != nil {
+		return fmt.Errorf("error connecting: %w", err)
+	}
+	if len(response) < 16 {
+		return u.malformed("connect response too short: %d bytes", len(response))
+	}
+
+	u.connectionID = binary.BigEndian.Uint64(response[8:])
+	u.connectedAt = time.Now()
+	log.Debugf("Connected to UDP tracker %s: connection ID %x", u.host, u.connectionID)
+	return nil
+}
+
+// exchange sends packet with a new transaction ID and waits for the matching
+// response, resending it with exponential backoff until the deadline, if it
+// is not zero. Responses to earlier transactions are ignored.
+func (u *udpTracker) exchange(packet []byte, action uint32, deadline time.Time) ([]byte, error) {
+	var tid [4]byte
+	if _, err := rand.Read(tid[:]); err != nil {
+		return nil, err
+	}
+	copy(packet[12:], tid[:])
+
+	buf := make([]byte, 64*1024)
+	start := time.Now()
+	for n := 0; n <= u.maxRetries; n++ {
+		wait := u.timeout << n
+		if !deadline.IsZero() {
+			wait = min(wait, time.Until(deadline))
+			if wait <= 0 {
+				break
+			}
+		}
+
+		if _, err := u.conn.Write(packet); err != nil {
+			return nil, err
+		}
+		u.conn.SetReadDeadline(time.Now().Add(wait))
+
+		for {
+			length, err := u.conn.Read(buf)
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				log.Debugf("UDP tracker %s did not answer in time, attempt %d", u.host, n+1)
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+			if length < 8 || [4]byte(buf[4:8]) != tid {
+				continue
+			}
+
+			response := buf[:length]
+			switch got := binary.BigEndian.Uint32(response); got {
+			case action:
+				return append([]byte{}, response...), nil
+			case actionError:
+				return nil, &FailureError{Tracker: u.String(), Reason: string(response[8:])}
+			default:
+				return nil, u.malformed("unexpected action %d in response", got)
+			}
+		}
+	}
+	return nil, &TimeoutError{Tracker: u.String(), Err: fmt.Errorf("no response after %v", time.Since(start).Round(time.Millisecond))}
+}
+
+// String returns the URL of the tracker, which names it in errors.
+func (u *udpTracker) String() string {
+	return "udp://" + u.host
+}
+
+func (u *udpTracker) malformed(format string, a ...any) error {
+	return &MalformedResponseError{Tracker: u.String(), Err: fmt.Errorf(format, a...)}
+}
@@ -0,0 +1,375 @@
+package tracker
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"net/url"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeUDPTracker is an in-process stand-in for a BEP 15 tracker.
+type fakeUDPTracker struct {
+	conn net.PacketConn
+
+	mutex         sync.Mutex
+	connects      int
+	announces     []AnnounceRequest
+	event         []uint32
+	drop          int // Number of packets to ignore, to force retransmissions
+	dropAnnounces int // Number of announces to ignore once connected
+	fail          string
+}
+
+const fakeConnectionID = 0x1122334455667788
+
+func newFakeUDPTracker(t *testing.T) *fakeUDPTracker {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeUDPTracker{conn: conn}
+	t.Cleanup(func() { conn.Close() })
+	go f.serve(t)
+	return f
+}
+
+func (f *fakeUDPTracker) serve(t *testing.T) {
+	buf := make([]byte, 2048)
+	for {
+		n, addr, err := f.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		packet := buf[:n]
+
+		f.mutex.Lock()
+		if f.drop > 0 {
+			f.drop--
+			f.mutex.Unlock()
+			continue
+		}
+
+		action := binary.BigEndian.Uint32(packet[8:])
+		tid := packet[12:16]
+		var response []byte
+		switch {
+		case action == actionConnect:
+			if binary.BigEndian.Uint64(packet) != udpProtocolID {
+				t.Errorf("wrong protocol ID %x", packet[:8])
+			}
+			f.connects++
+			response = binary.BigEndian.AppendUint32(nil, actionConnect)
+			response = append(response, tid...)
+			response = binary.BigEndian.AppendUint64(response, fakeConnectionID)
+		case binary.BigEndian.Uint64(packet) != fakeConnectionID:
+			t.Errorf("wrong connection ID %x", packet[:8])
+		case f.fail != "":
+			response = binary.BigEndian.AppendUint32(nil, actionError)
+			response = append(response, tid...)
+			response = append(response, f.fail...)
+		case action == actionAnnounce && f.dropAnnounces > 0:
+			f.dropAnnounces--
+		case action == actionAnnounce:
+			var req AnnounceRequest
+			copy(req.InfoHash[:], packet[16:36])
+			copy(req.PeerID[:], packet[36:56])
+			req.Downloaded = int64(binary.BigEndian.Uint64(packet[56:]))
+			req.Left = int64(binary.BigEndian.Uint64(packet[64:]))
+			req.Uploaded = int64(binary.BigEndian.Uint64(packet[72:]))
+			req.Key = binary.BigEndian.Uint32(packet[88:])
+			req.NumWant = int(int32(binary.BigEndian.Uint32(packet[92:])))
+			req.Port = int(binary.BigEndian.Uint16(packet[96:]))
+			f.announces = append(f.announces, req)
+			f.event = append(f.event, binary.BigEndian.Uint32(packet[80:]))
+
+			// A stale response to an older transaction comes first
+			stale := binary.BigEndian.AppendUint32(nil, actionAnnounce)
+			stale = append(stale, 0xde, 0xad, 0xbe, 0xef)
+			f.conn.WriteTo(stale, addr)
+
+			response = binary.BigEndian.AppendUint32(nil, actionAnnounce)
+			response = append(response, tid...)
+			response = binary.BigEndian.AppendUint32(response, 1800) // Interval
+			response = binary.BigEndian.AppendUint32(response, 3)    // Leechers
+			response = binary.BigEndian.AppendUint32(response, 7)    // Seeders
+			response = append(response, 165, 232, 111, 122, 0xc9, 0x26)
+			response = append(response, 10, 0, 0, 1, 0x1a, 0xe1)
+		case action == actionScrape:
+			response = binary.BigEndian.AppendUint32(nil, actionScrape)
+			response = append(response, tid...)
+			for i := 16; i < len(packet); i += 20 {
+				// Statistics derived from the first byte of the info hash
+				b := uint32(packet[i])
+				response = binary.BigEndian.AppendUint32(response, b)
+				response = binary.BigEndian.AppendUint32(response, b+1)
+				response = binary.BigEndian.AppendUint32(response, b+2)
+			}
+		}
+		f.mutex.Unlock()
+
+		if response != nil {
+			f.conn.WriteTo(response, addr)
+		}
+	}
+}
+
+func (f *fakeUDPTracker) connectCount() int {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.connects
+}
+
+func (f *fakeUDPTracker) tracker(t *testing.T) *udpTracker {
+	u, err := url.Parse("udp://" + f.conn.LocalAddr().String() + "/announce")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tracker, err := newUDPTracker(u, DefaultTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tracker.timeout = 20 * time.Millisecond
+	tracker.maxRetries = 2
+	return tracker
+}
+
+func TestUDPAnnounce(t *testing.T) {
+	f := newFakeUDPTracker(t)
+	tracker := f.tracker(t)
+
+	req := AnnounceRequest{
+		InfoHash:   [20]byte{1, 2, 3},
+		PeerID:     [20]byte{4, 5, 6},
+		Port:       6881,
+		Uploaded:   1024,
+		Downloaded: 2048,
+		Left:       4096,
+		Event:      "started",
+		Key:        0xcafe,
+	}
+	resp, err := tracker.Announce(req)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if resp.Interval != 1800 || resp.Leechers != 3 || resp.Seeders != 7 {
+		t.Errorf("unexpected response: %+v", resp)
+	}
+	var addresses []string
+	for _, peer := range resp.Peers {
+		addresses = append(addresses, peer.Address())
+	}
+	if want := []string{"165.232.111.122:51494", "10.0.0.1:6881"}; !reflect.DeepEqual(addresses, want) {
+		t.Errorf("have: %v, want: %v", addresses, want)
+	}
+
+	req.Event, req.NumWant = "", -1
+	f.mutex.Lock()
+	if !reflect.DeepEqual(f.announces, []AnnounceRequest{req}) || f.event[0] != 2 {
+		t.Errorf("tracker received %+v, event %v", f.announces, f.event)
+	}
+	f.mutex.Unlock()
+
+	t.Run("caches the connection ID", func(t *testing.T) {
+		if _, err := tracker.Announce(AnnounceRequest{}); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if f.connectCount() != 1 {
+			t.Errorf("have: %d connects, want: 1", f.connectCount())
+		}
+
+		// An expired connection ID is replaced
+		tracker.connectedAt = time.Now().Add(-2 * connectionIDLifetime)
+		if _, err := tracker.Announce(AnnounceRequest{}); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if f.connectCount() != 2 {
+			t.Errorf("have: %d connects, want: 2", f.connectCount())
+		}
+	})
+
+	t.Run("retransmits lost packets", func(t *testing.T) {
+		f.mutex.Lock()
+		f.drop = 2
+		f.mutex.Unlock()
+		if _, err := tracker.Announce(AnnounceRequest{}); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("gives up", func(t *testing.T) {
+		f.mutex.Lock()
+		f.drop = 3
+		f.mutex.Unlock()
+		_, err := tracker.Announce(AnnounceRequest{})
+		var timeout *TimeoutError
+		if !errors.As(err, &timeout) {
+			t.Errorf("have: %v, want: a TimeoutError", err)
+		}
+	})
+
+	t.Run("gives up after the time limit", func(t *testing.T) {
+		f.mutex.Lock()
+		f.drop = 100
+		f.mutex.Unlock()
+		tracker.maxRetries, tracker.limit = 8, 100*time.Millisecond
+		defer func() {
+			f.mutex.Lock()
+			f.drop = 0
+			f.mutex.Unlock()
+			tracker.maxRetries, tracker.limit = 2, DefaultTimeout
+		}()
+
+		start := time.Now()
+		_, err := tracker.Announce(AnnounceRequest{})
+		var timeout *TimeoutError
+		if !errors.As(err, &timeout) {
+			t.Errorf("have: %v, want: a TimeoutError", err)
+		}
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Errorf("took %v, want about 100ms", elapsed)
+		}
+	})
+
+	t.Run("tracker error", func(t *testing.T) {
+		f.mutex.Lock()
+		f.fail = "torrent not registered"
+		f.mutex.Unlock()
+		_, err := tracker.Announce(AnnounceRequest{})
+		var failure *FailureError
+		if !errors.As(err, &failure) || failure.Reason != "torrent not registered" {
+			t.Errorf("have: %v, want: a FailureError", err)
+		}
+	})
+}
+
+func TestUDPScrape(t *testing.T) {
+	f := newFakeUDPTracker(t)
+	tracker := f.tracker(t)
+
+	// More info hashes than fit in a single request
+	infoHashes := make([][20]byte, 100)
+	for i := range infoHashes {
+		infoHashes[i][0] = byte(i)
+	}
+
+	results, err := tracker.Scrape(infoHashes)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(results) != len(infoHashes) {
+		t.Fatalf("have: %d results, want: %d", len(results), len(infoHashes))
+	}
+	for i, result := range results {
+		want := ScrapeResult{InfoHash: infoHashes[i], Seeders: i, Completed: i + 1, Leechers: i + 2}
+		if result != want {
+			t.Errorf("have: %+v, want: %+v", result, want)
+		}
+	}
+}
+
+func TestNew(t *testing.T) {
+	tests := []struct {
+		announce string
+		want     string
+		wantErr  bool
+	}{
+		{"http://tracker.example.com/announce", "*tracker.httpTracker", false},
+		{"https://tracker.example.com/announce", "*tracker.httpTracker", false},
+		{"udp://tracker.example.com:6969/announce", "*tracker.udpTracker", false},
+		{"udp://tracker.example.com/announce", "", true},
+		{"wss://tracker.example.com", "", true},
+		{"%", "", true},
+	}
+
+	for _, tt := range tests {
+		tracker, err := New(tt.announce, Config{})
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: unexpected error: %v", tt.announce, err)
+			continue
+		}
+		if err == nil && reflect.TypeOf(tracker).String() != tt.want {
+			t.Errorf("%s: have %T, want %s", tt.announce, tracker, tt.want)
+		}
+	}
+}
+
+func TestNewUDPTimeout(t *testing.T) {
+	announce := "udp://tracker.example.com:6969/announce"
+	for _, timeout := range []time.Duration{time.Second, 5 * time.Second, time.Second} {
+		tracker, err := New(announce, Config{Timeout: timeout})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if have := tracker.(*udpTracker).limit; have != timeout {
+			t.Errorf("have limit %v, want %v", have, timeout)
+		}
+	}
+}
+
+func TestUDPAnnounceTimeLimit(t *testing.T) {
+	f := newFakeUDPTracker(t)
+	tracker := f.tracker(t)
+	tracker.timeout = 50 * time.Millisecond
+	tracker.maxRetries = 8
+	tracker.limit = 500 * time.Millisecond
+
+	// Connecting takes 350ms, after three retransmissions, and the announce
+	// is never answered. The announce gets what is left of the limit, rather
+	// than a limit of its own.
+	f.mutex.Lock()
+	f.drop = 3
+	f.dropAnnounces = 100
+	f.mutex.Unlock()
+
+	start := time.Now()
+	_, err := tracker.Announce(AnnounceRequest{})
+	elapsed := time.Since(start)
+	var timeout *TimeoutError
+	if !errors.As(err, &timeout) {
+		t.Errorf("have: %v, want: a TimeoutError", err)
+	}
+	if elapsed > 700*time.Millisecond {
+		t.Errorf("announce took %v, more than its limit of %v", elapsed, tracker.limit)
+	}
+	if f.connectCount() != 1 {
+		t.Errorf("have %d connects, want 1", f.connectCount())
+	}
+}
+
+func TestUDPTrackerIdle(t *testing.T) {
+	f := newFakeUDPTracker(t)
+	tracker := f.tracker(t)
+	tracker.idleTimeout = 50 * time.Millisecond
+
+	if _, err := tracker.Announce(AnnounceRequest{}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, ok := udpTrackers.Load(tracker.key); !ok {
+		t.Fatal("tracker is not shared")
+	}
+
+	// Once idle, the socket is closed and the tracker forgotten
+	time.Sleep(200 * time.Millisecond)
+	tracker.mutex.Lock()
+	conn := tracker.conn
+	tracker.mutex.Unlock()
+	if conn != nil {
+		t.Error("socket of idle tracker is open")
+	}
+	if _, ok := udpTrackers.Load(tracker.key); ok {
+		t.Error("idle tracker is still shared")
+	}
+
+	// Whoever still holds it reconnects
+	if _, err := tracker.Announce(AnnounceRequest{}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if f.connectCount() != 2 {
+		t.Errorf("have %d connects, want 2", f.connectCount())
+	}
+}